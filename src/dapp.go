@@ -2,9 +2,12 @@ package main
 
 import (
   "encoding/json"
+  "errors"
+  "io"
   "log"
   "os"
   "fmt"
+  "math"
   "strconv"
   "io/ioutil"
   "strings"
@@ -12,6 +15,7 @@ import (
 
   "dapp/model"
   "dapp/processor"
+  "dapp/snapshot"
 
   "github.com/prototyp3-dev/go-rollups/rollups"
   "github.com/prototyp3-dev/go-rollups/handler"
@@ -26,124 +30,298 @@ var claimTimeout uint64
 var disputeTimeout uint64
 var users map[string]*model.User
 var claims map[string]*model.Claim
+var addressRegexp = regexp.MustCompile(`^0x[0-9a-fA-F]{40}$`)
+var chunkStore *processor.ChunkStore
+var claimIndex *model.ClaimIndex
+var snapshotPath string
+var snapshotInterval uint64
+var inputsSinceSnapshot uint64
 
 
 func GetUser(address string) *model.User {
   user := users[address]
   if user == nil {
-    newUser := model.User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{})}
+    newUser := model.User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{}), Delegates: make(map[string]struct{}), ClaimDelegates: make(map[string]map[string]struct{})}
     users[address] = &newUser
     user = users[address]
   }
   return user
 }
 
-func GetClaimList(payloadMap map[string]interface{}) error {
-  infolog.Println("Got claim list request")
-  claimList := []*model.SimplifiedClaim{}
-  for k, _ := range claims {
-    claimList = append(claimList, &model.SimplifiedClaim{Id:k,Status:claims[k].Status,Value:claims[k].Value})
+// CanValidate tells whether the address may send the validation inputs of a
+// claim: the claimer or one of its delegates, for all its claims or this one
+func CanValidate(claimId string, claim *model.Claim, address string) bool {
+  if address == claim.UserAddress {
+    return true
+  }
+  user := GetUser(claim.UserAddress)
+  if _, ok := user.Delegates[address]; ok {
+    return true
   }
+  _, ok := user.ClaimDelegates[claimId][address]
+  return ok
+}
+
+// ClaimTransition is the state machine context of an input on a claim
+func ClaimTransition(claimId string, metadata *rollups.Metadata) *model.TransitionContext {
+  return &model.TransitionContext{ClaimId: claimId, Claim: claims[claimId], GetUser: GetUser, Timestamp: metadata.Timestamp, ClaimTimeout: claimTimeout, DisputeTimeout: disputeTimeout, Actor: metadata.MsgSender, Index: claimIndex}
+}
 
-  claimListJson, err := json.Marshal(claimList)
+// ClaimUploader tells who sends the data of a claim: the claimer and its
+// delegates, "" for short, or any other address for a disputed claim
+func ClaimUploader(claimId string, claim *model.Claim, address string) (string,error) {
+  if CanValidate(claimId,claim,address) {
+    return "", nil
+  }
+  if claim.Status != model.Disputing {
+    return "", Fail(model.NotAuthorizedCode,"","Can only validate own claims or claims delegated to you, or provide the data of Disputing claims")
+  }
+  return address, nil
+}
+
+// ClaimKey resolves a claim id sent in an input to its key in the claims map,
+// a bare cid names the claim of the default metric and options
+func ClaimKey(claimId string) string {
+  claimKey, err := processor.CanonicalClaimKey(claimId)
   if err != nil {
-    return err
+    return claimId
   }
-  
-  report := rollups.Report{rollups.Str2Hex(string(claimListJson))}
+  return claimKey
+}
+
+// the action of the input being handled, for its reports
+var currentAction string
+
+// SendReport sends the envelope of a result of the current action, claimId
+// is the claim it is about, if any
+func SendReport(code string, claimId string, message string, payload interface{}) error {
+  envelope, err := model.NewReport(code,currentAction,claimId,message,payload)
+  if err != nil {
+    return fmt.Errorf("SendReport: %s", err)
+  }
+  envelopeJson, err := json.Marshal(envelope)
+  if err != nil {
+    return fmt.Errorf("SendReport: error converting report to json: %s", err)
+  }
+  report := rollups.Report{Payload: rollups.Str2Hex(string(envelopeJson))}
   res, err := rollups.SendReport(&report)
   if err != nil {
-    return fmt.Errorf("GetClaimList: error making http request: %s", err)
+    return fmt.Errorf("SendReport: error making http request: %s", err)
   }
   infolog.Println("Received report status", strconv.Itoa(res.StatusCode))
-  
   return nil
 }
 
+// Fail is a failed input, reported with the code by its route
+func Fail(code string, claimId string, message string) error {
+  return &model.CodeError{Code: code, Id: claimId, Err: errors.New(message)}
+}
+
+// ReportFailure reports the error of a failed input and gives it back. The
+// report is about the claim of the error or else the known claim of the 'id'.
+func ReportFailure(payloadMap map[string]interface{}, err error) error {
+  code, payload := model.ErrorReport(err)
+  claimId := ""
+  var codeErr *model.CodeError
+  if errors.As(err,&codeErr) && codeErr.Id != "" {
+    claimId = codeErr.Id
+  } else if id, ok := payloadMap["id"].(string); ok && claims[ClaimKey(id)] != nil {
+    claimId = ClaimKey(id)
+  }
+  if reportErr := SendReport(code,claimId,err.Error(),payload); reportErr != nil {
+    errlog.Println("ReportFailure:",reportErr)
+  }
+  return err
+}
+
+// NewUploadStatus is the progress of the upload of a claim
+func NewUploadStatus(claimId string, dataChunks *model.DataChunks) *model.UploadStatus {
+  return &model.UploadStatus{Id:claimId,TotalChunks:dataChunks.TotalChunks,Received:dataChunks.ReceivedChunks(),Missing:dataChunks.MissingChunks(),Stored:chunkStore.HasDataset(processor.ClaimKeyCid(claimId))}
+}
+
+// GetClaimList reports a page of the claims, filtered by the optional
+// 'status' (a name or list of names), 'claimer', 'disputer', 'minValue',
+// 'maxValue', 'deadlineFrom' and 'deadlineTo', sorted by 'sort' ('id', 'value',
+// 'lastEdited' or 'status') in 'order' ('asc' or 'desc'), and paged by 'limit'
+// and the 'cursor' of the previous page. Vector claims have no single value,
+// the value filters and sort leave them out.
+func GetClaimList(payloadMap map[string]interface{}) error {
+  infolog.Println("Got claim list request")
+  query, err := ParseClaimQuery(payloadMap)
+  var claimPage *model.ClaimPage
+  if err == nil {
+    claimPage, err = claimIndex.Query(claims,query)
+  }
+  if err != nil {
+    return Fail(model.InvalidParametersCode,"",fmt.Sprint("GetClaimList: Invalid parameters: ",err))
+  }
+
+  return SendReport(model.ClaimListCode,"","",claimPage)
+}
+
+// ParseClaimQuery reads the claim list parameters
+func ParseClaimQuery(payloadMap map[string]interface{}) (model.ClaimQuery,error) {
+  query := model.ClaimQuery{ClaimTimeout: claimTimeout, DisputeTimeout: disputeTimeout}
+
+  var statusNames []string
+  if statusName, ok := payloadMap["status"].(string); ok {
+    statusNames = []string{statusName}
+  } else if payloadMap["status"] != nil {
+    if statusNames, ok = ParseStringList(payloadMap["status"]); !ok {
+      return query, fmt.Errorf("'status' must be a status name or a list of them")
+    }
+  }
+  for _, statusName := range statusNames {
+    status, err := model.StatusFromName(statusName)
+    if err != nil {
+      return query, fmt.Errorf("'status' must be one of %v", model.Statuses)
+    }
+    query.Statuses = append(query.Statuses,status)
+  }
+
+  query.Claimer, _ = payloadMap["claimer"].(string)
+  query.Claimer = strings.ToLower(query.Claimer)
+  query.Disputer, _ = payloadMap["disputer"].(string)
+  query.Disputer = strings.ToLower(query.Disputer)
+
+  bounds := []struct {
+    key string
+    bound **uint64
+  }{
+    {"minValue",&query.MinValue},
+    {"maxValue",&query.MaxValue},
+    {"deadlineFrom",&query.DeadlineFrom},
+    {"deadlineTo",&query.DeadlineTo},
+  }
+  for _, bound := range bounds {
+    if payloadMap[bound.key] == nil {
+      continue
+    }
+    value, ok := payloadMap[bound.key].(float64)
+    if !ok || value < 0 {
+      return query, fmt.Errorf("'%s' must be a non negative number", bound.key)
+    }
+    boundValue := uint64(value)
+    *bound.bound = &boundValue
+  }
+
+  query.SortBy, _ = payloadMap["sort"].(string)
+  switch order, _ := payloadMap["order"].(string); order {
+  case "", "asc":
+  case "desc":
+    query.Descending = true
+  default:
+    return query, fmt.Errorf("'order' must be asc or desc")
+  }
+  query.Cursor, _ = payloadMap["cursor"].(string)
+  if payloadMap["limit"] != nil {
+    limit, ok := payloadMap["limit"].(float64)
+    if !ok || limit < 1 {
+      return query, fmt.Errorf("'limit' must be a positive number")
+    }
+    query.Limit = int(math.Min(limit,model.MaxClaimPageLimit))
+  }
+  return query, nil
+}
+
 func ShowUser(payloadMap map[string]interface{}) error {
   infolog.Println("Got show user request")
   userAddress, ok := payloadMap["id"].(string)
 
   if !ok || userAddress == "" {
-    message := "ShowUser: Not enough parameters, you must provide string 'id'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("ShowUser: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.InvalidParametersCode,"","ShowUser: Not enough parameters, you must provide string 'id'")
   }
 
   userAddress = strings.ToLower(userAddress)
   infolog.Println("For user user",userAddress)
 
   if users[userAddress] == nil {
-    message := "ShowUser: User doesn't exist"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("ShowUser: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.UserNotFoundCode,"","ShowUser: User doesn't exist")
   }
 
-  user := users[userAddress]
+  return SendReport(model.UserCode,"","",users[userAddress])
+}
+
+func ShowClaim(payloadMap map[string]interface{}) error {
+  infolog.Println("Got show claim request")
+  claimId, ok := payloadMap["id"].(string)
 
-  userJson, err := json.Marshal(user)
-  if err != nil {
-    return err
+  if !ok || claimId == "" {
+    return Fail(model.InvalidParametersCode,"","ShowClaim: Not enough parameters, you must provide string 'id'")
   }
-  
-  report := rollups.Report{rollups.Str2Hex(string(userJson))}
-  res, err := rollups.SendReport(&report)
-  if err != nil {
-    return fmt.Errorf("ShowUser: error making http request: %s", err)
+  claimId = ClaimKey(claimId)
+  infolog.Println("For claim",claimId)
+
+  if claims[claimId] == nil {
+    return Fail(model.ClaimNotFoundCode,"","ShowClaim: Claim doesn't exist")
   }
-  infolog.Println("Received report status", strconv.Itoa(res.StatusCode))
   
-  return nil
+  return SendReport(model.ClaimCode,claimId,"",model.NewClaimDetails(claims[claimId]))
 }
 
-func ShowClaim(payloadMap map[string]interface{}) error {
-  infolog.Println("Got show claim request")
+// ClaimHistory reports the history of a claim, only the entries of the
+// optional 'type'
+func ClaimHistory(payloadMap map[string]interface{}) error {
+  infolog.Println("Got claim history request")
   claimId, ok := payloadMap["id"].(string)
 
   if !ok || claimId == "" {
-    message := "ShowClaim: Not enough parameters, you must provide string 'id'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("ShowClaim: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.InvalidParametersCode,"","ClaimHistory: Not enough parameters, you must provide string 'id'")
   }
-  infolog.Println("For claim",claimId)
+  claimId = ClaimKey(claimId)
 
   if claims[claimId] == nil {
-    message := "ShowClaim: Claim doesn't exist"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("ShowClaim: error making http request: %s", err)
+    return Fail(model.ClaimNotFoundCode,"","ClaimHistory: Claim doesn't exist")
+  }
+
+  history := claims[claimId].History
+  if entryType, ok := payloadMap["type"].(string); ok && entryType != "" {
+    known := false
+    for _, historyType := range model.HistoryTypes() {
+      known = known || historyType == entryType
     }
-    return fmt.Errorf(message)
+    if !known {
+      return Fail(model.InvalidParametersCode,"",fmt.Sprint("ClaimHistory: Invalid 'type', history entries are of types ",model.HistoryTypes()))
+    }
+    filtered := []model.HistoryEntry{}
+    for _, entry := range history {
+      if entry.Type == entryType {
+        filtered = append(filtered,entry)
+      }
+    }
+    history = filtered
   }
-  
-  claim := claims[claimId]
-  
-  claimJson, err := json.Marshal(claim)
-  if err != nil {
-    return err
+  if history == nil {
+    history = []model.HistoryEntry{}
   }
-  
-  report := rollups.Report{rollups.Str2Hex(string(claimJson))}
-  res, err := rollups.SendReport(&report)
-  if err != nil {
-    return fmt.Errorf("ShowClaim: error making http request: %s", err)
+
+  return SendReport(model.ClaimHistoryCode,claimId,"",&model.ClaimHistory{Id:claimId,History:history})
+}
+
+// UploadStatus reports the chunks of a claim upload received and still missing
+func UploadStatus(payloadMap map[string]interface{}) error {
+  infolog.Println("Got upload status request")
+  claimId, ok := payloadMap["id"].(string)
+
+  if !ok || claimId == "" {
+    return Fail(model.InvalidParametersCode,"","UploadStatus: Not enough parameters, you must provide string 'id'")
   }
-  infolog.Println("Received report status", strconv.Itoa(res.StatusCode))
-  
-  return nil
+  claimId = ClaimKey(claimId)
+
+  if claims[claimId] == nil {
+    return Fail(model.ClaimNotFoundCode,"","UploadStatus: Claim doesn't exist")
+  }
+
+  // third parties providing the data of a disputed claim give their address
+  dataChunks := claims[claimId].DataChunks
+  if address, ok := payloadMap["address"].(string); ok && address != "" && strings.ToLower(address) != claims[claimId].UserAddress {
+    dataChunks = claims[claimId].Uploads[strings.ToLower(address)]
+  }
+  if dataChunks == nil {
+    dataChunks = &model.DataChunks{}
+  }
+
+  return SendReport(model.UploadStatusCode,claimId,"",NewUploadStatus(claimId,dataChunks))
 }
 
 func GetWasm(payloadMap map[string]interface{}) error {
@@ -164,10 +342,10 @@ func GetWasm(payloadMap map[string]interface{}) error {
         return fmt.Errorf("GetWasm: error opening file %s: %s", file.Name(), err)
       }
       
-      report := rollups.Report{rollups.Bin2Hex(fileBytes)}
+      report := rollups.Report{Payload: rollups.Bin2Hex(fileBytes)}
       res, err := rollups.SendReport(&report)
       if err != nil {
-        return fmt.Errorf("ShowClaim: error making http request: %s", err)
+        return fmt.Errorf("GetWasm: error making http request: %s", err)
       }
       infolog.Println("Received report status", strconv.Itoa(res.StatusCode))  
     }
@@ -175,45 +353,248 @@ func GetWasm(payloadMap map[string]interface{}) error {
   return nil
 }
 
+// CheckStats reports whether the user stats match the ones rebuilt from the
+// claims, for all users or the one of the optional 'id'
+func CheckStats(payloadMap map[string]interface{}) error {
+  infolog.Println("Got check stats request")
+  statsReport := UserStatsReport()
+
+  if userAddress, ok := payloadMap["id"].(string); ok && userAddress != "" {
+    userAddress = strings.ToLower(userAddress)
+    divergences := []model.StatsDivergence{}
+    for _, divergence := range statsReport.Divergences {
+      if divergence.Address == userAddress {
+        divergences = append(divergences,divergence)
+      }
+    }
+    statsReport.Divergences = divergences
+    statsReport.Consistent = len(divergences) == 0
+  }
+
+  return SendReport(model.StatsCode,"","",statsReport)
+}
+
+// UserStatsReport checks the stats of every user against the claims
+func UserStatsReport() *model.StatsReport {
+  divergences := model.CheckUserStats(users,claims)
+  return &model.StatsReport{Consistent: len(divergences) == 0, Users: len(users), Claims: len(claims), Divergences: divergences}
+}
+
+// CheckedAdvance reports the failures of an advance route, checks the user
+// stats after each accepted input and saves the state snapshot at the
+// checkpoints
+func CheckedAdvance(action string, handle handler.AdvanceMapHandlerFunc) handler.AdvanceMapHandlerFunc {
+  return func(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+    currentAction = action
+    if err := handle(metadata,payloadMap); err != nil {
+      return ReportFailure(payloadMap,err)
+    }
+    if err := ReportStatsDivergences(metadata.InputIndex); err != nil {
+      return err
+    }
+    Checkpoint(metadata.InputIndex)
+    return nil
+  }
+}
+
+// ReportedInspect reports the failures of an inspect route
+func ReportedInspect(action string, handle handler.InspectMapHandlerFunc) handler.InspectMapHandlerFunc {
+  return func(payloadMap map[string]interface{}) error {
+    currentAction = action
+    if err := handle(payloadMap); err != nil {
+      return ReportFailure(payloadMap,err)
+    }
+    return nil
+  }
+}
+
+// ReportStatsDivergences flags the user stats that diverge from the claims in
+// the log and in a report. The input is kept, the stats are only derived data.
+func ReportStatsDivergences(inputIndex uint64) error {
+  statsReport := UserStatsReport()
+  if statsReport.Consistent {
+    return nil
+  }
+  for _, divergence := range statsReport.Divergences {
+    errlog.Println("ReportStatsDivergences: input",inputIndex,"diverged",divergence)
+  }
+  return SendReport(model.StatsDivergenceCode,"",fmt.Sprint("User stats diverged from the claims at input ",inputIndex),statsReport)
+}
+
+// Checkpoint saves the state snapshot every snapshotInterval accepted inputs,
+// when a snapshot path is set. A failed write is logged, the state is fine.
+func Checkpoint(inputIndex uint64) {
+  if snapshotPath == "" {
+    return
+  }
+  inputsSinceSnapshot += 1
+  if inputsSinceSnapshot < snapshotInterval {
+    return
+  }
+  inputsSinceSnapshot = 0
+  if err := snapshot.Write(snapshotPath,snapshot.Capture(inputIndex,users,claims,chunkStore)); err != nil {
+    errlog.Println("Checkpoint:",err)
+    return
+  }
+  infolog.Println("Saved snapshot of input",inputIndex,"to",snapshotPath)
+}
+
+// RestoreSnapshot loads the state of the snapshot at the snapshot path, if
+// there is one
+func RestoreSnapshot() error {
+  savedSnapshot, err := snapshot.Read(snapshotPath)
+  if errors.Is(err,os.ErrNotExist) {
+    infolog.Println("No snapshot at",snapshotPath)
+    return nil
+  }
+  if err != nil {
+    return fmt.Errorf("RestoreSnapshot: %s", err)
+  }
+  restoredUsers, restoredClaims, restoredStore, err := savedSnapshot.Restore(UploadHolder)
+  if err != nil {
+    return fmt.Errorf("RestoreSnapshot: %s", err)
+  }
+  users, claims, chunkStore = restoredUsers, restoredClaims, restoredStore
+  claimIndex = model.NewClaimIndex(claims)
+  infolog.Println("Restored snapshot of input",savedSnapshot.InputIndex,"with",len(claims),"claims and",len(users),"users")
+  return nil
+}
+
 // Receive and store claim
 func HandleClaim(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
   infolog.Println("Got claim request")
-  user := GetUser(metadata.MsgSender)
 
-  claimId, ok1 := payloadMap["id"].(string)
-  claimValueFloat, ok2 := payloadMap["value"].(float64) // value 100,000 == 100%
+  claimId, ok := payloadMap["id"].(string)
+
+  if !ok || claimId == "" {
+    return Fail(model.InvalidParametersCode,"","HandleClaim: Not enough parameters, you must provide string 'id' and uint 'value'")
+  }
 
-  if !ok1 || !ok2 || claimId == "" || claimValueFloat > 1000000 {
-    message := "HandleClaim: Not enough parameters, you must provide string 'id' and uint 'value'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
+  // claims are keyed by the canonical form of the cid, the metric and options
+  canonicalId, err := processor.CanonicalCid(claimId)
+  if err != nil {
+    return Fail(model.InvalidParametersCode,"",fmt.Sprint("HandleClaim: Invalid 'id', it must be a supported CID: ",err))
+  }
+
+  // optional metric, defaults to blank cell permillionage
+  metricName, _ := payloadMap["metric"].(string)
+  metric, err := processor.GetMetric(metricName)
+  if err != nil {
+    return Fail(model.InvalidParametersCode,"",fmt.Sprint("HandleClaim: Invalid metric, available metrics are ",processor.ListMetrics()))
+  }
+
+  claim := model.Claim{Metric: metric.Name(), NullTokens: model.DefaultNullTokens(), LastEdited: metadata.Timestamp, UserAddress: metadata.MsgSender}
+
+  // optional null tokens, defaults to case insensitive "na"
+  if payloadMap["nullTokens"] != nil {
+    nullTokens, ok := ParseStringList(payloadMap["nullTokens"])
+    if !ok {
+      return Fail(model.InvalidParametersCode,"","HandleClaim: Invalid parameters, 'nullTokens' must be a string list")
+    }
+    claim.NullTokens.Tokens = nullTokens
+  }
+  claim.NullTokens.CaseSensitive, _ = payloadMap["nullCaseSensitive"].(bool)
+  claim.NullTokens.TrimSpace, _ = payloadMap["nullTrimSpace"].(bool)
+
+  // optional csv dialect, defaults to comma separated with one header row
+  claim.Dialect = model.DefaultDialect()
+  if delimiter, ok := payloadMap["delimiter"].(string); ok {
+    claim.Dialect.Delimiter = delimiter
+  }
+  claim.Dialect.Comment, _ = payloadMap["comment"].(string)
+  claim.Dialect.LazyQuotes, _ = payloadMap["lazyQuotes"].(bool)
+  claim.Dialect.TrimLeadingSpace, _ = payloadMap["trimLeadingSpace"].(bool)
+  if headerRows, ok := payloadMap["headerRows"].(float64); ok && headerRows >= 0 {
+    claim.Dialect.HeaderRows = uint32(headerRows)
+  }
+  if err = processor.ValidateDialect(claim.Dialect); err != nil {
+    return Fail(model.InvalidParametersCode,"",fmt.Sprint("HandleClaim: Invalid dialect: ",err))
+  }
+
+  if metric.Vector() {
+    // vector claims commit to the header columns and either all values or their hash
+    columns, ok1 := ParseStringList(payloadMap["columns"])
+    values, ok2 := ParseUintList(payloadMap["values"])
+    valuesHash, ok3 := payloadMap["valuesHash"].(string)
+
+    if !ok1 || len(columns) == 0 || (!ok2 && !ok3) || (ok2 && len(values) != len(columns)) {
+      return Fail(model.InvalidParametersCode,"","HandleClaim: Not enough parameters, vector claims must provide string list 'columns' and either uint list 'values' or string 'valuesHash'")
+    }
+    for _, value := range values {
+      if value > metric.MaxValue() {
+        return Fail(model.InvalidParametersCode,"",fmt.Sprintf("HandleClaim: Value greater than %s max value %d",metric.Name(),metric.MaxValue()))
+      }
+    }
+    claim.Columns = columns
+    if ok2 {
+      claim.Values = values
+      claim.ValuesHash = processor.HashMetricVector(columns,values)
+    } else {
+      claim.ValuesHash = strings.ToLower(valuesHash)
+    }
+  } else {
+    claimValueFloat, ok := payloadMap["value"].(float64) // value 100,000 == 100%
+
+    if !ok || claimValueFloat < 0 {
+      return Fail(model.InvalidParametersCode,"","HandleClaim: Not enough parameters, you must provide string 'id' and uint 'value'")
+    }
+    claim.Value = uint64(claimValueFloat)
+    if claim.Value > metric.MaxValue() {
+      return Fail(model.InvalidParametersCode,"",fmt.Sprintf("HandleClaim: Value greater than %s max value %d",metric.Name(),metric.MaxValue()))
+    }
+  }
+
+  // optional dispute mode, bisection and spot check claims commit to a tree of
+  // per chunk (or per row) partials
+  claim.DisputeMode, _ = payloadMap["disputeMode"].(string)
+  switch claim.DisputeMode {
+  case "":
+  case model.BisectionDispute, model.SpotCheckDispute:
+    leavesKey := "bisectionLeaves"
+    if claim.DisputeMode == model.SpotCheckDispute {
+      leavesKey = "spotCheckRows"
+    }
+    commitment, ok := ParseTreeCommitment(payloadMap,claim.DisputeMode,leavesKey)
+    if !ok {
+      prefix := claim.DisputeMode
+      return Fail(model.InvalidParametersCode,"",fmt.Sprintf("HandleClaim: Not enough parameters, %s claims must provide strings '%sRoot' and '%sFinalState', uint list '%sPartial' and uints '%s' and '%sWidth'",prefix,prefix,prefix,prefix,leavesKey,prefix))
+    }
+
+    dataCid, err := processor.DecodeClaimCid(canonicalId)
     if err != nil {
-      return fmt.Errorf("HandleSet: error making http request: %s", err)
+      return fmt.Errorf("HandleClaim: %s", err)
+    }
+    var result *processor.MetricResult
+    options := processor.ClaimMetricOptions(&claim)
+    if claim.DisputeMode == model.BisectionDispute {
+      claim.Bisection, result, err = processor.NewBisection(dataCid,metric,options,claim.Columns,commitment.Root,commitment.FinalState,commitment.Partial,commitment.Leaves,commitment.Width)
+    } else {
+      claim.SpotCheck, result, err = processor.NewSpotCheck(dataCid,metric,options,claim.Columns,commitment.Root,commitment.FinalState,commitment.Partial,commitment.Leaves,commitment.Width)
+    }
+    if err == nil && !ClaimMatchesResult(&claim,result) {
+      err = fmt.Errorf("committed partial doesn't match the claimed value")
     }
-    return fmt.Errorf(message)
+    if err != nil {
+      return Fail(model.InvalidParametersCode,"",fmt.Sprint("HandleClaim: Invalid ",claim.DisputeMode," commitment: ",err))
+    }
+  default:
+    return Fail(model.InvalidParametersCode,"",fmt.Sprint("HandleClaim: Invalid dispute mode ",claim.DisputeMode))
   }
-  claimValue := uint64(claimValueFloat)
 
   // Check if claim already exists
+  claimId = processor.NewClaimKey(canonicalId,metric.Name(),processor.ClaimMetricOptions(&claim))
   if claims[claimId] != nil {
-    return fmt.Errorf("HandleClaim: Claim already exists")
+    return Fail(model.ClaimExistsCode,claimId,"HandleClaim: Claim already exists")
   }
 
-  claim := model.Claim{Status: model.Open, Value: claimValue, LastEdited: metadata.Timestamp, UserAddress: metadata.MsgSender}
   claims[claimId] = &claim
-  user.OpenClaims[claimId] = struct{}{}
-
-  message := fmt.Sprint("Claim ",claimId," created: ", claim)
-  
-  report := rollups.Report{rollups.Str2Hex(message)}
-  _, err := rollups.SendReport(&report)
-  if err != nil {
-    return fmt.Errorf("HandleClaim: error making http request: %s", err)
+  if err := model.Fire(ClaimTransition(claimId,metadata),model.ClaimEvent); err != nil {
+    return fmt.Errorf("HandleClaim: %w", err)
   }
 
-  infolog.Println(message)
+  infolog.Println("Claim",claimId,"created")
 
-  return nil
+  return SendReport(model.ClaimCreatedCode,claimId,"",model.NewClaimDetails(&claim))
 }
 
 // Finalize a claim
@@ -223,77 +604,26 @@ func HandleFinalize(metadata *rollups.Metadata, payloadMap map[string]interface{
   
   claimId, ok := payloadMap["id"].(string)
   if !ok || claimId == "" {
-    message := "HandleFinalize: Not enough parameters, you must provide string 'claimId'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("HandleFinalize: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.InvalidParametersCode,"","HandleFinalize: Not enough parameters, you must provide string 'claimId'")
   }
 
   // Check if claim exists
+  claimId = ClaimKey(claimId)
   if claims[claimId] == nil {
-    return fmt.Errorf("HandleFinalize: Claim doesn't exist")
+    return Fail(model.ClaimNotFoundCode,"","HandleFinalize: Claim doesn't exist")
   }
   claim := claims[claimId]
 
-  switch claim.Status {
-  case model.Open:
-    // Check if enought time passed
-    if metadata.Timestamp < claim.LastEdited + claimTimeout {
-      secondsToAccept := claim.LastEdited + claimTimeout - metadata.Timestamp
-      return fmt.Errorf("HandleFinalize: Claim can't be finalized yet, %d more seconds to go",secondsToAccept)
-    }
-    
-    // finalize claim
-    claim.Status = model.Finalized // change status
-    claim.LastEdited = metadata.Timestamp
-    
-    user := GetUser(claim.UserAddress)
-    user.TotalClaims += 1 // add to user finalized claims
-    user.CorrectClaims += 1 // add to user finalized correct claims
-
-    delete(user.OpenClaims,claimId) // delete from users open claims 
-
-  case model.Disputing:
-    // finalizing disputing claims is always lost dispute
-
-    // Check if enought time passed
-    if metadata.Timestamp < claim.LastEdited + disputeTimeout {
-      secondsToAccept := claim.LastEdited + disputeTimeout - metadata.Timestamp
-      return fmt.Errorf("HandleFinalize: Claim can't be finalized yet, %d more seconds to go",secondsToAccept)
-    }
-    
-    // finalize claim
-    claim.Status = model.Disputed // change status
-    claim.LastEdited = metadata.Timestamp
-    
-    user := GetUser(claim.UserAddress)
-    user.TotalClaims += 1 // add to user finalized claims
-    user.TotalDisputes += 1 // add to user disputes
-    delete(user.OpenDisputes,claimId) // delete from users open claims 
-
-    disputingUser := GetUser(claim.DisputingUserAddress)
-    disputingUser.TotalDisputes += 1 // add to user disputes
-    disputingUser.WonDisputes += 1 // add to user won disputes
-
-  default:
-    return fmt.Errorf("HandleFinalize: Can only finalize Open or Disputing claims")
-
-  }
-
-  message := fmt.Sprint("Claim ",claimId," finalized: ", claim)
-  
-  report := rollups.Report{rollups.Str2Hex(message)}
-  _, err := rollups.SendReport(&report)
-  if err != nil {
-    return fmt.Errorf("HandleFinalize: error making http request: %s", err)
+  // open claims are accepted after their timeout, disputes are lost by who
+  // doesn't answer in time
+  if err := model.Fire(ClaimTransition(claimId,metadata),model.FinalizeEvent); err != nil {
+    return fmt.Errorf("HandleFinalize: %w", err)
   }
+  ReleaseClaim(claimId)
 
-  infolog.Println(message)
+  infolog.Println("Claim",claimId,"finalized")
 
-  return nil
+  return SendReport(model.ClaimFinalizedCode,claimId,"",model.NewClaimDetails(claim))
 }
 
 // Dispute a claim
@@ -303,49 +633,219 @@ func HandleDispute(metadata *rollups.Metadata, payloadMap map[string]interface{}
   // check claim id
   claimId, ok := payloadMap["id"].(string)
   if !ok || claimId == "" {
-    message := "HandleDispute: Not enough parameters, you must provide string 'claimId'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("HandleDispute: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.InvalidParametersCode,"","HandleDispute: Not enough parameters, you must provide string 'claimId'")
   }
 
   // Check if claim exists
+  claimId = ClaimKey(claimId)
   if claims[claimId] == nil {
-    return fmt.Errorf("HandleDispute: Claim doesn't exist")
+    return Fail(model.ClaimNotFoundCode,"","HandleDispute: Claim doesn't exist")
   }
   claim := claims[claimId]
 
-  if claim.Status != model.Open {
-    return fmt.Errorf("HandleDispute: Can only dispute Open claims")
+  transition := ClaimTransition(claimId,metadata)
+  transition.Sender = metadata.MsgSender
+  if err := model.Allowed(transition,model.DisputeEvent); err != nil {
+    return fmt.Errorf("HandleDispute: %w", err)
   }
 
-  if claim.UserAddress == metadata.MsgSender {
-    return fmt.Errorf("HandleDispute: Can not dispute own claims")
+  if CanValidate(claimId,claim,metadata.MsgSender) {
+    return Fail(model.NotAuthorizedCode,"","HandleDispute: Can not dispute own claims or claims delegated to you")
   }
 
   // dispute claim
-  claim.Status = model.Disputing // change status
-  claim.DisputingUserAddress = metadata.MsgSender
-  claim.LastEdited = metadata.Timestamp
+  if err := model.Fire(transition,model.DisputeEvent); err != nil {
+    return fmt.Errorf("HandleDispute: %w", err)
+  }
 
-  user := GetUser(claim.UserAddress)
-  user.OpenDisputes[claimId] = struct{}{} // add to users open disputes
-  delete(user.OpenClaims,claimId) // delete from users open claims 
+  if claim.SpotCheck != nil {
+    // the rows the claimer has to prove come from the dispute input
+    claim.SpotCheck.Samples = processor.SampleRows(claimId,metadata.BlockNumber,metadata.Timestamp,claim.SpotCheck.Rows,processor.SpotCheckSamples)
+    claim.SpotCheck.Checked = nil
+  }
 
-  message := fmt.Sprint("Claim ",claimId," disputed: ", claim)
-  
-  report := rollups.Report{rollups.Str2Hex(message)}
-  _, err := rollups.SendReport(&report)
+  infolog.Println("Claim",claimId,"disputed")
+
+  return SendReport(model.ClaimDisputedCode,claimId,"",model.NewClaimDetails(claim))
+}
+
+// Reveal the children of the bisection node in question
+func HandleRevealBisection(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+  infolog.Println("Got reveal bisection request")
+
+  claimId, ok1 := payloadMap["id"].(string)
+  leftHash, ok2 := payloadMap["leftHash"].(string)
+  rightHash, ok3 := payloadMap["rightHash"].(string)
+  midState, ok4 := payloadMap["midState"].(string)
+  leftPartial, ok5 := ParseUintList(payloadMap["leftPartial"])
+  rightPartial, ok6 := ParseUintList(payloadMap["rightPartial"])
+
+  if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 || claimId == "" {
+    return Fail(model.InvalidParametersCode,"","HandleRevealBisection: Not enough parameters, you must provide strings 'id', 'leftHash', 'rightHash' and 'midState' and uint lists 'leftPartial' and 'rightPartial'")
+  }
+
+  // Check if claim exists
+  claimId = ClaimKey(claimId)
+  if claims[claimId] == nil {
+    return Fail(model.ClaimNotFoundCode,"","HandleRevealBisection: Claim doesn't exist")
+  }
+  claim := claims[claimId]
+
+  transition := ClaimTransition(claimId,metadata)
+  if err := model.Allowed(transition,model.RevealEvent); err != nil {
+    return fmt.Errorf("HandleRevealBisection: %w", err)
+  }
+
+  if !CanValidate(claimId,claim,metadata.MsgSender) {
+    return Fail(model.NotAuthorizedCode,"","HandleRevealBisection: Can only reveal bisections of own claims or claims delegated to you")
+  }
+
+  bisection := claim.Bisection
+  if bisection.Left != nil {
+    return fmt.Errorf("HandleRevealBisection: Waiting for the disputer to choose a side")
+  }
+
+  left, err := processor.NewBisectionNode(leftHash,bisection.Node.StateIn,midState,leftPartial)
   if err != nil {
-    return fmt.Errorf("HandleDispute: error making http request: %s", err)
+    return fmt.Errorf("HandleRevealBisection: %s", err)
+  }
+  right, err := processor.NewBisectionNode(rightHash,left.StateOut,bisection.Node.StateOut,rightPartial)
+  if err != nil {
+    return fmt.Errorf("HandleRevealBisection: %s", err)
+  }
+  if err = processor.VerifyBisectionChildren(bisection,left,right); err != nil {
+    return fmt.Errorf("HandleRevealBisection: %s", err)
   }
 
-  infolog.Println(message)
+  bisection.Left = &left
+  bisection.Right = &right
+  if err := model.Fire(transition,model.RevealEvent); err != nil {
+    return fmt.Errorf("HandleRevealBisection: %w", err)
+  }
 
-  return nil
+  infolog.Println("Claim",claimId,"bisection revealed")
+
+  return SendReport(model.BisectionRevealedCode,claimId,"",model.NewClaimDetails(claim))
+}
+
+// Choose the revealed bisection child the disputer disagrees with
+func HandleChooseBisection(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+  infolog.Println("Got choose bisection request")
+
+  claimId, ok1 := payloadMap["id"].(string)
+  side, ok2 := payloadMap["side"].(string)
+
+  if !ok1 || !ok2 || claimId == "" || (side != "left" && side != "right") {
+    return Fail(model.InvalidParametersCode,"","HandleChooseBisection: Not enough parameters, you must provide string 'id' and 'side' (left or right)")
+  }
+
+  // Check if claim exists
+  claimId = ClaimKey(claimId)
+  if claims[claimId] == nil {
+    return Fail(model.ClaimNotFoundCode,"","HandleChooseBisection: Claim doesn't exist")
+  }
+  claim := claims[claimId]
+
+  transition := ClaimTransition(claimId,metadata)
+  if err := model.Allowed(transition,model.ChooseEvent); err != nil {
+    return fmt.Errorf("HandleChooseBisection: %w", err)
+  }
+
+  if claim.DisputingUserAddress != metadata.MsgSender {
+    return Fail(model.NotAuthorizedCode,"","HandleChooseBisection: Can only choose bisections of own disputes")
+  }
+
+  bisection := claim.Bisection
+  if bisection.Left == nil {
+    return fmt.Errorf("HandleChooseBisection: Waiting for the claimer to reveal a bisection")
+  }
+
+  mid := processor.BisectionSplit(bisection.Start,bisection.End)
+  if side == "left" {
+    bisection.Node = *bisection.Left
+    bisection.End = mid
+  } else {
+    bisection.Node = *bisection.Right
+    bisection.Start = mid
+  }
+  bisection.Left = nil
+  bisection.Right = nil
+  if err := model.Fire(transition,model.ChooseEvent); err != nil {
+    return fmt.Errorf("HandleChooseBisection: %w", err)
+  }
+
+  infolog.Println("Claim",claimId,"bisection chosen")
+
+  return SendReport(model.BisectionChosenCode,claimId,"",model.NewClaimDetails(claim))
+}
+
+// Prove a row sampled by a spot check dispute
+func HandleSpotCheckRow(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+  infolog.Println("Got spot check row request")
+
+  claimId, ok1 := payloadMap["id"].(string)
+  index, ok2 := payloadMap["index"].(float64)
+  rowData, ok3 := payloadMap["data"].(string)
+  stateIn, ok4 := payloadMap["stateIn"].(string)
+  partial, ok5 := ParseUintList(payloadMap["partial"])
+  proof, ok6 := ParseBisectionNodes(payloadMap["proof"])
+
+  if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 || claimId == "" || index < 0 || index > math.MaxUint32 {
+    return Fail(model.InvalidParametersCode,"","HandleSpotCheckRow: Not enough parameters, you must provide strings 'id', 'data' and 'stateIn', uint 'index', uint list 'partial' and node list 'proof'")
+  }
+
+  // Check if claim exists
+  claimId = ClaimKey(claimId)
+  if claims[claimId] == nil {
+    return Fail(model.ClaimNotFoundCode,"","HandleSpotCheckRow: Claim doesn't exist")
+  }
+  claim := claims[claimId]
+
+  transition := ClaimTransition(claimId,metadata)
+  if err := model.Allowed(transition,model.CheckRowEvent); err != nil {
+    return fmt.Errorf("HandleSpotCheckRow: %w", err)
+  }
+
+  if !CanValidate(claimId,claim,metadata.MsgSender) {
+    return Fail(model.NotAuthorizedCode,"","HandleSpotCheckRow: Can only check rows of own claims or claims delegated to you")
+  }
+
+  spotCheck := claim.SpotCheck
+  row := uint32(index)
+  if !ContainsRow(spotCheck.Samples,row) || ContainsRow(spotCheck.Checked,row) {
+    return fmt.Errorf("HandleSpotCheckRow: Row %d isn't a sampled row left to check",row)
+  }
+
+  metric, err := processor.GetMetric(claim.Metric)
+  if err != nil {
+    return fmt.Errorf("HandleSpotCheckRow: %s", err)
+  }
+  var columns []string
+  if metric.Vector() {
+    columns = claim.Columns
+  }
+  if stateIn, err = processor.NormalizeHex(stateIn); err != nil {
+    return fmt.Errorf("HandleSpotCheckRow: %s", err)
+  }
+  err = processor.VerifySpotCheckRow(spotCheck,row,[]byte(rowData),stateIn,partial,proof,metric,processor.ClaimMetricOptions(claim),columns)
+  if errors.Is(err,processor.ErrSpotCheckProof) {
+    return fmt.Errorf("HandleSpotCheckRow: %s", err)
+  }
+  if err != nil {
+    return ResolveClaim(claimId,false,"",fmt.Sprintf("row %d doesn't match the commitment: %s",row,err),metadata)
+  }
+
+  spotCheck.Checked = append(spotCheck.Checked,row)
+  if err := model.Fire(transition,model.CheckRowEvent); err != nil {
+    return fmt.Errorf("HandleSpotCheckRow: %w", err)
+  }
+  if len(spotCheck.Checked) == len(spotCheck.Samples) {
+    return ResolveClaim(claimId,true,"","all sampled rows match the commitment",metadata)
+  }
+
+  infolog.Println("Claim",claimId,"row",row,"checked")
+
+  return SendReport(model.RowCheckedCode,claimId,fmt.Sprint("Row ",row," checked"),model.NewClaimDetails(claim))
 }
 
 func HandleValidateChunk(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
@@ -354,48 +854,95 @@ func HandleValidateChunk(metadata *rollups.Metadata, payloadMap map[string]inter
   claimData, ok2 := payloadMap["data"].(string)
 
   if !ok1 || !ok2 || claimId == "" || len(claimData) == 0 {
-    message := "HandleValidateChunk: Not enough parameters, you must provide string 'claimId' and 'data' bytes"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("HandleValidateChunk: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+    return Fail(model.InvalidParametersCode,"","HandleValidateChunk: Not enough parameters, you must provide string 'claimId' and 'data' bytes")
   }
 
   // Check if claim exists
+  claimId = ClaimKey(claimId)
   if claims[claimId] == nil {
-    return fmt.Errorf("HandleValidateChunk: Claim doesn't exist")
+    return Fail(model.ClaimNotFoundCode,"","HandleValidateChunk: Claim doesn't exist")
   }
   claim := claims[claimId]
 
-  if claim.Status != model.Open && claim.Status != model.Disputing {
-    return fmt.Errorf("HandleValidateChunk: Can only dispute Open and Disputing claims")
+  if err := model.CheckEvent(claim.Status,model.ValidateEvent); err != nil {
+    return fmt.Errorf("HandleValidateChunk: %w", err)
   }
 
-  if claim.UserAddress != metadata.MsgSender {
-    return fmt.Errorf("HandleValidateChunk: Can only validate own claims")
+  uploader, err := ClaimUploader(claimId,claim,metadata.MsgSender)
+  if err != nil {
+    return fmt.Errorf("HandleValidateChunk: %w", err)
   }
-
-  if claim.DataChunks == nil {
-    claim.DataChunks = &model.DataChunks{ChunksData:make(map[uint32]*model.Chunk)}
+  if err := CheckThirdPartyUpload(claimId,uploader,metadata.Timestamp); err != nil {
+    return fmt.Errorf("HandleValidateChunk: %w", err)
+  }
+  dataChunks := ClaimUpload(claim,uploader)
+  dataChunks.LastEdited = metadata.Timestamp
+  uploadKey, received := "", dataChunks.ReceivedChunks()
+  if dataChunks.Manifest != nil {
+    uploadKey = processor.UploadKey(dataChunks)
   }
 
-  err := processor.UpdateDataChunks(claim.DataChunks,claimData)
+  err = processor.UpdateDataChunks(dataChunks,claimData)
+  var limitErr *processor.LimitError
+  if errors.As(err,&limitErr) && uploader == "" {
+    return ContradictOverLimit(claimId,limitErr,metadata)
+  }
   if err != nil {
-    return fmt.Errorf("HandleValidatePart: Error updating data chunks: %s",err)
+    return Fail(model.InvalidDataCode,"",fmt.Sprint("HandleValidateChunk: Error updating data chunks: ",err))
+  }
+
+  // the codec of the uploaded data, from the chunk header
+  if codec, err := processor.GetChunkCodec(dataChunks.Codec); err == nil && uploader == "" {
+    claim.DataCodec = codec.Name
   }
 
-  if uint32(len(claim.DataChunks.ChunksData)) == claim.DataChunks.TotalChunks {
-    composed,err := processor.ComposeDataFromChunks(claim.DataChunks)
+  // chunks already stored needn't be uploaded again, and the received chunks
+  // stay stored while the upload holds them
+  chunkStore.FillUpload(dataChunks)
+  chunkStore.HoldUpload(UploadHolder(claimId,uploader),dataChunks)
+  if processor.UploadKey(dataChunks) != uploadKey {
+    // a new manifest restarted the upload
+    received = nil
+  }
+  AddUploadHistory(claimId,metadata,received,dataChunks.ReceivedChunks())
+
+  // chunks are decompressed, hashed and processed as they arrive in order
+  if dataChunks.Stream == nil {
+    if uploader == "" {
+      if err := CheckClaimDataExpected(claim); err != nil {
+        return err
+      }
+    }
+    stream, err := processor.NewChunkStream(dataChunks.Codec,StreamClaimData(claimId,uploader,dataChunks))
     if err != nil {
-      return fmt.Errorf("HandleValidatePart: Error composing data chunks: %s",err)
+      return fmt.Errorf("HandleValidateChunk: Error streaming data chunks: %s",err)
     }
-    claim.DataChunks = nil
-
-    return ValidateAndFinalizeClaim(claimId,string(composed),metadata.Timestamp)
+    dataChunks.Stream = stream
   }
-  return nil
+  done, err := processor.StreamDataChunks(dataChunks)
+  if err != nil {
+    if uploader != "" {
+      ReleaseUpload(claimId,uploader)
+    }
+    return fmt.Errorf("HandleValidateChunk: Error streaming data chunks: %s",err)
+  }
+  if done {
+    isClaimValid, err := dataChunks.Stream.Close()
+    if dataChunks.Verified {
+      // the data of the claimed cid is kept for other claims on it
+      if err := chunkStore.AddDataset(processor.ClaimKeyCid(claimId),UploadHolder(claimId,uploader),dataChunks); err != nil {
+        errlog.Println(err)
+      }
+    }
+    if uploader != "" {
+      return FinalizeProvidedData(claimId,uploader,dataChunks.Verified,isClaimValid,err,metadata)
+    }
+    return FinalizeClaimVerification(claimId,isClaimValid,err,metadata)
+  }
+
+  infolog.Println("Claim",claimId,"chunks missing:",dataChunks.MissingChunks())
+
+  return SendReport(model.ChunksMissingCode,claimId,"",NewUploadStatus(claimId,dataChunks))
 }
 
 // validate an open claim and finalize it (in dispute or not)
@@ -406,159 +953,570 @@ func HandleValidate(metadata *rollups.Metadata, payloadMap map[string]interface{
 
   // check claim id
   claimId, ok1 := payloadMap["id"].(string)
-  claimData, ok2 := payloadMap["data"].(string)
+  claimData, _ := payloadMap["data"].(string)
 
-  if !ok1 || !ok2 || claimId == "" || claimData == "" {
-    message := "HandleValidate: Not enough parameters, you must provide string 'claimId' and 'data'"
-    report := rollups.Report{rollups.Str2Hex(message)}
-    _, err := rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("HandleValidate: error making http request: %s", err)
-    }
-    return fmt.Errorf(message)
+  if !ok1 || claimId == "" || (claimData == "" && !chunkStore.HasDataset(processor.ClaimKeyCid(ClaimKey(claimId)))) {
+    return Fail(model.InvalidParametersCode,"","HandleValidate: Not enough parameters, you must provide string 'claimId' and 'data', unless the claimed cid data is stored")
   }
 
   // Check if claim exists
+  claimId = ClaimKey(claimId)
   if claims[claimId] == nil {
-    return fmt.Errorf("HandleValidate: Claim doesn't exist")
+    return Fail(model.ClaimNotFoundCode,"","HandleValidate: Claim doesn't exist")
   }
   claim := claims[claimId]
 
-  if claim.Status != model.Open && claim.Status != model.Disputing {
-    return fmt.Errorf("HandleValidate: Can only dispute Open and Disputing claims")
+  if err := model.CheckEvent(claim.Status,model.ValidateEvent); err != nil {
+    return fmt.Errorf("HandleValidate: %w", err)
   }
 
-  if claim.UserAddress != metadata.MsgSender {
-    return fmt.Errorf("HandleValidate: Can only validate own claims")
+  uploader, err := ClaimUploader(claimId,claim,metadata.MsgSender)
+  if err != nil {
+    return fmt.Errorf("HandleValidate: %w", err)
   }
 
-  return ValidateAndFinalizeClaim(claimId,claimData,metadata.Timestamp)
+  if claimData == "" {
+    // the data of the claimed cid was already uploaded and verified, for this
+    // claim or another one on the cid
+    claimReader, err := chunkStore.DatasetReader(processor.ClaimKeyCid(claimId))
+    if err != nil {
+      return fmt.Errorf("HandleValidate: %s", err)
+    }
+    return ValidateAndFinalizeClaim(claimId,uploader,claimReader,metadata)
+  }
+  claimReader := processor.NewBoundedReader(strings.NewReader(claimData),processor.LimitDecompressedSize,processor.Limits.MaxDecompressedSize)
+  return ValidateAndFinalizeClaim(claimId,uploader,claimReader,metadata)
 }
 
-func ValidateAndFinalizeClaim(claimId string,claimData string, timestamp uint64) error {
-  claim := claims[claimId]
+// authorize an address to send validation inputs for a claim, or for all the
+// sender claims when no claim id is given
+func HandleAuthorizeDelegate(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+  infolog.Println("Got authorize delegate request")
+  claimId, delegate, err := ParseDelegation("HandleAuthorizeDelegate",metadata,payloadMap)
+  if err != nil {
+    return err
+  }
+
+  user := GetUser(metadata.MsgSender)
+  if claimId == "" {
+    user.Delegates[delegate] = struct{}{}
+  } else {
+    if user.ClaimDelegates[claimId] == nil {
+      user.ClaimDelegates[claimId] = make(map[string]struct{})
+    }
+    user.ClaimDelegates[claimId][delegate] = struct{}{}
+  }
+
+  infolog.Println("User",metadata.MsgSender,"authorized delegate",delegate,claimId)
 
-  isClaimValid, err := ValidateClaim(claimId,claim.Value,claimData)
+  return SendReport(model.DelegateAuthorizedCode,claimId,"",&model.Delegation{Claimer:metadata.MsgSender,Delegate:delegate,Id:claimId})
+}
+
+// revoke a delegate authorized for a claim, or for all the sender claims when
+// no claim id is given
+func HandleRevokeDelegate(metadata *rollups.Metadata, payloadMap map[string]interface{}) error {
+  infolog.Println("Got revoke delegate request")
+  claimId, delegate, err := ParseDelegation("HandleRevokeDelegate",metadata,payloadMap)
   if err != nil {
-    report := rollups.Report{rollups.Str2Hex(fmt.Sprint("HandleValidate: Error during claim validation: %s",err))}
-    _, err = rollups.SendReport(&report)
-    if err != nil {
-      return fmt.Errorf("HandleValidate: error making http request:", err)
+    return err
+  }
+
+  user := GetUser(metadata.MsgSender)
+  if claimId == "" {
+    if _, ok := user.Delegates[delegate]; !ok {
+      return Fail(model.InvalidParametersCode,"","HandleRevokeDelegate: Address isn't a delegate")
     }
+    delete(user.Delegates,delegate)
+  } else {
+    if _, ok := user.ClaimDelegates[claimId][delegate]; !ok {
+      return Fail(model.InvalidParametersCode,claimId,"HandleRevokeDelegate: Address isn't a delegate of the claim")
+    }
+    RevokeClaimDelegate(user,claimId,delegate)
   }
 
-  var message string
+  infolog.Println("User",metadata.MsgSender,"revoked delegate",delegate,claimId)
 
-  if isClaimValid {
-    // validate claim
-    claim.Status = model.Validated // change status
-    claim.LastEdited = timestamp
-    
-    user := GetUser(claim.UserAddress)
-    user.TotalClaims += 1 // add to user finalized claims
-    user.CorrectClaims += 1 // add to user finalized correct claims
+  return SendReport(model.DelegateRevokedCode,claimId,"",&model.Delegation{Claimer:metadata.MsgSender,Delegate:delegate,Id:claimId})
+}
 
-    delete(user.OpenClaims,claimId) // delete from users open claims 
+// ParseDelegation reads the delegate address and the optional claim id, which
+// must be an open claim of the sender
+func ParseDelegation(handlerName string, metadata *rollups.Metadata, payloadMap map[string]interface{}) (string,string,error) {
+  delegate, ok := payloadMap["address"].(string)
+  if !ok || !addressRegexp.MatchString(delegate) {
+    return "", "", Fail(model.InvalidParametersCode,"",fmt.Sprint(handlerName,": Not enough parameters, you must provide string 'address' and optionally the claim 'id'"))
+  }
+  delegate = strings.ToLower(delegate)
+  if delegate == metadata.MsgSender {
+    return "", "", Fail(model.InvalidParametersCode,"",fmt.Sprint(handlerName,": Can not delegate to yourself"))
+  }
 
-    if claim.Status == model.Disputing {
-      disputingUser := GetUser(claim.DisputingUserAddress)
-      disputingUser.TotalDisputes += 1 // add to user disputes
+  claimId, _ := payloadMap["id"].(string)
+  if claimId == "" {
+    return "", delegate, nil
+  }
+  claimId = ClaimKey(claimId)
+  claim := claims[claimId]
+  if claim == nil {
+    return "", "", Fail(model.ClaimNotFoundCode,"",fmt.Sprint(handlerName,": Claim doesn't exist"))
+  }
+  if claim.UserAddress != metadata.MsgSender {
+    return "", "", Fail(model.NotAuthorizedCode,claimId,fmt.Sprint(handlerName,": Can only delegate own claims"))
+  }
+  if err := model.CheckEvent(claim.Status,model.ValidateEvent); err != nil {
+    return "", "", fmt.Errorf("%s: %w", handlerName, err)
+  }
+  return claimId, delegate, nil
+}
 
-      delete(user.OpenDisputes,claimId) // delete from users open claims 
-    }
-    message = fmt.Sprint("Claim ",claimId," validated: ", claim)
+func RevokeClaimDelegate(user *model.User, claimId string, delegate string) {
+  delete(user.ClaimDelegates[claimId],delegate)
+  if len(user.ClaimDelegates[claimId]) == 0 {
+    delete(user.ClaimDelegates,claimId)
+  }
+}
 
-  } else {
-    // contradict claim
-    claim.Status = model.Contradicted // change status
-    claim.LastEdited = timestamp
-    
-    user := GetUser(claim.UserAddress)
-    user.TotalClaims += 1 // add to user finalized claims
+// ValidateAndFinalizeClaim checks the data sent by the claimer (or its
+// delegates), or by a third party for a disputed claim, and resolves the claim
+func ValidateAndFinalizeClaim(claimId string, uploader string, claimData io.Reader, metadata *rollups.Metadata) error {
+  if uploader != "" {
+    isClaimValid, err := ValidateClaim(claimId,claims[claimId],claimData)
+    return FinalizeProvidedData(claimId,uploader,!errors.Is(err,ErrDataNotClaimed),isClaimValid,err,metadata)
+  }
+  if err := CheckClaimDataExpected(claims[claimId]); err != nil {
+    return err
+  }
+  isClaimValid, err := VerifyClaimData(claimId,claimData)
+  return FinalizeClaimVerification(claimId,isClaimValid,err,metadata)
+}
 
-    delete(user.OpenClaims,claimId) // delete from users open claims 
+// CheckClaimDataExpected checks the claim is waiting for data, bisection
+// disputes end with the data of the single chunk in question
+func CheckClaimDataExpected(claim *model.Claim) error {
+  if claim.Bisection != nil && claim.Status == model.Disputing && claim.Bisection.End - claim.Bisection.Start != 1 {
+    return fmt.Errorf("HandleValidate: Bisection dispute hasn't reached a single chunk")
+  }
+  return nil
+}
 
-    if claim.Status  == model.Disputing {
-      disputingUser := GetUser(claim.DisputingUserAddress)
-      disputingUser.TotalDisputes += 1 // add to user disputes
-      disputingUser.WonDisputes += 1 // add to user won disputes
+// VerifyClaimData checks the claim against its data, or against the chunk in
+// question of a bisection dispute. It only reads the claim so it can run as
+// the data streams in.
+func VerifyClaimData(claimId string, claimData io.Reader) (bool,error) {
+  claim := claims[claimId]
+  if claim.Bisection != nil && claim.Status == model.Disputing {
+    return ValidateBisectionChunk(claim,claimData)
+  }
+  return ValidateClaim(claimId,claim,claimData)
+}
 
-      delete(user.OpenDisputes,claimId) // delete from users open claims 
+// StreamClaimData verifies the data of an upload as it streams in, setting
+// Verified once the whole data hashes to the claimed cid
+func StreamClaimData(claimId string, uploader string, dataChunks *model.DataChunks) processor.StreamVerifier {
+  return func(data io.Reader) (bool,error) {
+    claim := claims[claimId]
+    if uploader == "" && claim.Bisection != nil && claim.Status == model.Disputing {
+      return ValidateBisectionChunk(claim,data)
     }
-  
-    message = fmt.Sprint("Claim ",claimId," contradicted: ", claim)
+    isClaimValid, err := ValidateClaim(claimId,claim,data)
+    dataChunks.Verified = !errors.Is(err,ErrDataNotClaimed)
+    return isClaimValid, err
+  }
+}
+
+// FinalizeClaimVerification resolves the claim with the verification result
+func FinalizeClaimVerification(claimId string, isClaimValid bool, err error, metadata *rollups.Metadata) error {
+  if errors.Is(err,processor.ErrBisectionChunkMismatch) {
+    return fmt.Errorf("HandleValidate: Data must be the chunk of the bisection leaf in question")
+  }
+  var limitErr *processor.LimitError
+  if errors.As(err,&limitErr) {
+    return ContradictOverLimit(claimId,limitErr,metadata)
+  }
+  return ResolveClaim(claimId,isClaimValid,"",VerificationReason(claimId,isClaimValid,err),metadata)
+}
+
+// FinalizeProvidedData resolves a disputed claim with the data a third party
+// sent, as long as it is the claimed data
+func FinalizeProvidedData(claimId string, uploader string, cidMatched bool, isClaimValid bool, err error, metadata *rollups.Metadata) error {
+  if !cidMatched {
+    ReleaseUpload(claimId,uploader)
+    return Fail(model.InvalidDataCode,claimId,fmt.Sprintf("HandleValidate: Data provided by %s can't settle the dispute: %s", uploader, err))
+  }
+  return ResolveClaim(claimId,isClaimValid,uploader,VerificationReason(claimId,isClaimValid,err),metadata)
+}
+
+// VerificationReason tells why the checked data resolves the claim, for the
+// claim history and the report
+func VerificationReason(claimId string, isClaimValid bool, err error) string {
+  if isClaimValid {
+    return "data matches the claim"
+  }
+  var dataErr *processor.CsvDataError
+  if errors.As(err,&dataErr) {
+    return fmt.Sprintf("data can't be read with the claim dialect, so it has no %s value: %s",claims[claimId].Metric,dataErr)
   }
-  
-  report := rollups.Report{rollups.Str2Hex(message)}
-  _, err = rollups.SendReport(&report)
   if err != nil {
-    return fmt.Errorf("HandleValidate: error making http request: %s", err)
+    return fmt.Sprint("error during claim validation: ",err)
+  }
+  return "data doesn't match the claim"
+}
+
+// ReleaseClaim drops what a claim holds once it no longer waits for inputs: its
+// uploads, the stored chunks they reference and its delegates
+func ReleaseClaim(claimId string) {
+  claim := claims[claimId]
+  ReleaseUpload(claimId,"")
+  for uploader := range claim.Uploads {
+    ReleaseUpload(claimId,uploader)
   }
+  claim.Uploads = nil
+  delete(GetUser(claim.UserAddress).ClaimDelegates,claimId)
+}
 
-  infolog.Println(message)
+// AddUploadHistory adds the chunks received by an input to the claim history
+func AddUploadHistory(claimId string, metadata *rollups.Metadata, before []uint32, after []uint32) {
+  var newChunks []uint32
+  for _, index := range after {
+    if !ContainsRow(before,index) {
+      newChunks = append(newChunks,index)
+    }
+  }
+  if len(newChunks) == 0 {
+    return
+  }
+  claim := claims[claimId]
+  claim.History = append(claim.History,model.HistoryEntry{Type: model.UploadEntry, Actor: metadata.MsgSender, Timestamp: metadata.Timestamp, From: claim.Status, To: claim.Status, Chunks: newChunks})
+}
 
+// ClaimUpload is the upload of the claimer and its delegates, or of a third
+// party providing the data of a disputed claim
+func ClaimUpload(claim *model.Claim, uploader string) *model.DataChunks {
+  if uploader == "" {
+    if claim.DataChunks == nil {
+      claim.DataChunks = &model.DataChunks{ChunksData:make(map[uint32]*model.Chunk)}
+    }
+    return claim.DataChunks
+  }
+  if claim.Uploads == nil {
+    claim.Uploads = make(map[string]*model.DataChunks)
+  }
+  if claim.Uploads[uploader] == nil {
+    claim.Uploads[uploader] = &model.DataChunks{ChunksData:make(map[uint32]*model.Chunk)}
+  }
+  return claim.Uploads[uploader]
+}
+
+// CheckThirdPartyUpload lets a single third party upload the data of a claim
+// at a time, the first one to send a chunk. An upload with no chunk for
+// longer than the dispute timeout is abandoned and makes way for others.
+func CheckThirdPartyUpload(claimId string, uploader string, timestamp uint64) error {
+  if uploader == "" {
+    return nil
+  }
+  claim := claims[claimId]
+  for other, dataChunks := range claim.Uploads {
+    if other == uploader {
+      continue
+    }
+    if timestamp <= dataChunks.LastEdited + disputeTimeout {
+      return Fail(model.RejectedCode,claimId,fmt.Sprint("Claim data is already being provided by ",other))
+    }
+    infolog.Println("Claim",claimId,"upload of",other,"abandoned")
+    ReleaseUpload(claimId,other)
+  }
   return nil
 }
 
-func ValidateClaim(claimId string, claimValue uint64, claimData string) (bool,error) {
+// UploadHolder is the holder of the stored chunks of an upload
+func UploadHolder(claimId string, uploader string) string {
+  if uploader == "" {
+    return claimId
+  }
+  return claimId+":"+uploader
+}
+
+func ReleaseUpload(claimId string, uploader string) {
+  claim := claims[claimId]
+  dataChunks := claim.DataChunks
+  if uploader != "" {
+    dataChunks = claim.Uploads[uploader]
+    delete(claim.Uploads,uploader)
+  } else {
+    claim.DataChunks = nil
+  }
+  if dataChunks != nil && dataChunks.Stream != nil {
+    dataChunks.Stream.Abort()
+  }
+  chunkStore.Release(UploadHolder(claimId,uploader))
+}
+
+// ContradictOverLimit contradicts a claim whose data exceeds a data limit, the
+// data can't be checked so the claim can't stand
+func ContradictOverLimit(claimId string, limitErr *processor.LimitError, metadata *rollups.Metadata) error {
+  limitReport := &model.LimitReport{Limit: limitErr.Limit, Max: limitErr.Max, Value: limitErr.Value}
+  if err := SendReport(model.LimitExceededCode,claimId,limitErr.Error(),limitReport); err != nil {
+    return err
+  }
+  infolog.Println("Claim",claimId,limitErr)
+
+  return ResolveClaim(claimId,false,"",limitErr.Error(),metadata)
+}
+
+// ResolveClaim validates or contradicts a claim once its data was checked, the
+// uploader is the third party that sent the data, if any, and the reason is
+// kept in the claim history
+func ResolveClaim(claimId string, isClaimValid bool, uploader string, reason string, metadata *rollups.Metadata) error {
+  claim := claims[claimId]
+
+  transition := ClaimTransition(claimId,metadata)
+  transition.Uploader = uploader
+  transition.Reason = reason
+  event := model.ContradictEvent
+  if isClaimValid {
+    event = model.ValidateEvent
+  }
+  if err := model.Fire(transition,event); err != nil {
+    return fmt.Errorf("HandleValidate: %w", err)
+  }
+  ReleaseClaim(claimId)
+  infolog.Println("Claim",claimId,claim.Status,":",reason)
+
+  return SendReport(model.ClaimResolvedCode,claimId,reason,model.NewClaimDetails(claim))
+}
+
+// ErrDataNotClaimed marks data that can't be read or doesn't hash to the
+// claimed cid, which says nothing about the claim when a third party sent it
+var ErrDataNotClaimed = errors.New("data isn't the claimed data")
+
+func ValidateClaim(claimId string, claim *model.Claim, claimData io.Reader) (bool,error) {
 
   // validate processing, any error processing or failed process contradicts
-  cid, err := processor.GetDataCid(claimData)
+  // the claimed cid defines whether the data is hashed as a raw block or a UnixFS DAG
+  claimCid := processor.ClaimKeyCid(claimId)
+  cidPrefix, err := processor.CidPrefixFromString(claimCid)
   if err != nil {
     return false, err
   }
+  // the cid and metric are computed in a single pass over the data
+  dataCids, metricResult, metricErr := processor.ComputeCidAndMetric(claimData,cidPrefix,claim.Metric,processor.ClaimMetricOptions(claim))
+  if dataCids == nil {
+    return false, fmt.Errorf("%w: %w", ErrDataNotClaimed, metricErr)
+  }
 
-  infolog.Println("claimId",claimId,"and got the CID", cid)
+  infolog.Println("claimId",claimId,"and got the CIDs", dataCids)
 
-  equalCid, err := processor.CompareCidWithString(cid,claimId)
-  if err != nil || !equalCid {
-    return false, err
+  equalCid, err := processor.CompareCidWithString(dataCids,claimCid)
+  if err != nil {
+    return false, fmt.Errorf("%w: %w", ErrDataNotClaimed, err)
+  }
+  if !equalCid {
+    return false, ErrDataNotClaimed
   }
 
-  permillionValue, err := processor.CsvBlankCellPermillionage(claimData,"na")
-  if err != nil || permillionValue != claimValue {
-    return false, err
+  if metricErr != nil {
+    return false, metricErr
+  }
+
+  if !ClaimMatchesResult(claim,metricResult) {
+    return false, nil
+  }
+  if claim.ValuesHash != "" {
+    claim.Values = metricResult.Values
   }
 
   return true, nil
 }
 
-func HandleDefault(payloadHex string) error {
-
-  payload, err := rollups.Hex2Str(payloadHex)
+// ValidateBisectionChunk recomputes the bisection leaf in question from its
+// chunk, any error but a chunk mismatch contradicts the claim
+func ValidateBisectionChunk(claim *model.Claim, claimData io.Reader) (bool,error) {
+  metric, err := processor.GetMetric(claim.Metric)
+  if err != nil {
+    return false, err
+  }
+  chunk, err := io.ReadAll(claimData)
+  if err != nil {
+    return false, err
+  }
+  var columns []string
+  if metric.Vector() {
+    columns = claim.Columns
+  }
+  err = processor.VerifyBisectionLeaf(claim.Bisection,chunk,metric,processor.ClaimMetricOptions(claim),columns)
   if err != nil {
-    return fmt.Errorf("HandleDefault: hex error decoding payload: %s", err)
+    return false, err
+  }
+  return true, nil
+}
+
+// ClaimMatchesResult compares the claimed value with a metric result, vector
+// claims must match every column and value
+func ClaimMatchesResult(claim *model.Claim, result *processor.MetricResult) bool {
+  if claim.ValuesHash != "" {
+    if !result.EqualVector(claim.Columns,result.Values) || result.Hash() != claim.ValuesHash {
+      return false
+    }
+    return claim.Values == nil || result.EqualVector(claim.Columns,claim.Values)
   }
+  return result.Value == claim.Value
+}
 
-  message := fmt.Sprint("HandleDefault: Unrecognized ",payload," input, you should send a valid json")
-  report := rollups.Report{rollups.Str2Hex(message)}
-  _, err = rollups.SendReport(&report)
+func ParseStringList(value interface{}) ([]string,bool) {
+  list, ok := value.([]interface{})
+  if !ok {
+    return nil, false
+  }
+  stringList := make([]string,len(list))
+  for i, item := range list {
+    stringList[i], ok = item.(string)
+    if !ok {
+      return nil, false
+    }
+  }
+  return stringList, true
+}
+
+// TreeCommitment holds the payload fields of bisection and spot check claims
+type TreeCommitment struct {
+  Root string
+  FinalState string
+  Partial []uint64
+  Leaves uint32
+  Width uint32
+}
+
+// ParseTreeCommitment reads the commitment fields named by the dispute mode
+// prefix, the number of leaves is named by leavesKey
+func ParseTreeCommitment(payloadMap map[string]interface{}, prefix string, leavesKey string) (TreeCommitment,bool) {
+  root, ok1 := payloadMap[prefix+"Root"].(string)
+  finalState, ok2 := payloadMap[prefix+"FinalState"].(string)
+  partial, ok3 := ParseUintList(payloadMap[prefix+"Partial"])
+  leaves, ok4 := payloadMap[leavesKey].(float64)
+  width, ok5 := payloadMap[prefix+"Width"].(float64)
+
+  if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || leaves < 1 || leaves > math.MaxUint32 || width < 0 || width > math.MaxUint32 {
+    return TreeCommitment{}, false
+  }
+  return TreeCommitment{Root: root, FinalState: finalState, Partial: partial, Leaves: uint32(leaves), Width: uint32(width)}, true
+}
+
+// ParseBisectionNodes reads a list of {hash, stateIn, stateOut, partial} objects
+func ParseBisectionNodes(value interface{}) ([]model.BisectionNode,bool) {
+  list, ok := value.([]interface{})
+  if !ok {
+    return nil, false
+  }
+  nodes := make([]model.BisectionNode,len(list))
+  for i, item := range list {
+    itemMap, ok := item.(map[string]interface{})
+    if !ok {
+      return nil, false
+    }
+    hash, ok1 := itemMap["hash"].(string)
+    stateIn, ok2 := itemMap["stateIn"].(string)
+    stateOut, ok3 := itemMap["stateOut"].(string)
+    partial, ok4 := ParseUintList(itemMap["partial"])
+    if !ok1 || !ok2 || !ok3 || !ok4 {
+      return nil, false
+    }
+    node, err := processor.NewBisectionNode(hash,stateIn,stateOut,partial)
+    if err != nil {
+      return nil, false
+    }
+    nodes[i] = node
+  }
+  return nodes, true
+}
+
+func ContainsRow(rows []uint32, row uint32) bool {
+  for _, item := range rows {
+    if item == row {
+      return true
+    }
+  }
+  return false
+}
+
+func ParseUintList(value interface{}) ([]uint64,bool) {
+  list, ok := value.([]interface{})
+  if !ok {
+    return nil, false
+  }
+  uintList := make([]uint64,len(list))
+  for i, item := range list {
+    floatItem, ok := item.(float64)
+    if !ok || floatItem < 0 {
+      return nil, false
+    }
+    uintList[i] = uint64(floatItem)
+  }
+  return uintList, true
+}
+
+// HandleDefault reports the inputs of no route
+func HandleDefault(payloadHex string) error {
+  currentAction = ""
+  payload, err := rollups.Hex2Str(payloadHex)
   if err != nil {
-    return fmt.Errorf("HandleDefault: error making http request: %s", err)
+    return ReportFailure(nil,Fail(model.InvalidInputCode,"",fmt.Sprint("HandleDefault: hex error decoding payload: ",err)))
   }
-  return fmt.Errorf(message)
+
+  return ReportFailure(nil,Fail(model.InvalidInputCode,"",fmt.Sprint("HandleDefault: Unrecognized ",payload," input, you should send a valid json")))
 }
 
 func main() {
   users = make(map[string]*model.User)
   claims = make(map[string]*model.Claim)
+  chunkStore = processor.NewChunkStore()
+  claimIndex = model.NewClaimIndex(claims)
   claimTimeout = 30 //86400
   disputeTimeout = 30 //43200
 
+  // state snapshots, saved every SNAPSHOT_INTERVAL accepted inputs (100 by
+  // default) to SNAPSHOT_PATH, when set, and restored on start
+  snapshotPath = os.Getenv("SNAPSHOT_PATH")
+  snapshotInterval = 100
+  if interval, err := strconv.ParseUint(os.Getenv("SNAPSHOT_INTERVAL"),10,64); err == nil && interval > 0 {
+    snapshotInterval = interval
+  }
+  if snapshotPath != "" {
+    if err := RestoreSnapshot(); err != nil {
+      log.Panicln(err)
+    }
+  }
+
   jsonHandler := handler.NewJsonHandler("action")
 
-  jsonHandler.HandleInspectRoute("showUser",ShowUser)
-  jsonHandler.HandleInspectRoute("showClaim",ShowClaim)
-  jsonHandler.HandleInspectRoute("getClaimList",GetClaimList)
-  jsonHandler.HandleInspectRoute("wasm",GetWasm)
+  // routes report their results and failures as coded envelopes, but the
+  // wasm binary
+  inspectRoute := func(action string, handle handler.InspectMapHandlerFunc) {
+    jsonHandler.HandleInspectRoute(action,ReportedInspect(action,handle))
+  }
+  advanceRoute := func(action string, handle handler.AdvanceMapHandlerFunc) {
+    jsonHandler.HandleAdvanceRoute(action,CheckedAdvance(action,handle))
+  }
 
-  jsonHandler.HandleAdvanceRoute("claim", HandleClaim)
-  jsonHandler.HandleAdvanceRoute("dispute", HandleDispute)
-  jsonHandler.HandleAdvanceRoute("finalize", HandleFinalize)
-  jsonHandler.HandleAdvanceRoute("validate", HandleValidate)
-  jsonHandler.HandleAdvanceRoute("validateChunk", HandleValidateChunk)
-  
-  handler.HandleDefault(HandleDefault)
+  inspectRoute("showUser",ShowUser)
+  inspectRoute("showClaim",ShowClaim)
+  inspectRoute("getClaimList",GetClaimList)
+  inspectRoute("uploadStatus",UploadStatus)
+  inspectRoute("wasm",GetWasm)
+  inspectRoute("checkStats",CheckStats)
+  inspectRoute("claimHistory",ClaimHistory)
+
+  advanceRoute("claim",HandleClaim)
+  advanceRoute("dispute",HandleDispute)
+  advanceRoute("finalize",HandleFinalize)
+  advanceRoute("validate",HandleValidate)
+  advanceRoute("validateChunk",HandleValidateChunk)
+  advanceRoute("revealBisection",HandleRevealBisection)
+  advanceRoute("chooseBisection",HandleChooseBisection)
+  advanceRoute("spotCheckRow",HandleSpotCheckRow)
+  advanceRoute("authorizeDelegate",HandleAuthorizeDelegate)
+  advanceRoute("revokeDelegate",HandleRevokeDelegate)
+
+  jsonHandler.HandleDefault(HandleDefault)
 
   err := jsonHandler.Run()
   if err != nil {
@@ -0,0 +1,646 @@
+package main
+
+import (
+  "encoding/json"
+  "io"
+  "net/http"
+  "reflect"
+  "strings"
+  "testing"
+
+  "dapp/model"
+  "dapp/processor"
+
+  "github.com/prototyp3-dev/go-rollups/rollups"
+)
+
+const claimer = "0x00000000000000000000000000000000000000aa"
+const disputer = "0x00000000000000000000000000000000000000bb"
+
+const testCsv = "id,name,score\n1,,na\n2,bob,7\n3,carol,\n"
+
+type reportRecorder struct {
+  reports []string
+}
+
+func (r *reportRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+  var report rollups.Report
+  if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
+    return nil, err
+  }
+  payload, err := rollups.Hex2Str(report.Payload)
+  if err != nil {
+    return nil, err
+  }
+  r.reports = append(r.reports, payload)
+  return &http.Response{StatusCode: http.StatusOK, Body: io.NopCloser(strings.NewReader(""))}, nil
+}
+
+// newTestState resets the DApp state and keeps the reports it sends
+func newTestState(t *testing.T) *reportRecorder {
+  users = make(map[string]*model.User)
+  claims = make(map[string]*model.Claim)
+  chunkStore = processor.NewChunkStore()
+  claimTimeout = 30
+  disputeTimeout = 30
+  recorder := &reportRecorder{}
+  transport := http.DefaultClient.Transport
+  http.DefaultClient.Transport = recorder
+  t.Cleanup(func() {
+    http.DefaultClient.Transport = transport
+  })
+  return recorder
+}
+
+// lastReport is the envelope of the last report sent
+func (r *reportRecorder) lastReport(t *testing.T) *model.Report {
+  if len(r.reports) == 0 {
+    t.Fatalf("no report sent")
+  }
+  report, _, err := model.DecodeReport([]byte(r.reports[len(r.reports)-1]))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return report
+}
+
+// errorCode is the code a failed input is reported with
+func errorCode(err error) string {
+  if err == nil {
+    return ""
+  }
+  code, _ := model.ErrorReport(err)
+  return code
+}
+
+func input(sender string, timestamp uint64) *rollups.Metadata {
+  return &rollups.Metadata{MsgSender: sender, Timestamp: timestamp, BlockNumber: timestamp}
+}
+
+func dataCid(t *testing.T, data string) string {
+  dataCid, err := processor.GetDataCid(strings.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return dataCid.String()
+}
+
+// onlyClaimKey is the key of the only claim of the state
+func onlyClaimKey(t *testing.T) string {
+  if len(claims) != 1 {
+    t.Fatalf("%d claims, expected one", len(claims))
+  }
+  for claimKey := range claims {
+    return claimKey
+  }
+  return ""
+}
+
+func uintValues(values []uint64) []interface{} {
+  list := make([]interface{}, len(values))
+  for i, value := range values {
+    list[i] = float64(value)
+  }
+  return list
+}
+
+func stringValues(values []string) []interface{} {
+  list := make([]interface{}, len(values))
+  for i, value := range values {
+    list[i] = value
+  }
+  return list
+}
+
+func TestClaimMetric(t *testing.T) {
+  claimId := dataCid(t, testCsv)
+  tests := []struct {
+    name string
+    payload map[string]interface{}
+    code string
+    status model.Status
+  }{
+    {name: "default metric", payload: map[string]interface{}{"value": float64(666666)}, status: model.Validated},
+    {name: "named metric", payload: map[string]interface{}{"value": float64(666666), "metric": processor.DefaultMetric}, status: model.Validated},
+    {name: "wrong value", payload: map[string]interface{}{"value": float64(500000), "metric": processor.DefaultMetric}, status: model.Contradicted},
+    {name: "unknown metric", payload: map[string]interface{}{"value": float64(666666), "metric": "rowCount"}, code: model.InvalidParametersCode},
+    {name: "over the metric max", payload: map[string]interface{}{"value": float64(1000001)}, code: model.InvalidParametersCode},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      test.payload["id"] = claimId
+      err := HandleClaim(input(claimer, 1), test.payload)
+      if test.code != "" {
+        if errorCode(err) != test.code || len(claims) != 0 {
+          t.Errorf("expected the claim to be rejected with %s, got %s %v", test.code, errorCode(err), err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      claimId := onlyClaimKey(t)
+      if claims[claimId].Metric != processor.DefaultMetric {
+        t.Errorf("claim stored with metric %q", claims[claimId].Metric)
+      }
+      if err := HandleValidate(input(claimer, 2), map[string]interface{}{"id": claimId, "data": testCsv}); err != nil {
+        t.Fatal(err)
+      }
+      if claims[claimId].Status != test.status {
+        t.Errorf("claim %s, expected %s", claims[claimId].Status, test.status)
+      }
+    })
+  }
+}
+
+func TestVectorClaim(t *testing.T) {
+  claimId := dataCid(t, testCsv)
+  columns := []string{"id", "name", "score"}
+  values := []uint64{1000000, 666666, 333333}
+  tests := []struct {
+    name string
+    payload map[string]interface{}
+    code string
+    status model.Status
+  }{
+    {name: "values", payload: map[string]interface{}{"columns": stringValues(columns), "values": uintValues(values)}, status: model.Validated},
+    {name: "one wrong value", payload: map[string]interface{}{"columns": stringValues(columns), "values": uintValues([]uint64{1000000, 666666, 333334})}, status: model.Contradicted},
+    {name: "wrong column", payload: map[string]interface{}{"columns": stringValues([]string{"id", "name", "points"}), "values": uintValues(values)}, status: model.Contradicted},
+    {name: "hash", payload: map[string]interface{}{"columns": stringValues(columns), "valuesHash": processor.HashMetricVector(columns, values)}, status: model.Validated},
+    {name: "wrong hash", payload: map[string]interface{}{"columns": stringValues(columns), "valuesHash": processor.HashMetricVector(columns, []uint64{1000000, 666666, 333334})}, status: model.Contradicted},
+    {name: "missing values", payload: map[string]interface{}{"columns": stringValues(columns)}, code: model.InvalidParametersCode},
+    {name: "values of other columns", payload: map[string]interface{}{"columns": stringValues(columns), "values": uintValues(values[:2])}, code: model.InvalidParametersCode},
+    {name: "value over the metric max", payload: map[string]interface{}{"columns": stringValues(columns), "values": uintValues([]uint64{1000001, 0, 0})}, code: model.InvalidParametersCode},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      test.payload["id"] = claimId
+      test.payload["metric"] = processor.ColumnBlankCellMetric
+      err := HandleClaim(input(claimer, 1), test.payload)
+      if test.code != "" {
+        if errorCode(err) != test.code || len(claims) != 0 {
+          t.Errorf("expected the claim to be rejected with %s, got %s %v", test.code, errorCode(err), err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      claimId := onlyClaimKey(t)
+      if err := HandleValidate(input(claimer, 2), map[string]interface{}{"id": claimId, "data": testCsv}); err != nil {
+        t.Fatal(err)
+      }
+      claim := claims[claimId]
+      if claim.Status != test.status {
+        t.Errorf("claim %s, expected %s", claim.Status, test.status)
+      }
+      if test.status == model.Validated && !(&processor.MetricResult{Columns: claim.Columns, Values: claim.Values}).EqualVector(columns, values) {
+        t.Errorf("validated claim values %v %v", claim.Columns, claim.Values)
+      }
+    })
+  }
+}
+
+func TestShowVectorClaim(t *testing.T) {
+  recorder := newTestState(t)
+  claimId := dataCid(t, testCsv)
+  columns := []string{"id", "name", "score"}
+  values := []uint64{1000000, 666666, 333333}
+  payload := map[string]interface{}{"id": claimId, "metric": processor.ColumnBlankCellMetric, "columns": stringValues(columns), "valuesHash": processor.HashMetricVector(columns, values)}
+  if err := HandleClaim(input(claimer, 1), payload); err != nil {
+    t.Fatal(err)
+  }
+  if err := ShowClaim(map[string]interface{}{"id": onlyClaimKey(t)}); err != nil {
+    t.Fatal(err)
+  }
+  var shown struct {
+    ColumnValues []model.ColumnValue `json:"columnValues"`
+  }
+  if err := json.Unmarshal(recorder.lastReport(t).Payload, &shown); err != nil {
+    t.Fatal(err)
+  }
+  if len(shown.ColumnValues) != 3 || shown.ColumnValues[1].Column != "name" || shown.ColumnValues[1].Value != nil {
+    t.Errorf("hashed claim shown as %+v", shown.ColumnValues)
+  }
+}
+
+func TestNullTokensClaim(t *testing.T) {
+  data := "a,b\n NULL,n/a\nnull,7\n-,\n"
+  claimId := dataCid(t, data)
+  tests := []struct {
+    name string
+    payload map[string]interface{}
+    nullTokens model.NullTokens
+    code string
+    status model.Status
+  }{
+    {name: "default", payload: map[string]interface{}{"value": float64(833333)}, nullTokens: model.DefaultNullTokens(), status: model.Validated},
+    {name: "tokens", payload: map[string]interface{}{"value": float64(500000), "nullTokens": stringValues([]string{"NULL", "N/A"})}, nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}}, status: model.Validated},
+    {name: "trimmed tokens", payload: map[string]interface{}{"value": float64(333333), "nullTokens": stringValues([]string{"NULL", "N/A"}), "nullTrimSpace": true}, nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}, TrimSpace: true}, status: model.Validated},
+    {name: "case sensitive tokens", payload: map[string]interface{}{"value": float64(666666), "nullTokens": stringValues([]string{"NULL", "N/A"}), "nullTrimSpace": true, "nullCaseSensitive": true}, nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}, CaseSensitive: true, TrimSpace: true}, status: model.Validated},
+    {name: "value of the default tokens", payload: map[string]interface{}{"value": float64(833333), "nullTokens": stringValues([]string{"NULL", "N/A"})}, nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}}, status: model.Contradicted},
+    {name: "invalid tokens", payload: map[string]interface{}{"value": float64(833333), "nullTokens": "NULL"}, code: model.InvalidParametersCode},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      test.payload["id"] = claimId
+      err := HandleClaim(input(claimer, 1), test.payload)
+      if test.code != "" {
+        if errorCode(err) != test.code || len(claims) != 0 {
+          t.Errorf("expected the claim to be rejected with %s, got %s %v", test.code, errorCode(err), err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      claimId := onlyClaimKey(t)
+      if !reflect.DeepEqual(claims[claimId].NullTokens, test.nullTokens) {
+        t.Errorf("claim stored with null tokens %+v", claims[claimId].NullTokens)
+      }
+      if err := HandleValidate(input(claimer, 2), map[string]interface{}{"id": claimId, "data": data}); err != nil {
+        t.Fatal(err)
+      }
+      if claims[claimId].Status != test.status {
+        t.Errorf("claim %s, expected %s", claims[claimId].Status, test.status)
+      }
+    })
+  }
+}
+
+func TestDialectClaim(t *testing.T) {
+  data := "# exported\nid;name\n1;\n2; na\n"
+  claimId := dataCid(t, data)
+  tests := []struct {
+    name string
+    payload map[string]interface{}
+    dialect model.Dialect
+    code string
+    status model.Status
+  }{
+    {name: "dialect", payload: map[string]interface{}{"value": float64(500000), "delimiter": ";", "comment": "#", "trimLeadingSpace": true}, dialect: model.Dialect{Delimiter: ";", Comment: "#", TrimLeadingSpace: true, HeaderRows: 1}, status: model.Validated},
+    {name: "header rows", payload: map[string]interface{}{"value": float64(750000), "delimiter": ";", "headerRows": float64(2)}, dialect: model.Dialect{Delimiter: ";", HeaderRows: 2}, status: model.Validated},
+    {name: "value of another dialect", payload: map[string]interface{}{"value": float64(750000), "delimiter": ";", "comment": "#", "trimLeadingSpace": true}, dialect: model.Dialect{Delimiter: ";", Comment: "#", TrimLeadingSpace: true, HeaderRows: 1}, status: model.Contradicted},
+    {name: "data the dialect can't read", payload: map[string]interface{}{"value": float64(500000)}, dialect: model.DefaultDialect(), status: model.Contradicted},
+    {name: "invalid delimiter", payload: map[string]interface{}{"value": float64(500000), "delimiter": ";;"}, code: model.InvalidParametersCode},
+    {name: "comment is the delimiter", payload: map[string]interface{}{"value": float64(500000), "delimiter": ";", "comment": ";"}, code: model.InvalidParametersCode},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      test.payload["id"] = claimId
+      err := HandleClaim(input(claimer, 1), test.payload)
+      if test.code != "" {
+        if errorCode(err) != test.code || len(claims) != 0 {
+          t.Errorf("expected the claim to be rejected with %s, got %s %v", test.code, errorCode(err), err)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      claimId := onlyClaimKey(t)
+      if claims[claimId].Dialect != test.dialect {
+        t.Errorf("claim stored with dialect %+v", claims[claimId].Dialect)
+      }
+      // the dispute is settled by the metric read with the claim dialect
+      if err := HandleDispute(input(disputer, 2), map[string]interface{}{"id": claimId}); err != nil {
+        t.Fatal(err)
+      }
+      if err := HandleValidate(input(claimer, 3), map[string]interface{}{"id": claimId, "data": data}); err != nil {
+        t.Fatal(err)
+      }
+      if claims[claimId].Status != test.status {
+        t.Errorf("disputed claim %s, expected %s", claims[claimId].Status, test.status)
+      }
+    })
+  }
+}
+
+func TestClaimsShareVerifiedData(t *testing.T) {
+  newTestState(t)
+  data := "id,name,score\n" + strings.Repeat("1,,na\n2,bob,7\n3,carol,\n", 300)
+  dataId := dataCid(t, data)
+  result, err := processor.ComputeMetric(processor.DefaultMetric, strings.NewReader(data), processor.DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  columnResult, err := processor.ComputeMetric(processor.ColumnBlankCellMetric, strings.NewReader(data), processor.DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err := HandleClaim(input(claimer, 1), map[string]interface{}{"id": dataId, "value": float64(result.Value)}); err != nil {
+    t.Fatal(err)
+  }
+  if err := HandleClaim(input(claimer, 1), map[string]interface{}{"id": dataId, "metric": processor.ColumnBlankCellMetric, "columns": stringValues(columnResult.Columns), "values": uintValues(columnResult.Values)}); err != nil {
+    t.Fatal(err)
+  }
+  canonicalId, _ := processor.CanonicalCid(dataId)
+  claimKey := processor.NewClaimKey(canonicalId, processor.DefaultMetric, processor.DefaultMetricOptions())
+  columnClaimKey := processor.NewClaimKey(canonicalId, processor.ColumnBlankCellMetric, processor.DefaultMetricOptions())
+  if len(claims) != 2 || claims[claimKey] == nil || claims[columnClaimKey] == nil {
+    t.Fatalf("claims of two metrics on a cid don't coexist: %v", claims)
+  }
+
+  // the same metric and options on the cid is the same claim
+  if err := HandleClaim(input(claimer, 2), map[string]interface{}{"id": dataId, "value": float64(result.Value)}); err == nil {
+    t.Errorf("claimed the same metric twice")
+  }
+  // other options make another claim
+  if err := HandleClaim(input(claimer, 2), map[string]interface{}{"id": dataId, "value": float64(result.Value), "nullTokens": stringValues([]string{"-"})}); err != nil {
+    t.Errorf("claim with other null tokens: %v", err)
+  }
+
+  // nothing is stored yet, the column claim needs its data
+  if err := HandleValidate(input(claimer, 3), map[string]interface{}{"id": columnClaimKey}); err == nil {
+    t.Errorf("validated without data")
+  }
+
+  // the default claim, named by the bare cid, is validated by an upload
+  chunks, err := processor.PrepareDataToSendWithCodec([]byte(data), 1024, "none", processor.DefaultCompressionLevel)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chunks) < 2 {
+    t.Fatalf("expected several chunks, got %d", len(chunks))
+  }
+  for _, chunk := range chunks {
+    if err := HandleValidateChunk(input(claimer, 4), map[string]interface{}{"id": dataId, "data": chunk}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if claims[claimKey].Status != model.Validated {
+    t.Fatalf("uploaded claim is %s", claims[claimKey].Status)
+  }
+  if !chunkStore.HasDataset(canonicalId) {
+    t.Fatalf("verified data wasn't stored")
+  }
+
+  // the column claim on the cid is validated from the stored data
+  if err := HandleValidate(input(claimer, 5), map[string]interface{}{"id": columnClaimKey}); err != nil {
+    t.Fatal(err)
+  }
+  if claims[columnClaimKey].Status != model.Validated {
+    t.Errorf("column claim validated from the stored data is %s", claims[columnClaimKey].Status)
+  }
+}
+
+func TestDelegation(t *testing.T) {
+  const delegate = "0x00000000000000000000000000000000000000cc"
+  otherCsv := testCsv + "4,dan,1\n"
+  tests := []struct {
+    name string
+    inputs []map[string]interface{}
+    revoke map[string]interface{}
+    validates []bool
+  }{
+    {name: "global delegate", inputs: []map[string]interface{}{{"address": delegate}}, validates: []bool{true, true}},
+    {name: "claim delegate", inputs: []map[string]interface{}{{"address": delegate, "id": "claim"}}, validates: []bool{true, false}},
+    {name: "no delegate", validates: []bool{false, false}},
+    {name: "revoked global delegate", inputs: []map[string]interface{}{{"address": delegate}}, revoke: map[string]interface{}{"address": delegate}, validates: []bool{false, false}},
+    {name: "revoked claim delegate", inputs: []map[string]interface{}{{"address": delegate}, {"address": delegate, "id": "claim"}}, revoke: map[string]interface{}{"address": delegate, "id": "claim"}, validates: []bool{true, true}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      var claimIds []string
+      for i, data := range []string{testCsv, otherCsv} {
+        if err := HandleClaim(input(claimer, uint64(i+1)), map[string]interface{}{"id": dataCid(t, data), "value": float64(666666)}); err != nil {
+          t.Fatal(err)
+        }
+        claimIds = append(claimIds, ClaimKey(dataCid(t, data)))
+      }
+      withClaim := func(payload map[string]interface{}) map[string]interface{} {
+        if payload["id"] == "claim" {
+          return map[string]interface{}{"address": payload["address"], "id": claimIds[0]}
+        }
+        return payload
+      }
+      for _, payload := range test.inputs {
+        if err := HandleAuthorizeDelegate(input(claimer, 3), withClaim(payload)); err != nil {
+          t.Fatal(err)
+        }
+      }
+      if test.revoke != nil {
+        if err := HandleRevokeDelegate(input(claimer, 4), withClaim(test.revoke)); err != nil {
+          t.Fatal(err)
+        }
+      }
+      for i, data := range []string{testCsv, otherCsv} {
+        err := HandleValidate(input(delegate, 5), map[string]interface{}{"id": claimIds[i], "data": data})
+        if validates := errorCode(err) != model.NotAuthorizedCode; validates != test.validates[i] {
+          t.Errorf("delegate validating claim %d: %v, expected validates %v", i, err, test.validates[i])
+        }
+      }
+    })
+  }
+}
+
+func TestRevokeUnknownDelegate(t *testing.T) {
+  const delegate = "0x00000000000000000000000000000000000000cc"
+  newTestState(t)
+  if err := HandleRevokeDelegate(input(claimer, 1), map[string]interface{}{"address": delegate}); err == nil {
+    t.Errorf("revoked an address that isn't a delegate")
+  }
+  if err := HandleAuthorizeDelegate(input(claimer, 1), map[string]interface{}{"address": claimer}); err == nil {
+    t.Errorf("delegated to the claimer itself")
+  }
+}
+
+func TestShowUserDelegates(t *testing.T) {
+  const delegate = "0x00000000000000000000000000000000000000cc"
+  const revoked = "0x00000000000000000000000000000000000000dd"
+  recorder := newTestState(t)
+  if err := HandleClaim(input(claimer, 1), map[string]interface{}{"id": dataCid(t, testCsv), "value": float64(666666)}); err != nil {
+    t.Fatal(err)
+  }
+  claimId := onlyClaimKey(t)
+  delegations := []map[string]interface{}{
+    {"address": delegate},
+    {"address": revoked},
+    {"address": revoked, "id": claimId},
+  }
+  for _, payload := range delegations {
+    if err := HandleAuthorizeDelegate(input(claimer, 2), payload); err != nil {
+      t.Fatal(err)
+    }
+  }
+  for _, payload := range delegations[1:] {
+    if err := HandleRevokeDelegate(input(claimer, 3), payload); err != nil {
+      t.Fatal(err)
+    }
+  }
+
+  if err := ShowUser(map[string]interface{}{"id": claimer}); err != nil {
+    t.Fatal(err)
+  }
+  var user model.User
+  if err := json.Unmarshal(recorder.lastReport(t).Payload, &user); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := user.Delegates[delegate]; !ok || len(user.Delegates) != 1 {
+    t.Errorf("user delegates %v, expected only %s", user.Delegates, delegate)
+  }
+  if len(user.ClaimDelegates) != 0 {
+    t.Errorf("user claim delegates %v, expected none", user.ClaimDelegates)
+  }
+}
+
+func TestDelegateRevealsBisection(t *testing.T) {
+  const delegate = "0x00000000000000000000000000000000000000cc"
+  newTestState(t)
+  data := []byte("id,name,score\n" + strings.Repeat("1,,na\n2,bob,7\n3,carol,\n", 40))
+  tree, err := processor.BuildBisectionTree(data, 128, processor.DefaultMetric, processor.DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  root, err := tree.Root()
+  if err != nil {
+    t.Fatal(err)
+  }
+  result, err := processor.ComputeMetric(processor.DefaultMetric, strings.NewReader(string(data)), processor.DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  claimPayload := map[string]interface{}{
+    "id": dataCid(t, string(data)),
+    "value": float64(result.Value),
+    "disputeMode": model.BisectionDispute,
+    "bisectionRoot": root.Hash,
+    "bisectionFinalState": root.StateOut,
+    "bisectionPartial": uintValues(root.Partial),
+    "bisectionLeaves": float64(len(tree.Leaves)),
+    "bisectionWidth": float64(tree.Width),
+  }
+  if err := HandleClaim(input(claimer, 1), claimPayload); err != nil {
+    t.Fatal(err)
+  }
+  claimId := onlyClaimKey(t)
+  if err := HandleAuthorizeDelegate(input(claimer, 2), map[string]interface{}{"address": delegate}); err != nil {
+    t.Fatal(err)
+  }
+  if err := HandleDispute(input(disputer, 3), map[string]interface{}{"id": claimId}); err != nil {
+    t.Fatal(err)
+  }
+
+  bisection := claims[claimId].Bisection
+  mid := processor.BisectionSplit(bisection.Start, bisection.End)
+  left, _ := tree.Node(bisection.Start, mid)
+  right, _ := tree.Node(mid, bisection.End)
+  reveal := map[string]interface{}{
+    "id": claimId,
+    "leftHash": left.Hash,
+    "rightHash": right.Hash,
+    "midState": left.StateOut,
+    "leftPartial": uintValues(left.Partial),
+    "rightPartial": uintValues(right.Partial),
+  }
+
+  // only the claimer and its delegates answer the dispute
+  if err := HandleRevealBisection(input(disputer, 4), reveal); errorCode(err) != model.NotAuthorizedCode {
+    t.Errorf("the disputer revealed the bisection")
+  }
+  if err := HandleRevealBisection(input(delegate, 4), reveal); err != nil {
+    t.Fatalf("delegate reveal: %v", err)
+  }
+  if bisection.Left == nil || bisection.Right == nil {
+    t.Errorf("bisection wasn't revealed")
+  }
+}
+
+func TestThirdPartyData(t *testing.T) {
+  const provider = "0x00000000000000000000000000000000000000ee"
+  tests := []struct {
+    name string
+    value float64
+    dispute bool
+    data string
+    code string
+    status model.Status
+    providedData uint32
+  }{
+    {name: "contradicts a wrong claim", value: 500000, dispute: true, data: testCsv, status: model.Contradicted, providedData: 1},
+    {name: "validates a right claim", value: 666666, dispute: true, data: testCsv, status: model.Validated},
+    {name: "data of another cid", value: 500000, dispute: true, data: testCsv + "4,dan,1\n", code: model.InvalidDataCode, status: model.Disputing},
+    {name: "open claim", value: 500000, data: testCsv, code: model.NotAuthorizedCode, status: model.Open},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      newTestState(t)
+      if err := HandleClaim(input(claimer, 1), map[string]interface{}{"id": dataCid(t, testCsv), "value": test.value}); err != nil {
+        t.Fatal(err)
+      }
+      claimId := onlyClaimKey(t)
+      if test.dispute {
+        if err := HandleDispute(input(disputer, 2), map[string]interface{}{"id": claimId}); err != nil {
+          t.Fatal(err)
+        }
+      }
+      err := HandleValidate(input(provider, 3), map[string]interface{}{"id": claimId, "data": test.data})
+      if errorCode(err) != test.code {
+        t.Errorf("third party data: %s %v, expected %q", errorCode(err), err, test.code)
+      }
+      if claims[claimId].Status != test.status {
+        t.Errorf("claim %s, expected %s", claims[claimId].Status, test.status)
+      }
+      if provided := GetUser(provider).ProvidedData; provided != test.providedData {
+        t.Errorf("provider credited %d, expected %d", provided, test.providedData)
+      }
+    })
+  }
+}
+
+func TestSingleThirdPartyUpload(t *testing.T) {
+  const provider = "0x00000000000000000000000000000000000000ee"
+  const otherProvider = "0x00000000000000000000000000000000000000ff"
+  newTestState(t)
+  data := "id,name,score\n" + strings.Repeat("1,,na\n2,bob,7\n3,carol,\n", 300)
+  if err := HandleClaim(input(claimer, 1), map[string]interface{}{"id": dataCid(t, data), "value": float64(0)}); err != nil {
+    t.Fatal(err)
+  }
+  claimId := onlyClaimKey(t)
+  if err := HandleDispute(input(disputer, 2), map[string]interface{}{"id": claimId}); err != nil {
+    t.Fatal(err)
+  }
+  chunks, err := processor.PrepareDataToSendWithCodec([]byte(data), 1024, "none", processor.DefaultCompressionLevel)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chunks) < 2 {
+    t.Fatalf("expected several chunks, got %d", len(chunks))
+  }
+
+  // the first third party to send a chunk holds the upload
+  if err := HandleValidateChunk(input(provider, 3), map[string]interface{}{"id": claimId, "data": chunks[0]}); err != nil {
+    t.Fatal(err)
+  }
+  if err := HandleValidateChunk(input(otherProvider, 4), map[string]interface{}{"id": claimId, "data": chunks[0]}); errorCode(err) != model.RejectedCode {
+    t.Errorf("a second third party uploaded while the first one is active")
+  }
+  // the claimer upload isn't held back
+  if err := HandleValidateChunk(input(claimer, 4), map[string]interface{}{"id": claimId, "data": chunks[0]}); err != nil {
+    t.Errorf("claimer upload: %v", err)
+  }
+
+  // an idle upload is abandoned after the dispute timeout
+  abandoned := 3 + disputeTimeout + 1
+  for _, chunk := range chunks {
+    if err := HandleValidateChunk(input(otherProvider, abandoned), map[string]interface{}{"id": claimId, "data": chunk}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if claims[claimId].Status != model.Contradicted {
+    t.Fatalf("claim %s, expected %s", claims[claimId].Status, model.Contradicted)
+  }
+  if GetUser(otherProvider).ProvidedData != 1 || GetUser(provider).ProvidedData != 0 {
+    t.Errorf("provided data credited to %d and %d", GetUser(provider).ProvidedData, GetUser(otherProvider).ProvidedData)
+  }
+  for _, uploader := range []string{"", provider, otherProvider} {
+    if chunkStore.Holds[UploadHolder(claimId, uploader)] != nil {
+      t.Errorf("upload of %q still held", uploader)
+    }
+  }
+}
@@ -2,28 +2,125 @@ package main
 
 import (
   "fmt"
+  "strings"
+  "encoding/json"
 
+  "dapp/model"
   "dapp/processor"
   "syscall/js"
 )
 
+// MetricOptions reads an optional options object using the same keys as the
+// claim payload, so values computed here match the DApp validation
+func MetricOptions(args []js.Value, index int) processor.MetricOptions {
+  options := processor.DefaultMetricOptions()
+  if len(args) <= index || args[index].Type() != js.TypeObject {
+    return options
+  }
+  jsOptions := args[index]
+  if nullTokens := jsOptions.Get("nullTokens"); nullTokens.Type() == js.TypeObject {
+    options.NullTokens.Tokens = make([]string, nullTokens.Length())
+    for i := range options.NullTokens.Tokens {
+      options.NullTokens.Tokens[i] = nullTokens.Index(i).String()
+    }
+  }
+  if caseSensitive := jsOptions.Get("nullCaseSensitive"); caseSensitive.Type() == js.TypeBoolean {
+    options.NullTokens.CaseSensitive = caseSensitive.Bool()
+  }
+  if trimSpace := jsOptions.Get("nullTrimSpace"); trimSpace.Type() == js.TypeBoolean {
+    options.NullTokens.TrimSpace = trimSpace.Bool()
+  }
+  if delimiter := jsOptions.Get("delimiter"); delimiter.Type() == js.TypeString {
+    options.Dialect.Delimiter = delimiter.String()
+  }
+  if comment := jsOptions.Get("comment"); comment.Type() == js.TypeString {
+    options.Dialect.Comment = comment.String()
+  }
+  if lazyQuotes := jsOptions.Get("lazyQuotes"); lazyQuotes.Type() == js.TypeBoolean {
+    options.Dialect.LazyQuotes = lazyQuotes.Bool()
+  }
+  if trimLeadingSpace := jsOptions.Get("trimLeadingSpace"); trimLeadingSpace.Type() == js.TypeBoolean {
+    options.Dialect.TrimLeadingSpace = trimLeadingSpace.Bool()
+  }
+  if headerRows := jsOptions.Get("headerRows"); headerRows.Type() == js.TypeNumber && headerRows.Int() >= 0 {
+    options.Dialect.HeaderRows = uint32(headerRows.Int())
+  }
+  return options
+}
+
 func EmptyCellValue(this js.Value, args []js.Value) interface{} {
   if len(args) == 0 {
     return nil
   }
-  value, err := processor.CsvBlankCellPermillionage(args[0].String(),"na")
+  result, err := processor.ComputeMetric(processor.DefaultMetric,strings.NewReader(args[0].String()),MetricOptions(args,1))
   if err != nil {
     fmt.Println("Error:",err)
     return nil
   }
-  return value
+  return result.Value
+}
+
+func ListMetrics(this js.Value, args []js.Value) interface{} {
+  names := processor.ListMetrics()
+  namesInterface := make([]interface{}, len(names))
+  for i, name := range names {
+    namesInterface[i] = name
+  }
+  return namesInterface
+}
+
+func ComputeMetric(this js.Value, args []js.Value) interface{} {
+  if len(args) < 2 {
+    return nil
+  }
+  metric, err := processor.GetMetric(args[0].String())
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  result, err := metric.Compute(strings.NewReader(args[1].String()),MetricOptions(args,2))
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  if !metric.Vector() {
+    return result.Value
+  }
+  columns := make([]interface{}, len(result.Columns))
+  for i, column := range result.Columns {
+    columns[i] = column
+  }
+  values := make([]interface{}, len(result.Values))
+  for i, value := range result.Values {
+    values[i] = value
+  }
+  return map[string]interface{}{"columns":columns,"values":values,"valuesHash":result.Hash()}
 }
 
 func GetDataCid(this js.Value, args []js.Value) interface{} {
   if len(args) == 0 {
     return nil
   }
-  value, err := processor.GetDataCid(args[0].String())
+  // optional options object, {unixfs: true, cidVersion: 0} gives the CID ipfs add produces
+  // and {hash: "keccak-256"} selects the multihash function
+  cidPrefix := processor.DataCidPrefix()
+  if len(args) > 1 && args[1].Type() == js.TypeObject {
+    if unixFs := args[1].Get("unixfs"); unixFs.Type() == js.TypeBoolean && unixFs.Bool() {
+      cidPrefix = processor.UnixFsCidPrefix(1)
+      if cidVersion := args[1].Get("cidVersion"); cidVersion.Type() == js.TypeNumber && cidVersion.Int() == 0 {
+        cidPrefix = processor.UnixFsCidPrefix(0)
+      }
+    }
+    if hashName := args[1].Get("hash"); hashName.Type() == js.TypeString {
+      mhType, err := processor.MultihashFromName(hashName.String())
+      if err != nil {
+        fmt.Println("Error:",err)
+        return nil
+      }
+      cidPrefix.MhType = mhType
+    }
+  }
+  value, err := processor.GetDataCidWithPrefix(strings.NewReader(args[0].String()),cidPrefix)
   if err != nil {
     fmt.Println("Error:",err)
     return nil
@@ -31,11 +128,163 @@ func GetDataCid(this js.Value, args []js.Value) interface{} {
   return value.String()
 }
 
+func uintList(values []uint64) []interface{} {
+  list := make([]interface{}, len(values))
+  for i, value := range values {
+    list[i] = value
+  }
+  return list
+}
+
+// bisectionTree builds the bisection tree of a metric over the csv, the
+// options object may also set the chunk size with the "chunkSize" key
+func bisectionTree(args []js.Value, optionsIndex int) (*processor.BisectionTree,error) {
+  chunkSize := processor.DefaultBisectionChunkSize
+  if len(args) > optionsIndex && args[optionsIndex].Type() == js.TypeObject {
+    if size := args[optionsIndex].Get("chunkSize"); size.Type() == js.TypeNumber {
+      chunkSize = size.Int()
+    }
+  }
+  return processor.BuildBisectionTree([]byte(args[1].String()),chunkSize,args[0].String(),MetricOptions(args,optionsIndex))
+}
+
+// BisectionCommitment returns the claim payload fields of a bisection claim
+func BisectionCommitment(this js.Value, args []js.Value) interface{} {
+  if len(args) < 2 {
+    return nil
+  }
+  tree, err := bisectionTree(args,2)
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  root, err := tree.Root()
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  return map[string]interface{}{
+    "disputeMode":"bisection",
+    "bisectionRoot":root.Hash,
+    "bisectionFinalState":root.StateOut,
+    "bisectionPartial":uintList(root.Partial),
+    "bisectionLeaves":len(tree.Leaves),
+    "bisectionWidth":tree.Width,
+  }
+}
+
+// BisectionStep answers the bisection dispute over the chunks [start,end): the
+// revealBisection payload fields, or the chunk data once a single chunk is left
+func BisectionStep(this js.Value, args []js.Value) interface{} {
+  if len(args) < 4 {
+    return nil
+  }
+  tree, err := bisectionTree(args,4)
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  start := uint32(args[2].Int())
+  end := uint32(args[3].Int())
+  if end - start == 1 && end <= uint32(len(tree.Chunks)) {
+    return map[string]interface{}{"data":string(tree.Chunks[start])}
+  }
+  mid := processor.BisectionSplit(start,end)
+  left, err := tree.Node(start,mid)
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  right, err := tree.Node(mid,end)
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  return map[string]interface{}{
+    "leftHash":left.Hash,
+    "rightHash":right.Hash,
+    "midState":left.StateOut,
+    "leftPartial":uintList(left.Partial),
+    "rightPartial":uintList(right.Partial),
+  }
+}
+
+func nodeObject(node model.BisectionNode) map[string]interface{} {
+  return map[string]interface{}{"hash":node.Hash,"stateIn":node.StateIn,"stateOut":node.StateOut,"partial":uintList(node.Partial)}
+}
+
+// SpotCheckCommitment returns the claim payload fields of a spot check claim
+func SpotCheckCommitment(this js.Value, args []js.Value) interface{} {
+  if len(args) < 2 {
+    return nil
+  }
+  tree, err := processor.CommitRows([]byte(args[1].String()),args[0].String(),MetricOptions(args,2))
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  root, err := tree.Root()
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  return map[string]interface{}{
+    "disputeMode":"spotCheck",
+    "spotCheckRoot":root.Hash,
+    "spotCheckFinalState":root.StateOut,
+    "spotCheckPartial":uintList(root.Partial),
+    "spotCheckRows":len(tree.Leaves),
+    "spotCheckWidth":tree.Width,
+  }
+}
+
+// SpotCheckRow returns the spotCheckRow payload fields proving a sampled row
+func SpotCheckRow(this js.Value, args []js.Value) interface{} {
+  if len(args) < 3 {
+    return nil
+  }
+  tree, err := processor.CommitRows([]byte(args[1].String()),args[0].String(),MetricOptions(args,3))
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  index := uint32(args[2].Int())
+  proof, err := tree.Proof(index)
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  proofList := make([]interface{}, len(proof))
+  for i, node := range proof {
+    proofList[i] = nodeObject(node)
+  }
+  leaf := tree.Leaves[index]
+  return map[string]interface{}{
+    "index":index,
+    "data":string(tree.Chunks[index]),
+    "stateIn":leaf.StateIn,
+    "partial":uintList(leaf.Partial),
+    "proof":proofList,
+  }
+}
+
+// PrepareData splits the data in chunk envelopes. An optional options object
+// may choose the "codec" (or "auto" for the smallest payload) and its "level".
 func PrepareData(this js.Value, args []js.Value) interface{} {
-  if len(args) == 0 {
+  if len(args) < 2 {
     return nil
   }
-  value, err := processor.PrepareDataToSend([]byte(args[0].String()),uint64(args[1].Int()))
+  codec := "gzip"
+  level := processor.DefaultCompressionLevel
+  if len(args) > 2 && args[2].Type() == js.TypeObject {
+    if codecValue := args[2].Get("codec"); codecValue.Type() == js.TypeString {
+      codec = codecValue.String()
+    }
+    if levelValue := args[2].Get("level"); levelValue.Type() == js.TypeNumber {
+      level = levelValue.Int()
+    }
+  }
+  value, err := processor.PrepareDataToSendWithCodec([]byte(args[0].String()),uint64(args[1].Int()),codec,level)
   if err != nil {
     fmt.Println("Error:",err)
     return nil
@@ -47,11 +296,50 @@ func PrepareData(this js.Value, args []js.Value) interface{} {
   return valueInterface
 }
 
+// DecodeReport reads a DApp report envelope, returning it with the payload
+// typed by its code, or null when it isn't an envelope
+func DecodeReport(this js.Value, args []js.Value) interface{} {
+  if len(args) < 1 {
+    return nil
+  }
+  report, payload, err := model.DecodeReport([]byte(args[0].String()))
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  decodedJson, err := json.Marshal(struct{
+    *model.Report
+    Payload interface{}           `json:"payload,omitempty"`
+  }{Report:report,Payload:payload})
+  if err != nil {
+    fmt.Println("Error:",err)
+    return nil
+  }
+  return js.Global().Get("JSON").Call("parse",string(decodedJson))
+}
+
+// ErrorCodes lists the codes of the failed inputs
+func ErrorCodes(this js.Value, args []js.Value) interface{} {
+  codes := make([]interface{}, len(model.ErrorCodes))
+  for i, code := range model.ErrorCodes {
+    codes[i] = code
+  }
+  return codes
+}
+
 func main() {
   wait := make(chan struct{},0)
   fmt.Println("DAPP WASM initialized")
   js.Global().Set("emptyCellValue", js.FuncOf(EmptyCellValue))
+  js.Global().Set("listMetrics", js.FuncOf(ListMetrics))
+  js.Global().Set("computeMetric", js.FuncOf(ComputeMetric))
   js.Global().Set("getDataCid", js.FuncOf(GetDataCid))
   js.Global().Set("prepareData", js.FuncOf(PrepareData))
+  js.Global().Set("bisectionCommitment", js.FuncOf(BisectionCommitment))
+  js.Global().Set("bisectionStep", js.FuncOf(BisectionStep))
+  js.Global().Set("spotCheckCommitment", js.FuncOf(SpotCheckCommitment))
+  js.Global().Set("spotCheckRow", js.FuncOf(SpotCheckRow))
+  js.Global().Set("decodeReport", js.FuncOf(DecodeReport))
+  js.Global().Set("errorCodes", js.FuncOf(ErrorCodes))
   <- wait
 }
\ No newline at end of file
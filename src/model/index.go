@@ -0,0 +1,419 @@
+package model
+
+import (
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+// The claim index keeps the claim ids sorted by id, status, value and edit
+// time, and grouped by claimer and disputer. A claim listing walks the sorted
+// ids of its sort from the cursor and stops once the page is full, the claimer
+// and disputer filters only sort the claims of the address. Transitions update
+// the index of the claims they change, the index isn't saved and is rebuilt
+// from the claims.
+
+// indexKey orders claims by a key, then by id
+type indexKey struct {
+  key uint64
+  id string
+}
+
+func (k indexKey) less(other indexKey) bool {
+  if k.key != other.key {
+    return k.key < other.key
+  }
+  return k.id < other.id
+}
+
+// indexedFields are the fields of a claim as indexed
+type indexedFields struct {
+  status Status
+  claimer string
+  disputer string
+  value uint64
+  hasValue bool
+  lastEdited uint64
+}
+
+type ClaimIndex struct {
+  byId []indexKey
+  byStatus []indexKey
+  byClaimer map[string]map[string]struct{}
+  byDisputer map[string]map[string]struct{}
+  byValue []indexKey
+  byLastEdited []indexKey
+  fields map[string]indexedFields
+}
+
+// NewClaimIndex indexes the claims
+func NewClaimIndex(claims map[string]*Claim) *ClaimIndex {
+  x := &ClaimIndex{
+    byClaimer: make(map[string]map[string]struct{}),
+    byDisputer: make(map[string]map[string]struct{}),
+    fields: make(map[string]indexedFields),
+  }
+  for claimId, claim := range claims {
+    x.Update(claimId,claim)
+  }
+  return x
+}
+
+func addToSet(sets map[string]map[string]struct{}, key string, claimId string) {
+  if sets[key] == nil {
+    sets[key] = make(map[string]struct{})
+  }
+  sets[key][claimId] = struct{}{}
+}
+
+func removeFromSet(sets map[string]map[string]struct{}, key string, claimId string) {
+  delete(sets[key],claimId)
+  if len(sets[key]) == 0 {
+    delete(sets,key)
+  }
+}
+
+func insertKey(keys []indexKey, k indexKey) []indexKey {
+  i := sort.Search(len(keys),func(i int) bool { return !keys[i].less(k) })
+  keys = append(keys,indexKey{})
+  copy(keys[i+1:],keys[i:])
+  keys[i] = k
+  return keys
+}
+
+func removeKey(keys []indexKey, k indexKey) []indexKey {
+  i := sort.Search(len(keys),func(i int) bool { return !keys[i].less(k) })
+  if i < len(keys) && keys[i] == k {
+    keys = append(keys[:i],keys[i+1:]...)
+  }
+  return keys
+}
+
+// Update indexes the current fields of the claim
+func (x *ClaimIndex) Update(claimId string, claim *Claim) {
+  fields := indexedFields{status: claim.Status, claimer: claim.UserAddress, disputer: claim.DisputingUserAddress, value: claim.Value, hasValue: claim.HasValue(), lastEdited: claim.LastEdited}
+  if old, ok := x.fields[claimId]; ok {
+    if old == fields {
+      return
+    }
+    x.remove(claimId,old)
+  } else {
+    x.byId = insertKey(x.byId,indexKey{0,claimId})
+  }
+  x.fields[claimId] = fields
+  x.byStatus = insertKey(x.byStatus,indexKey{uint64(fields.status),claimId})
+  addToSet(x.byClaimer,fields.claimer,claimId)
+  if fields.disputer != "" {
+    addToSet(x.byDisputer,fields.disputer,claimId)
+  }
+  if fields.hasValue {
+    x.byValue = insertKey(x.byValue,indexKey{fields.value,claimId})
+  }
+  x.byLastEdited = insertKey(x.byLastEdited,indexKey{fields.lastEdited,claimId})
+}
+
+func (x *ClaimIndex) remove(claimId string, fields indexedFields) {
+  x.byStatus = removeKey(x.byStatus,indexKey{uint64(fields.status),claimId})
+  removeFromSet(x.byClaimer,fields.claimer,claimId)
+  if fields.disputer != "" {
+    removeFromSet(x.byDisputer,fields.disputer,claimId)
+  }
+  if fields.hasValue {
+    x.byValue = removeKey(x.byValue,indexKey{fields.value,claimId})
+  }
+  x.byLastEdited = removeKey(x.byLastEdited,indexKey{fields.lastEdited,claimId})
+}
+
+// Claim sort orders
+const (
+  SortById = "id"
+  SortByValue = "value"
+  SortByLastEdited = "lastEdited"
+  SortByStatus = "status"
+)
+
+var ClaimSorts = []string{SortById, SortByValue, SortByLastEdited, SortByStatus}
+
+// Claim list page sizes
+const DefaultClaimPageLimit = 50
+const MaxClaimPageLimit = 200
+
+// HasValue tells whether the claim has a single value, vector claims have one
+// per column instead
+func (c Claim) HasValue() bool {
+  return len(c.Columns) == 0
+}
+
+// Deadline is when an open or disputing claim can be finalized
+func (c Claim) Deadline(claimTimeout uint64, disputeTimeout uint64) (uint64,bool) {
+  switch c.Status {
+  case Open:
+    return c.LastEdited + claimTimeout, true
+  case Disputing:
+    return c.LastEdited + disputeTimeout, true
+  }
+  return 0, false
+}
+
+// ClaimQuery filters, sorts and pages claims. Empty filters match all claims,
+// the deadline window only matches open and disputing claims, and the value
+// filters and sort only match claims with a single value, not vector claims.
+type ClaimQuery struct {
+  Statuses []Status
+  Claimer string
+  Disputer string
+  MinValue *uint64
+  MaxValue *uint64
+  DeadlineFrom *uint64
+  DeadlineTo *uint64
+  ClaimTimeout uint64
+  DisputeTimeout uint64
+  SortBy string
+  Descending bool
+  // Cursor is the next cursor of the previous page
+  Cursor string
+  Limit int
+}
+
+type ClaimPage struct {
+  Claims []*SimplifiedClaim       `json:"claims"`
+  NextCursor string               `json:"nextCursor,omitempty"`
+}
+
+func (q ClaimQuery) matches(claim *Claim) bool {
+  if len(q.Statuses) > 0 {
+    found := false
+    for _, status := range q.Statuses {
+      found = found || claim.Status == status
+    }
+    if !found {
+      return false
+    }
+  }
+  if q.Claimer != "" && claim.UserAddress != q.Claimer {
+    return false
+  }
+  if q.Disputer != "" && claim.DisputingUserAddress != q.Disputer {
+    return false
+  }
+  if (q.MinValue != nil || q.MaxValue != nil || q.SortBy == SortByValue) && !claim.HasValue() {
+    return false
+  }
+  if q.MinValue != nil && claim.Value < *q.MinValue {
+    return false
+  }
+  if q.MaxValue != nil && claim.Value > *q.MaxValue {
+    return false
+  }
+  if q.DeadlineFrom != nil || q.DeadlineTo != nil {
+    deadline, ok := claim.Deadline(q.ClaimTimeout,q.DisputeTimeout)
+    if !ok || (q.DeadlineFrom != nil && deadline < *q.DeadlineFrom) || (q.DeadlineTo != nil && deadline > *q.DeadlineTo) {
+      return false
+    }
+  }
+  return true
+}
+
+// addressIds are the ids of the claims of the claimer or disputer filters,
+// the smallest set, ok is false without those filters
+func (x *ClaimIndex) addressIds(q ClaimQuery) ([]string,bool) {
+  var sets []map[string]struct{}
+  if q.Claimer != "" {
+    sets = append(sets,x.byClaimer[q.Claimer])
+  }
+  if q.Disputer != "" {
+    sets = append(sets,x.byDisputer[q.Disputer])
+  }
+  if len(sets) == 0 {
+    return nil, false
+  }
+  set := sets[0]
+  if len(sets) > 1 && len(sets[1]) < len(set) {
+    set = sets[1]
+  }
+  ids := make([]string,0,len(set))
+  for id := range set {
+    ids = append(ids,id)
+  }
+  return ids, true
+}
+
+// sorted is the index of the sort key and the range of keys the filters on
+// that key allow
+func (x *ClaimIndex) sorted(q ClaimQuery) ([]indexKey,uint64,uint64) {
+  min, max := uint64(0), ^uint64(0)
+  switch q.SortBy {
+  case SortByValue:
+    if q.MinValue != nil {
+      min = *q.MinValue
+    }
+    if q.MaxValue != nil {
+      max = *q.MaxValue
+    }
+    return x.byValue, min, max
+  case SortByLastEdited:
+    // deadlines are edit times shifted by the timeout of the status, a single
+    // range when both timeouts are the same
+    if q.ClaimTimeout == q.DisputeTimeout {
+      timeout := q.ClaimTimeout
+      if q.DeadlineFrom != nil && *q.DeadlineFrom > timeout {
+        min = *q.DeadlineFrom - timeout
+      }
+      if q.DeadlineTo != nil {
+        if *q.DeadlineTo < timeout {
+          return nil, min, max
+        }
+        max = *q.DeadlineTo - timeout
+      }
+    }
+    return x.byLastEdited, min, max
+  case SortByStatus:
+    if len(q.Statuses) > 0 {
+      min, max = ^uint64(0), 0
+      for _, status := range q.Statuses {
+        if uint64(status) < min {
+          min = uint64(status)
+        }
+        if uint64(status) > max {
+          max = uint64(status)
+        }
+      }
+    }
+    return x.byStatus, min, max
+  }
+  return x.byId, min, max
+}
+
+// walk reads the index of the sort key from the cursor on, in the order of
+// the query, and stops at the first match past the page
+func (x *ClaimIndex) walk(claims map[string]*Claim, q ClaimQuery, cursor *indexKey) []indexKey {
+  keys, min, max := x.sorted(q)
+  if min > max {
+    return nil
+  }
+  lo := sort.Search(len(keys),func(i int) bool { return keys[i].key >= min })
+  hi := sort.Search(len(keys),func(i int) bool { return keys[i].key > max })
+  if cursor != nil {
+    if q.Descending {
+      if end := sort.Search(len(keys),func(i int) bool { return !keys[i].less(*cursor) }); end < hi {
+        hi = end
+      }
+    } else {
+      if start := sort.Search(len(keys),func(i int) bool { return cursor.less(keys[i]) }); start > lo {
+        lo = start
+      }
+    }
+  }
+  var page []indexKey
+  for n := 0; n < hi - lo && len(page) <= q.Limit; n += 1 {
+    i := lo + n
+    if q.Descending {
+      i = hi - 1 - n
+    }
+    if claim := claims[keys[i].id]; claim != nil && q.matches(claim) {
+      page = append(page,keys[i])
+    }
+  }
+  return page
+}
+
+// sortIds sorts the matching claims of the ids in the order of the query,
+// from the cursor on
+func (x *ClaimIndex) sortIds(claims map[string]*Claim, q ClaimQuery, ids []string, cursor *indexKey) []indexKey {
+  var keys []indexKey
+  for _, claimId := range ids {
+    if claim := claims[claimId]; claim != nil && q.matches(claim) {
+      keys = append(keys,x.sortKey(claimId,q.SortBy))
+    }
+  }
+  before := func(a indexKey, b indexKey) bool {
+    if q.Descending {
+      return b.less(a)
+    }
+    return a.less(b)
+  }
+  sort.Slice(keys,func(i, j int) bool { return before(keys[i],keys[j]) })
+  if cursor != nil {
+    keys = keys[sort.Search(len(keys),func(i int) bool { return before(*cursor,keys[i]) }):]
+  }
+  return keys
+}
+
+func (x *ClaimIndex) sortKey(claimId string, sortBy string) indexKey {
+  fields := x.fields[claimId]
+  switch sortBy {
+  case SortByValue:
+    return indexKey{fields.value,claimId}
+  case SortByLastEdited:
+    return indexKey{fields.lastEdited,claimId}
+  case SortByStatus:
+    return indexKey{uint64(fields.status),claimId}
+  }
+  return indexKey{0,claimId}
+}
+
+func parseCursor(cursor string) (indexKey,error) {
+  key, id, ok := strings.Cut(cursor,"/")
+  if !ok || id == "" {
+    return indexKey{}, fmt.Errorf("invalid cursor %s", cursor)
+  }
+  value, err := strconv.ParseUint(key,10,64)
+  if err != nil {
+    return indexKey{}, fmt.Errorf("invalid cursor %s", cursor)
+  }
+  return indexKey{value,id}, nil
+}
+
+// Query lists a page of the indexed claims matching the query
+func (x *ClaimIndex) Query(claims map[string]*Claim, q ClaimQuery) (*ClaimPage,error) {
+  if q.SortBy == "" {
+    q.SortBy = SortById
+  }
+  validSort := false
+  for _, sortBy := range ClaimSorts {
+    validSort = validSort || sortBy == q.SortBy
+  }
+  if !validSort {
+    return nil, fmt.Errorf("invalid sort %s, claims sort by %v", q.SortBy, ClaimSorts)
+  }
+  if q.Limit <= 0 {
+    q.Limit = DefaultClaimPageLimit
+  }
+  if q.Limit > MaxClaimPageLimit {
+    q.Limit = MaxClaimPageLimit
+  }
+
+  var cursor *indexKey
+  if q.Cursor != "" {
+    cursorKey, err := parseCursor(q.Cursor)
+    if err != nil {
+      return nil, err
+    }
+    cursor = &cursorKey
+  }
+
+  // the claims of an address aren't kept sorted, they are few enough to sort
+  var keys []indexKey
+  if ids, ok := x.addressIds(q); ok {
+    keys = x.sortIds(claims,q,ids,cursor)
+  } else {
+    keys = x.walk(claims,q,cursor)
+  }
+
+  page := &ClaimPage{Claims: []*SimplifiedClaim{}}
+  end := len(keys)
+  if end > q.Limit {
+    end = q.Limit
+  }
+  for _, k := range keys[:end] {
+    claim := claims[k.id]
+    simplifiedClaim := &SimplifiedClaim{Id:k.id,Status:claim.Status,Value:claim.Value,Metric:claim.Metric,LastEdited:claim.LastEdited}
+    simplifiedClaim.Deadline, _ = claim.Deadline(q.ClaimTimeout,q.DisputeTimeout)
+    page.Claims = append(page.Claims,simplifiedClaim)
+  }
+  if end < len(keys) {
+    page.NextCursor = fmt.Sprintf("%d/%s", keys[end-1].key, keys[end-1].id)
+  }
+  return page, nil
+}
@@ -0,0 +1,276 @@
+package model
+
+import (
+  "fmt"
+  "math/rand"
+  "sort"
+  "testing"
+)
+
+func randomClaims(rng *rand.Rand, n int) map[string]*Claim {
+  claims := make(map[string]*Claim)
+  addresses := []string{"alice", "bob", "carol"}
+  for i := 0; i < n; i += 1 {
+    claim := &Claim{
+      UserAddress: addresses[rng.Intn(len(addresses))],
+      Value: uint64(rng.Intn(20)),
+      LastEdited: uint64(rng.Intn(50)),
+      Status: Statuses[1+rng.Intn(len(Statuses)-1)],
+    }
+    if claim.Status != Open && rng.Intn(2) == 0 {
+      claim.DisputingUserAddress = addresses[rng.Intn(len(addresses))]
+    }
+    if rng.Intn(5) == 0 {
+      claim.Value = 0
+      claim.Columns = []string{"a", "b"}
+      claim.Values = []uint64{uint64(rng.Intn(20)), uint64(rng.Intn(20))}
+    }
+    claims[fmt.Sprintf("claim%03d", i)] = claim
+  }
+  return claims
+}
+
+// scanQuery lists the ids of the claims matching the query, reading them all
+func scanQuery(claims map[string]*Claim, q ClaimQuery) []string {
+  var keys []indexKey
+  for claimId, claim := range claims {
+    if !q.matches(claim) {
+      continue
+    }
+    key := indexKey{id: claimId}
+    switch q.SortBy {
+    case SortByValue:
+      key.key = claim.Value
+    case SortByLastEdited:
+      key.key = claim.LastEdited
+    case SortByStatus:
+      key.key = uint64(claim.Status)
+    }
+    keys = append(keys, key)
+  }
+  sort.Slice(keys, func(i, j int) bool {
+    if q.Descending {
+      return keys[j].less(keys[i])
+    }
+    return keys[i].less(keys[j])
+  })
+  ids := []string{}
+  for _, key := range keys {
+    ids = append(ids, key.id)
+  }
+  return ids
+}
+
+// queryAll follows the cursors of the query through all its pages
+func queryAll(t *testing.T, x *ClaimIndex, claims map[string]*Claim, q ClaimQuery) []string {
+  ids := []string{}
+  for pages := 0; ; pages += 1 {
+    if pages > len(claims) {
+      t.Fatalf("pagination doesn't end")
+    }
+    page, err := x.Query(claims, q)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if len(page.Claims) > q.Limit {
+      t.Fatalf("page of %d claims, limit %d", len(page.Claims), q.Limit)
+    }
+    for _, claim := range page.Claims {
+      ids = append(ids, claim.Id)
+    }
+    if page.NextCursor == "" {
+      return ids
+    }
+    q.Cursor = page.NextCursor
+  }
+}
+
+func uintPtr(value uint64) *uint64 {
+  return &value
+}
+
+func TestClaimIndexQuery(t *testing.T) {
+  rng := rand.New(rand.NewSource(1))
+  claims := randomClaims(rng, 300)
+  x := NewClaimIndex(claims)
+
+  queries := []ClaimQuery{
+    {},
+    {Statuses: []Status{Open}},
+    {Statuses: []Status{Disputing, Validated}, SortBy: SortByValue},
+    {Claimer: "alice", SortBy: SortByLastEdited, Descending: true},
+    {Disputer: "bob", SortBy: SortByStatus},
+    {Claimer: "nobody"},
+    {MinValue: uintPtr(5), MaxValue: uintPtr(8), SortBy: SortByValue, Descending: true},
+    {MinValue: uintPtr(9), MaxValue: uintPtr(3)},
+    {MaxValue: uintPtr(2), Claimer: "carol"},
+    {DeadlineFrom: uintPtr(30), DeadlineTo: uintPtr(45), ClaimTimeout: 10, DisputeTimeout: 5, SortBy: SortByLastEdited},
+    {DeadlineTo: uintPtr(8), ClaimTimeout: 10, DisputeTimeout: 5},
+    {DeadlineFrom: uintPtr(40), ClaimTimeout: 7, DisputeTimeout: 7, Statuses: []Status{Open}},
+    {DeadlineFrom: uintPtr(20), DeadlineTo: uintPtr(40), ClaimTimeout: 5, DisputeTimeout: 5, SortBy: SortByLastEdited, Descending: true},
+    {Statuses: []Status{Finalized, Open}, SortBy: SortByStatus, Descending: true},
+    {Claimer: "bob", Disputer: "alice", MinValue: uintPtr(4), SortBy: SortByValue},
+  }
+  for i, q := range queries {
+    for _, limit := range []int{1, 7, MaxClaimPageLimit} {
+      t.Run(fmt.Sprintf("query %d limit %d", i, limit), func(t *testing.T) {
+        q.Limit = limit
+        expected := scanQuery(claims, q)
+        if got := queryAll(t, x, claims, q); fmt.Sprint(got) != fmt.Sprint(expected) {
+          t.Errorf("listed %v, expected %v", got, expected)
+        }
+      })
+    }
+  }
+}
+
+func TestClaimIndexUpdates(t *testing.T) {
+  rng := rand.New(rand.NewSource(2))
+  claims := make(map[string]*Claim)
+  x := NewClaimIndex(claims)
+  users := make(map[string]*User)
+  getUser := func(address string) *User {
+    if users[address] == nil {
+      users[address] = &User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{})}
+    }
+    return users[address]
+  }
+
+  // claims change through the state machine, which updates the index
+  for i := 0; i < 500; i += 1 {
+    claimId := fmt.Sprintf("claim%02d", rng.Intn(60))
+    if claims[claimId] == nil {
+      claims[claimId] = &Claim{UserAddress: "alice", Value: uint64(rng.Intn(10))}
+    }
+    event := Events[rng.Intn(len(Events))]
+    transition := &TransitionContext{ClaimId: claimId, Claim: claims[claimId], GetUser: getUser, Timestamp: uint64(i) * 10, ClaimTimeout: 15, DisputeTimeout: 15, Sender: "bob", Index: x}
+    Fire(transition, event)
+  }
+  for claimId, claim := range claims {
+    if claim.Status == Undefined {
+      delete(claims, claimId)
+    }
+  }
+
+  rebuilt := NewClaimIndex(claims)
+  queries := []ClaimQuery{
+    {SortBy: SortByLastEdited},
+    {Statuses: []Status{Open, Disputing}, SortBy: SortByStatus},
+    {Disputer: "bob"},
+    {MinValue: uintPtr(3), MaxValue: uintPtr(6)},
+    {DeadlineFrom: uintPtr(100), DeadlineTo: uintPtr(4000), ClaimTimeout: 15, DisputeTimeout: 15},
+  }
+  for _, q := range queries {
+    q.Limit = 10
+    expected := scanQuery(claims, q)
+    if got := queryAll(t, x, claims, q); fmt.Sprint(got) != fmt.Sprint(expected) {
+      t.Errorf("updated index listed %v, expected %v", got, expected)
+    }
+    if got := queryAll(t, rebuilt, claims, q); fmt.Sprint(got) != fmt.Sprint(expected) {
+      t.Errorf("rebuilt index listed %v, expected %v", got, expected)
+    }
+  }
+  for _, k := range x.byStatus {
+    if claims[k.id].Status != Status(k.key) {
+      t.Errorf("claim %s indexed as %s, is %s", k.id, Status(k.key), claims[k.id].Status)
+    }
+  }
+}
+
+func TestClaimIndexErrors(t *testing.T) {
+  claims := randomClaims(rand.New(rand.NewSource(3)), 10)
+  x := NewClaimIndex(claims)
+  if _, err := x.Query(claims, ClaimQuery{SortBy: "metric"}); err == nil {
+    t.Errorf("expected error sorting by an unknown key")
+  }
+  for _, cursor := range []string{"claim001", "x/claim001", "3/"} {
+    if _, err := x.Query(claims, ClaimQuery{Cursor: cursor}); err == nil {
+      t.Errorf("expected error for cursor %q", cursor)
+    }
+  }
+  page, err := x.Query(claims, ClaimQuery{Limit: 1000})
+  if err != nil || len(page.Claims) != 10 || page.NextCursor != "" {
+    t.Errorf("page %+v %v", page, err)
+  }
+}
+
+func TestClaimIndexVectorClaims(t *testing.T) {
+  claims := map[string]*Claim{
+    "scalar0": {UserAddress: "alice", Status: Open, LastEdited: 3},
+    "scalar5": {UserAddress: "alice", Value: 5, Status: Open, LastEdited: 2},
+    "vector": {UserAddress: "alice", Columns: []string{"a", "b"}, Values: []uint64{3, 9}, Status: Open, LastEdited: 1},
+  }
+  x := NewClaimIndex(claims)
+  list := func(q ClaimQuery) string {
+    page, err := x.Query(claims, q)
+    if err != nil {
+      t.Fatal(err)
+    }
+    ids := []string{}
+    for _, claim := range page.Claims {
+      ids = append(ids, claim.Id)
+    }
+    return fmt.Sprint(ids)
+  }
+
+  // vector claims have no single value to filter or sort by
+  tests := []struct {
+    q ClaimQuery
+    expected string
+  }{
+    {ClaimQuery{}, "[scalar0 scalar5 vector]"},
+    {ClaimQuery{SortBy: SortByLastEdited}, "[vector scalar5 scalar0]"},
+    {ClaimQuery{MaxValue: uintPtr(5)}, "[scalar0 scalar5]"},
+    {ClaimQuery{MinValue: uintPtr(0)}, "[scalar0 scalar5]"},
+    {ClaimQuery{SortBy: SortByValue}, "[scalar0 scalar5]"},
+    {ClaimQuery{SortBy: SortByValue, Descending: true}, "[scalar5 scalar0]"},
+  }
+  for i, test := range tests {
+    if got := list(test.q); got != test.expected {
+      t.Errorf("query %d listed %s, expected %s", i, got, test.expected)
+    }
+  }
+
+  // a claim changing its kind moves in and out of the value index
+  claims["vector"].Columns, claims["vector"].Values, claims["vector"].Value = nil, nil, 7
+  x.Update("vector", claims["vector"])
+  if got := list(ClaimQuery{SortBy: SortByValue}); got != "[scalar0 scalar5 vector]" {
+    t.Errorf("value sort listed %s after the update", got)
+  }
+  claims["scalar0"].Columns = []string{"a"}
+  x.Update("scalar0", claims["scalar0"])
+  if got := list(ClaimQuery{MaxValue: uintPtr(10)}); got != "[scalar5 vector]" {
+    t.Errorf("value filter listed %s after the update", got)
+  }
+}
+
+func TestClaimIndexWalk(t *testing.T) {
+  claims := randomClaims(rand.New(rand.NewSource(4)), 300)
+  x := NewClaimIndex(claims)
+
+  // a page reads the index up to the first match past it
+  queries := []ClaimQuery{
+    {SortBy: SortById, Limit: 5},
+    {SortBy: SortByValue, MinValue: uintPtr(19), Limit: 200},
+    {SortBy: SortByStatus, Statuses: []Status{Open}, Limit: 3, Descending: true},
+  }
+  for i, q := range queries {
+    expected := scanQuery(claims, q)
+    if len(expected) > q.Limit {
+      expected = expected[:q.Limit+1]
+    }
+    ids := []string{}
+    for _, k := range x.walk(claims, q, nil) {
+      ids = append(ids, k.id)
+    }
+    if fmt.Sprint(ids) != fmt.Sprint(expected) {
+      t.Errorf("query %d read %v, expected %v", i, ids, expected)
+    }
+  }
+
+  // the cursor is found by binary search, the walk starts right after it
+  cursor := x.byId[100]
+  if keys := x.walk(claims, ClaimQuery{SortBy: SortById, Limit: 1}, &cursor); len(keys) != 2 || keys[0] != x.byId[101] {
+    t.Errorf("walk from the cursor read %v", keys)
+  }
+}
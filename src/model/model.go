@@ -12,39 +12,226 @@ type User struct {
   WonDisputes uint32              `json:"wonDisputes"`
   TotalClaims uint32              `json:"totalClaims"`
   CorrectClaims uint32            `json:"correctClaims"`
+  ProvidedData uint32             `json:"providedData"`
+  Delegates map[string]struct{}   `json:"delegates"`
+  ClaimDelegates map[string]map[string]struct{} `json:"claimDelegates"`
 }
 
 type Claim struct {
   UserAddress string              `json:"userAddress"`
   DisputingUserAddress string     `json:"disputingUserAddress"`
   Value uint64                    `json:"value"`
+  Metric string                   `json:"metric"`
+  NullTokens NullTokens           `json:"nullTokens"`
+  Dialect Dialect                 `json:"dialect"`
+  Columns []string                `json:"columns,omitempty"`
+  Values []uint64                 `json:"values,omitempty"`
+  ValuesHash string               `json:"valuesHash,omitempty"`
   LastEdited uint64               `json:"lastEdited"`
   Status Status                   `json:"status"`
   DataChunks *DataChunks          `json:"dataChunks"`
+  DataCodec string                `json:"dataCodec,omitempty"`
+  Uploads map[string]*DataChunks  `json:"uploads,omitempty"`
+  DataProvider string             `json:"dataProvider,omitempty"`
+  History []HistoryEntry          `json:"history,omitempty"`
+  DisputeMode string              `json:"disputeMode,omitempty"`
+  Bisection *Bisection            `json:"bisection,omitempty"`
+  SpotCheck *SpotCheck            `json:"spotCheck,omitempty"`
+}
+
+// HistoryEntry is a change of a claim: a transition of the state machine,
+// typed by its event, or chunks received for an upload
+type HistoryEntry struct {
+  Type string                     `json:"type"`
+  Actor string                    `json:"actor"`
+  Timestamp uint64                `json:"timestamp"`
+  From Status                     `json:"from"`
+  To Status                       `json:"to"`
+  Reason string                   `json:"reason,omitempty"`
+  Chunks []uint32                 `json:"chunks,omitempty"`
+}
+
+// UploadEntry is the type of history entries of received chunks
+const UploadEntry = "upload"
+
+// HistoryTypes lists the types of history entries
+func HistoryTypes() []string {
+  types := []string{UploadEntry}
+  for _, event := range Events {
+    types = append(types,event.String())
+  }
+  return types
+}
+
+// Dispute modes, claims without a mode are disputed by uploading all the data
+const BisectionDispute = "bisection"
+const SpotCheckDispute = "spotCheck"
+
+// BisectionNode is a node of a bisection commitment: the data hash state
+// before and after the bytes of its chunks and the metric partial of their
+// records. The hash covers these fields and the hashes of the children.
+type BisectionNode struct {
+  Hash string                     `json:"hash"`
+  StateIn string                  `json:"stateIn"`
+  StateOut string                 `json:"stateOut"`
+  Partial []uint64                `json:"partial"`
+}
+
+// Bisection tracks a bisection dispute: Node covers the chunks [Start,End) and
+// Left and Right are its children while the disputer chooses the wrong one
+type Bisection struct {
+  Leaves uint32                   `json:"leaves"`
+  Width uint32                    `json:"width"`
+  Node BisectionNode              `json:"node"`
+  Start uint32                    `json:"start"`
+  End uint32                      `json:"end"`
+  Left *BisectionNode             `json:"left,omitempty"`
+  Right *BisectionNode            `json:"right,omitempty"`
+}
+
+// SpotCheck tracks a spot check dispute: the row commitment, the rows sampled
+// when the claim was disputed and the rows already proven
+type SpotCheck struct {
+  Rows uint32                     `json:"rows"`
+  Width uint32                    `json:"width"`
+  Root BisectionNode              `json:"root"`
+  Samples []uint32                `json:"samples,omitempty"`
+  Checked []uint32                `json:"checked,omitempty"`
+}
+
+// NullTokens defines which cell values count as blank, besides empty cells
+type NullTokens struct {
+  Tokens []string                 `json:"tokens"`
+  CaseSensitive bool              `json:"caseSensitive"`
+  TrimSpace bool                  `json:"trimSpace"`
+}
+
+func DefaultNullTokens() NullTokens {
+  return NullTokens{Tokens: []string{"na"}}
+}
+
+// Dialect defines how the csv data is parsed
+type Dialect struct {
+  Delimiter string                `json:"delimiter"`
+  Comment string                  `json:"comment"`
+  LazyQuotes bool                 `json:"lazyQuotes"`
+  TrimLeadingSpace bool           `json:"trimLeadingSpace"`
+  HeaderRows uint32               `json:"headerRows"`
+}
+
+func DefaultDialect() Dialect {
+  return Dialect{Delimiter: ",", HeaderRows: 1}
+}
+
+type ColumnValue struct {
+  Column string                   `json:"column"`
+  Value *uint64                   `json:"value"`
+}
+
+// ColumnValues pairs vector claim values with their columns, values are nil
+// while only the hash of the vector is known
+func (c Claim) ColumnValues() []ColumnValue {
+  var columnValues []ColumnValue
+  for i, column := range c.Columns {
+    columnValue := ColumnValue{Column:column}
+    if i < len(c.Values) {
+      columnValue.Value = &c.Values[i]
+    }
+    columnValues = append(columnValues,columnValue)
+  }
+  return columnValues
 }
 
 type SimplifiedClaim struct {
   Id string                       `json:"id"`
   Status Status                   `json:"status"`
   Value uint64                    `json:"value"`
+  Metric string                   `json:"metric"`
+  LastEdited uint64               `json:"lastEdited"`
+  Deadline uint64                 `json:"deadline,omitempty"`
+}
+
+// LimitReport is reported when the data of a claim exceeds a data limit,
+// which contradicts the claim
+type LimitReport struct {
+  Limit string                    `json:"limit"`
+  Max uint64                      `json:"max"`
+  Value uint64                    `json:"value,omitempty"`
+}
+
+// StatsReport is the result of checking the user stats against the claims,
+// reported by checkStats and after an input that breaks the invariant
+type StatsReport struct {
+  Consistent bool                 `json:"consistent"`
+  Users int                       `json:"users"`
+  Claims int                      `json:"claims"`
+  Divergences []StatsDivergence   `json:"divergences"`
 }
 
+// DataChunks holds a chunked upload, the first chunk sets the compression
+// codec, the total compressed size and the manifest with the sha256 of the
+// data of every chunk. Chunks are fed to the stream in order as they arrive
+// and dropped, ChunksData only keeps the ones received ahead of NextChunk.
+// Verified is set once the streamed data matches the claimed CID. LastEdited
+// is the timestamp of the last chunk received.
 type DataChunks struct {
   ChunksData map[uint32]*Chunk
   TotalChunks uint32
+  Codec uint8
+  TotalSize uint64
+  Manifest [][]byte
+  NextChunk uint32
+  StreamedSize uint64
+  Stream DataStream
+  Verified bool
+  LastEdited uint64
+}
+
+// DataStream verifies the data of an upload as its chunks are fed in order
+type DataStream interface {
+  Write(data []byte) bool
+  Close() (bool,error)
+  Abort()
+}
+
+// ReceivedChunks lists the indexes of the chunks already uploaded, in order
+func (dc DataChunks) ReceivedChunks() []uint32 {
+  chunkIndexes := make([]uint32,0,len(dc.ChunksData))
+  for index := uint32(0); index < dc.TotalChunks; index += 1 {
+    if index < dc.NextChunk || dc.ChunksData[index] != nil {
+      chunkIndexes = append(chunkIndexes,index)
+    }
+  }
+  return chunkIndexes
 }
+
+// MissingChunks lists the indexes of the chunks still to upload, in order.
+// Without the first chunk the number of chunks isn't known yet.
+func (dc DataChunks) MissingChunks() []uint32 {
+  chunkIndexes := make([]uint32,0)
+  if dc.TotalChunks == 0 {
+    return append(chunkIndexes,0)
+  }
+  for index := dc.NextChunk; index < dc.TotalChunks; index += 1 {
+    if dc.ChunksData[index] == nil {
+      chunkIndexes = append(chunkIndexes,index)
+    }
+  }
+  return chunkIndexes
+}
+
 func (dc DataChunks) MarshalJSON() ([]byte, error) {
-  var size uint64
-  var chunkIndexes []uint32
-  for index, chunk := range dc.ChunksData {
+  size := dc.StreamedSize
+  for _, chunk := range dc.ChunksData {
     size += uint64(len(chunk.Data))
-    chunkIndexes = append(chunkIndexes,index)
   }
   return json.Marshal(struct{
     TotalChunks uint32            `json:"totalChunks"`
+    TotalSize uint64              `json:"totalSize"`
     CurrentSize uint64            `json:"size"`
     Chunks []uint32               `json:"chunks"`
-  }{TotalChunks:dc.TotalChunks,CurrentSize:size,Chunks:chunkIndexes})
+    Missing []uint32              `json:"missing"`
+  }{TotalChunks:dc.TotalChunks,TotalSize:dc.TotalSize,CurrentSize:size,Chunks:dc.ReceivedChunks(),Missing:dc.MissingChunks()})
 }
 
 type Chunk struct {
@@ -69,7 +256,7 @@ const (
 func (s Status) String() string {
 
 	statuses := [...]string{"undefined", "open", "disputing", "finalized","disputed","validated","contradicted"}
-	if len(statuses) < int(s) {
+	if len(statuses) <= int(s) {
 		return "unknown"
 	}
 	return statuses[s]
@@ -77,4 +264,26 @@ func (s Status) String() string {
 
 func (s Status) MarshalJSON() ([]byte, error) {
   return json.Marshal(s.String())
+}
+
+func (s *Status) UnmarshalJSON(data []byte) error {
+  var name string
+  if err := json.Unmarshal(data,&name); err != nil {
+    return err
+  }
+  status, err := StatusFromName(name)
+  if err != nil {
+    return err
+  }
+  *s = status
+  return nil
+}
+
+func StatusFromName(name string) (Status,error) {
+  for status := Undefined; status <= Contradicted; status += 1 {
+    if status.String() == name {
+      return status, nil
+    }
+  }
+  return Undefined, fmt.Errorf("Status: unknown status %s", name)
 }
\ No newline at end of file
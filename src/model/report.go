@@ -0,0 +1,204 @@
+package model
+
+import (
+  "fmt"
+  "errors"
+  "encoding/json"
+)
+
+// Every report of the DApp, but the wasm binary, is a json envelope: the code
+// of the result or error, whether the input succeeded, the action of the
+// input, the claim it is about, a message for people and a payload typed by
+// the code. Codes are stable, clients switch on them instead of the messages.
+// ReportPayloads is the catalog of the payload types and DecodeReport reads an
+// envelope with its typed payload, for Go clients and the wasm build.
+
+type Report struct {
+  Code string                     `json:"code"`
+  Ok bool                         `json:"ok"`
+  Action string                   `json:"action"`
+  Id string                       `json:"id,omitempty"`
+  Message string                  `json:"message,omitempty"`
+  Payload json.RawMessage         `json:"payload,omitempty"`
+}
+
+// Result codes
+const (
+  ClaimCreatedCode = "claimCreated"
+  ClaimDisputedCode = "claimDisputed"
+  ClaimFinalizedCode = "claimFinalized"
+  ClaimResolvedCode = "claimResolved"
+  BisectionRevealedCode = "bisectionRevealed"
+  BisectionChosenCode = "bisectionChosen"
+  RowCheckedCode = "rowChecked"
+  ChunksMissingCode = "chunksMissing"
+  DelegateAuthorizedCode = "delegateAuthorized"
+  DelegateRevokedCode = "delegateRevoked"
+  LimitExceededCode = "limitExceeded"
+  StatsDivergenceCode = "statsDivergence"
+  ClaimListCode = "claimList"
+  ClaimCode = "claim"
+  UserCode = "user"
+  ClaimHistoryCode = "claimHistory"
+  UploadStatusCode = "uploadStatus"
+  StatsCode = "stats"
+)
+
+// Error codes, of inputs that failed
+const (
+  InvalidInputCode = "invalidInput"
+  InvalidParametersCode = "invalidParameters"
+  InvalidDataCode = "invalidData"
+  ClaimNotFoundCode = "claimNotFound"
+  ClaimExistsCode = "claimExists"
+  UserNotFoundCode = "userNotFound"
+  NotAuthorizedCode = "notAuthorized"
+  IllegalTransitionCode = "illegalTransition"
+  TimeoutPendingCode = "timeoutPending"
+  RejectedCode = "rejected"
+)
+
+// ErrorCodes lists the error codes
+var ErrorCodes = []string{InvalidInputCode, InvalidParametersCode, InvalidDataCode, ClaimNotFoundCode, ClaimExistsCode, UserNotFoundCode, NotAuthorizedCode, IllegalTransitionCode, TimeoutPendingCode, RejectedCode}
+
+func IsErrorCode(code string) bool {
+  for _, errorCode := range ErrorCodes {
+    if code == errorCode {
+      return true
+    }
+  }
+  return false
+}
+
+// ClaimDetails is a claim as reported, with its column values and without its
+// history, which has its own route
+type ClaimDetails struct {
+  *Claim
+  ColumnValues []ColumnValue      `json:"columnValues,omitempty"`
+  History []HistoryEntry          `json:"history,omitempty"`
+}
+
+func NewClaimDetails(claim *Claim) *ClaimDetails {
+  return &ClaimDetails{Claim: claim, ColumnValues: claim.ColumnValues()}
+}
+
+type ClaimHistory struct {
+  Id string                       `json:"id"`
+  History []HistoryEntry          `json:"history"`
+}
+
+// UploadStatus is the progress of a claim upload
+type UploadStatus struct {
+  Id string                       `json:"id"`
+  TotalChunks uint32              `json:"totalChunks"`
+  Received []uint32               `json:"received"`
+  Missing []uint32                `json:"missing"`
+  Stored bool                     `json:"stored"`
+}
+
+// Delegation is an address authorized to validate the claims of a claimer, or
+// only the claim Id
+type Delegation struct {
+  Claimer string                  `json:"claimer"`
+  Delegate string                 `json:"delegate"`
+  Id string                       `json:"id,omitempty"`
+}
+
+// TransitionErrorPayload is the payload of an event a claim status doesn't
+// take now
+type TransitionErrorPayload struct {
+  From Status                     `json:"from"`
+  Event string                    `json:"event"`
+  Remaining uint64                `json:"remaining,omitempty"`
+}
+
+// ReportPayloads is the catalog of the payload types by code
+var ReportPayloads = map[string]func() interface{}{
+  ClaimCreatedCode: func() interface{} { return &ClaimDetails{} },
+  ClaimDisputedCode: func() interface{} { return &ClaimDetails{} },
+  ClaimFinalizedCode: func() interface{} { return &ClaimDetails{} },
+  ClaimResolvedCode: func() interface{} { return &ClaimDetails{} },
+  BisectionRevealedCode: func() interface{} { return &ClaimDetails{} },
+  BisectionChosenCode: func() interface{} { return &ClaimDetails{} },
+  RowCheckedCode: func() interface{} { return &ClaimDetails{} },
+  ChunksMissingCode: func() interface{} { return &UploadStatus{} },
+  DelegateAuthorizedCode: func() interface{} { return &Delegation{} },
+  DelegateRevokedCode: func() interface{} { return &Delegation{} },
+  LimitExceededCode: func() interface{} { return &LimitReport{} },
+  StatsDivergenceCode: func() interface{} { return &StatsReport{} },
+  ClaimListCode: func() interface{} { return &ClaimPage{} },
+  ClaimCode: func() interface{} { return &ClaimDetails{} },
+  UserCode: func() interface{} { return &User{} },
+  ClaimHistoryCode: func() interface{} { return &ClaimHistory{} },
+  UploadStatusCode: func() interface{} { return &UploadStatus{} },
+  StatsCode: func() interface{} { return &StatsReport{} },
+  IllegalTransitionCode: func() interface{} { return &TransitionErrorPayload{} },
+  TimeoutPendingCode: func() interface{} { return &TransitionErrorPayload{} },
+}
+
+// NewReport makes the envelope of a payload
+func NewReport(code string, action string, claimId string, message string, payload interface{}) (*Report,error) {
+  report := &Report{Code: code, Ok: !IsErrorCode(code), Action: action, Id: claimId, Message: message}
+  if payload != nil {
+    payloadJson, err := json.Marshal(payload)
+    if err != nil {
+      return nil, fmt.Errorf("NewReport: error converting payload to json: %s", err)
+    }
+    report.Payload = payloadJson
+  }
+  return report, nil
+}
+
+// DecodeReport reads an envelope and its payload, typed by the catalog. The
+// payload of codes without a type is nil.
+func DecodeReport(data []byte) (*Report,interface{},error) {
+  report := &Report{}
+  if err := json.Unmarshal(data,report); err != nil {
+    return nil, nil, fmt.Errorf("DecodeReport: invalid report: %s", err)
+  }
+  if report.Code == "" {
+    return nil, nil, fmt.Errorf("DecodeReport: report has no code")
+  }
+  newPayload := ReportPayloads[report.Code]
+  if newPayload == nil || len(report.Payload) == 0 {
+    return report, nil, nil
+  }
+  payload := newPayload()
+  if err := json.Unmarshal(report.Payload,payload); err != nil {
+    return nil, nil, fmt.Errorf("DecodeReport: invalid %s payload: %s", report.Code, err)
+  }
+  return report, payload, nil
+}
+
+// CodeError is a failed input with the code it is reported with, Id is the
+// claim it is about, when known
+type CodeError struct {
+  Code string
+  Id string
+  Err error
+}
+
+func (e *CodeError) Error() string {
+  return e.Err.Error()
+}
+
+func (e *CodeError) Unwrap() error {
+  return e.Err
+}
+
+// ErrorReport tells the code and payload of the report of a failed input,
+// the errors of the state machine have their own codes
+func ErrorReport(err error) (string,interface{}) {
+  var timeoutErr *TimeoutError
+  var transitionErr *TransitionError
+  var codeErr *CodeError
+  switch {
+  case errors.As(err,&codeErr):
+    return codeErr.Code, nil
+  case errors.As(err,&transitionErr) && errors.As(err,&timeoutErr):
+    return TimeoutPendingCode, &TransitionErrorPayload{From: transitionErr.From, Event: transitionErr.Event.String(), Remaining: timeoutErr.Remaining}
+  case errors.As(err,&transitionErr):
+    return IllegalTransitionCode, &TransitionErrorPayload{From: transitionErr.From, Event: transitionErr.Event.String()}
+  }
+  return RejectedCode, nil
+}
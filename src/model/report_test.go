@@ -0,0 +1,113 @@
+package model
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "reflect"
+  "testing"
+)
+
+func TestReportRoundTrip(t *testing.T) {
+  claim := &Claim{UserAddress: "alice", Value: 7, Metric: "blankCells", Status: Validated, LastEdited: 30, History: []HistoryEntry{{Type: "validate", Actor: "alice", From: Open, To: Validated}}}
+  payloads := map[string]interface{}{
+    ClaimCreatedCode: NewClaimDetails(claim),
+    ChunksMissingCode: &UploadStatus{Id: "claim", TotalChunks: 3, Received: []uint32{0}, Missing: []uint32{1, 2}},
+    DelegateAuthorizedCode: &Delegation{Claimer: "alice", Delegate: "bob"},
+    LimitExceededCode: &LimitReport{Limit: "maxChunks", Max: 4, Value: 5},
+    StatsDivergenceCode: &StatsReport{Users: 1, Claims: 1, Divergences: []StatsDivergence{{Address: "alice", Field: "totalClaims", Expected: 1, Actual: 2}}},
+    ClaimListCode: &ClaimPage{Claims: []*SimplifiedClaim{{Id: "claim", Status: Open, Value: 7}}},
+    ClaimHistoryCode: &ClaimHistory{Id: "claim", History: claim.History},
+    TimeoutPendingCode: &TransitionErrorPayload{From: Open, Event: "finalize", Remaining: 12},
+  }
+  for code := range ReportPayloads {
+    t.Run(code, func(t *testing.T) {
+      payload := payloads[code]
+      report, err := NewReport(code, "action", "claim", "message", payload)
+      if err != nil {
+        t.Fatal(err)
+      }
+      reportJson, err := json.Marshal(report)
+      if err != nil {
+        t.Fatal(err)
+      }
+      decoded, decodedPayload, err := DecodeReport(reportJson)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if decoded.Code != code || decoded.Ok == IsErrorCode(code) || decoded.Action != "action" || decoded.Id != "claim" || decoded.Message != "message" {
+        t.Errorf("decoded envelope %+v", decoded)
+      }
+      if payload == nil {
+        if decodedPayload != nil {
+          t.Errorf("decoded payload %+v without payload", decodedPayload)
+        }
+        return
+      }
+      if reflect.TypeOf(decodedPayload) != reflect.TypeOf(ReportPayloads[code]()) {
+        t.Fatalf("decoded payload of type %T", decodedPayload)
+      }
+      expected, _ := json.Marshal(payload)
+      got, _ := json.Marshal(decodedPayload)
+      if string(expected) != string(got) {
+        t.Errorf("decoded payload %s, expected %s", got, expected)
+      }
+    })
+  }
+}
+
+func TestReportDetailsOmitHistory(t *testing.T) {
+  claim := &Claim{UserAddress: "alice", History: []HistoryEntry{{Type: "claim"}}}
+  report, err := NewReport(ClaimCode, "showClaim", "claim", "", NewClaimDetails(claim))
+  if err != nil {
+    t.Fatal(err)
+  }
+  var payload map[string]interface{}
+  if err := json.Unmarshal(report.Payload, &payload); err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := payload["history"]; ok {
+    t.Errorf("claim details report the history: %s", report.Payload)
+  }
+  if payload["userAddress"] != "alice" {
+    t.Errorf("claim details miss the claim: %s", report.Payload)
+  }
+}
+
+func TestDecodeReportErrors(t *testing.T) {
+  for _, data := range []string{"Claim created", `{"ok":true}`, `{"code":"claim","payload":[1]}`} {
+    if _, _, err := DecodeReport([]byte(data)); err == nil {
+      t.Errorf("expected error decoding %s", data)
+    }
+  }
+  report, payload, err := DecodeReport([]byte(`{"code":"newCode","ok":true,"action":"x","payload":{"a":1}}`))
+  if err != nil || report.Code != "newCode" || payload != nil {
+    t.Errorf("unknown code decoded as %+v %v %v", report, payload, err)
+  }
+}
+
+func TestErrorReport(t *testing.T) {
+  transitionErr := &TransitionError{From: Open, Event: FinalizeEvent, Err: &TimeoutError{Remaining: 5}}
+  illegalErr := &TransitionError{From: Validated, Event: DisputeEvent, Err: ErrIllegalTransition}
+  tests := []struct {
+    err error
+    code string
+    payload interface{}
+  }{
+    {&CodeError{Code: ClaimNotFoundCode, Err: errors.New("missing")}, ClaimNotFoundCode, nil},
+    {fmt.Errorf("HandleDispute: %w", &CodeError{Code: NotAuthorizedCode, Err: errors.New("no")}), NotAuthorizedCode, nil},
+    {fmt.Errorf("HandleFinalize: %w", transitionErr), TimeoutPendingCode, &TransitionErrorPayload{From: Open, Event: "finalize", Remaining: 5}},
+    {fmt.Errorf("HandleDispute: %w", illegalErr), IllegalTransitionCode, &TransitionErrorPayload{From: Validated, Event: "dispute"}},
+    {fmt.Errorf("HandleRevealBisection: %s", illegalErr), RejectedCode, nil},
+    {errors.New("anything"), RejectedCode, nil},
+  }
+  for _, test := range tests {
+    code, payload := ErrorReport(test.err)
+    if code != test.code || !reflect.DeepEqual(payload, test.payload) {
+      t.Errorf("%v reported as %s %+v, expected %s %+v", test.err, code, payload, test.code, test.payload)
+    }
+    if !IsErrorCode(code) {
+      t.Errorf("%s isn't an error code", code)
+    }
+  }
+}
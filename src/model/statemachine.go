@@ -0,0 +1,301 @@
+package model
+
+import (
+  "fmt"
+  "errors"
+)
+
+// Claim statuses only change through the transition table: a transition
+// leaves a status on an event when its guard passes, and its effect updates
+// the stats of the users involved. Effects run knowing the status they leave,
+// and handlers ask the table before acting on a claim. Every transition is
+// added to the claim history with its actor and reason.
+
+type Event uint8
+
+const (
+  ClaimEvent Event = iota
+  DisputeEvent
+  FinalizeEvent
+  ValidateEvent
+  ContradictEvent
+  RevealEvent
+  ChooseEvent
+  CheckRowEvent
+)
+
+func (e Event) String() string {
+  events := [...]string{"claim", "dispute", "finalize", "validate", "contradict", "reveal", "choose", "checkRow"}
+  if int(e) >= len(events) {
+    return "unknown"
+  }
+  return events[e]
+}
+
+// Events lists every event, for exhaustive checks
+var Events = []Event{ClaimEvent, DisputeEvent, FinalizeEvent, ValidateEvent, ContradictEvent, RevealEvent, ChooseEvent, CheckRowEvent}
+
+// Statuses lists every status, for exhaustive checks
+var Statuses = []Status{Undefined, Open, Disputing, Finalized, Disputed, Validated, Contradicted}
+
+// ErrIllegalTransition is an event a claim status doesn't take
+var ErrIllegalTransition = errors.New("illegal transition")
+
+// TransitionError is an event rejected by the state machine, either illegal
+// in the claim status or refused by the guards
+type TransitionError struct {
+  From Status
+  Event Event
+  Err error
+}
+
+func (e *TransitionError) Error() string {
+  return fmt.Sprintf("Can't %s %s claims: %s", e.Event, e.From, e.Err)
+}
+
+func (e *TransitionError) Unwrap() error {
+  return e.Err
+}
+
+// TimeoutError is a claim finalized before its timeout
+type TimeoutError struct {
+  Remaining uint64
+}
+
+func (e *TimeoutError) Error() string {
+  return fmt.Sprintf("Claim can't be finalized yet, %d more seconds to go", e.Remaining)
+}
+
+// ErrNotBisection and ErrNotSpotCheck are steps of another dispute mode
+var ErrNotBisection = errors.New("claim isn't in a bisection dispute")
+var ErrNotSpotCheck = errors.New("claim isn't in a spot check dispute")
+
+// Transition is a row of the transition table
+type Transition struct {
+  From Status
+  Event Event
+  Guard func(t *TransitionContext) error
+  To Status
+  Effect func(t *TransitionContext)
+  // Reason is recorded in the history when the input doesn't give one
+  Reason string
+}
+
+// TransitionContext holds what the guards and effects of an event need
+type TransitionContext struct {
+  ClaimId string
+  Claim *Claim
+  GetUser func(address string) *User
+  Timestamp uint64
+  ClaimTimeout uint64
+  DisputeTimeout uint64
+  // the disputer of a dispute event and the third party whose data
+  // contradicted the claim, if any
+  Sender string
+  Uploader string
+  // the sender of the input and why it changes the claim, for the history
+  Actor string
+  Reason string
+  // the claim index to update, if any
+  Index *ClaimIndex
+}
+
+func (t *TransitionContext) claimer() *User {
+  return t.GetUser(t.Claim.UserAddress)
+}
+
+func (t *TransitionContext) disputer() *User {
+  return t.GetUser(t.Claim.DisputingUserAddress)
+}
+
+func timeoutPassed(t *TransitionContext, timeout uint64) error {
+  if t.Timestamp < t.Claim.LastEdited + timeout {
+    return &TimeoutError{Remaining: t.Claim.LastEdited + timeout - t.Timestamp}
+  }
+  return nil
+}
+
+// the disputer didn't choose a side of the revealed bisection in time
+func disputerTimedOut(t *TransitionContext) error {
+  if err := timeoutPassed(t,t.DisputeTimeout); err != nil {
+    return err
+  }
+  if t.Claim.Bisection == nil || t.Claim.Bisection.Left == nil {
+    return errors.New("claimer has to answer the dispute")
+  }
+  return nil
+}
+
+// the claimer didn't answer the dispute in time
+func claimerTimedOut(t *TransitionContext) error {
+  if err := timeoutPassed(t,t.DisputeTimeout); err != nil {
+    return err
+  }
+  if t.Claim.Bisection != nil && t.Claim.Bisection.Left != nil {
+    return errors.New("disputer has to choose a bisection side")
+  }
+  return nil
+}
+
+func isBisection(t *TransitionContext) error {
+  if t.Claim.Bisection == nil {
+    return ErrNotBisection
+  }
+  return nil
+}
+
+func isSpotCheck(t *TransitionContext) error {
+  if t.Claim.SpotCheck == nil {
+    return ErrNotSpotCheck
+  }
+  return nil
+}
+
+func openClaim(t *TransitionContext) {
+  t.claimer().OpenClaims[t.ClaimId] = struct{}{}
+}
+
+func disputeClaim(t *TransitionContext) {
+  t.Claim.DisputingUserAddress = t.Sender
+  claimer := t.claimer()
+  claimer.OpenDisputes[t.ClaimId] = struct{}{} // add to users open disputes
+  delete(claimer.OpenClaims,t.ClaimId) // delete from users open claims
+}
+
+// an open claim is accepted as correct
+func acceptOpenClaim(t *TransitionContext) {
+  claimer := t.claimer()
+  claimer.TotalClaims += 1 // add to user finalized claims
+  claimer.CorrectClaims += 1 // add to user finalized correct claims
+  delete(claimer.OpenClaims,t.ClaimId) // delete from users open claims
+}
+
+func rejectOpenClaim(t *TransitionContext) {
+  claimer := t.claimer()
+  claimer.TotalClaims += 1 // add to user finalized claims
+  delete(claimer.OpenClaims,t.ClaimId) // delete from users open claims
+}
+
+// the claimer wins the dispute
+func acceptDisputedClaim(t *TransitionContext) {
+  claimer := t.claimer()
+  claimer.TotalClaims += 1 // add to user finalized claims
+  claimer.CorrectClaims += 1 // add to user finalized correct claims
+  delete(claimer.OpenDisputes,t.ClaimId) // delete from users open disputes
+
+  t.disputer().TotalDisputes += 1 // add to user disputes
+}
+
+// the claimer didn't answer the dispute in time
+func timeoutDisputedClaim(t *TransitionContext) {
+  claimer := t.claimer()
+  claimer.TotalClaims += 1 // add to user finalized claims
+  claimer.TotalDisputes += 1 // add to user disputes
+  delete(claimer.OpenDisputes,t.ClaimId) // delete from users open disputes
+
+  disputer := t.disputer()
+  disputer.TotalDisputes += 1 // add to user disputes
+  disputer.WonDisputes += 1 // add to user won disputes
+}
+
+// the data proved the claim wrong
+func rejectDisputedClaim(t *TransitionContext) {
+  claimer := t.claimer()
+  claimer.TotalClaims += 1 // add to user finalized claims
+  delete(claimer.OpenDisputes,t.ClaimId) // delete from users open disputes
+
+  disputer := t.disputer()
+  disputer.TotalDisputes += 1 // add to user disputes
+  disputer.WonDisputes += 1 // add to user won disputes
+
+  if t.Uploader != "" {
+    // a third party proved the claim wrong with its data
+    t.Claim.DataProvider = t.Uploader
+    t.GetUser(t.Uploader).ProvidedData += 1
+  }
+}
+
+// Transitions is the claim transition table. Rows of the same status and
+// event are tried in order, the first whose guard passes applies.
+var Transitions = []Transition{
+  {From: Undefined, Event: ClaimEvent, To: Open, Effect: openClaim},
+
+  {From: Open, Event: DisputeEvent, To: Disputing, Effect: disputeClaim},
+  {From: Open, Event: FinalizeEvent, Guard: func(t *TransitionContext) error { return timeoutPassed(t,t.ClaimTimeout) }, To: Finalized, Effect: acceptOpenClaim, Reason: "no dispute before the claim timeout"},
+  {From: Open, Event: ValidateEvent, To: Validated, Effect: acceptOpenClaim},
+  {From: Open, Event: ContradictEvent, To: Contradicted, Effect: rejectOpenClaim},
+
+  {From: Disputing, Event: FinalizeEvent, Guard: disputerTimedOut, To: Finalized, Effect: acceptDisputedClaim, Reason: "disputer didn't choose a bisection side in time"},
+  {From: Disputing, Event: FinalizeEvent, Guard: claimerTimedOut, To: Disputed, Effect: timeoutDisputedClaim, Reason: "claimer didn't answer the dispute in time"},
+  {From: Disputing, Event: ValidateEvent, To: Validated, Effect: acceptDisputedClaim},
+  {From: Disputing, Event: ContradictEvent, To: Contradicted, Effect: rejectDisputedClaim},
+  {From: Disputing, Event: RevealEvent, Guard: isBisection, To: Disputing},
+  {From: Disputing, Event: ChooseEvent, Guard: isBisection, To: Disputing},
+  {From: Disputing, Event: CheckRowEvent, Guard: isSpotCheck, To: Disputing},
+}
+
+// CheckEvent tells whether the status takes the event at all, before the
+// guards, so handlers can reject inputs early
+func CheckEvent(status Status, event Event) error {
+  for _, transition := range Transitions {
+    if transition.From == status && transition.Event == event {
+      return nil
+    }
+  }
+  return &TransitionError{From: status, Event: event, Err: ErrIllegalTransition}
+}
+
+// match finds the first transition of the claim status and event whose guard
+// passes. When every guard fails the error of the first one is returned.
+func match(t *TransitionContext, event Event) (*Transition,error) {
+  from := t.Claim.Status
+  var guardErr error
+  for i := range Transitions {
+    transition := &Transitions[i]
+    if transition.From != from || transition.Event != event {
+      continue
+    }
+    if transition.Guard != nil {
+      if err := transition.Guard(t); err != nil {
+        if guardErr == nil {
+          guardErr = err
+        }
+        continue
+      }
+    }
+    return transition, nil
+  }
+  if guardErr == nil {
+    guardErr = ErrIllegalTransition
+  }
+  return nil, &TransitionError{From: from, Event: event, Err: guardErr}
+}
+
+// Allowed tells whether Fire would apply the event now
+func Allowed(t *TransitionContext, event Event) error {
+  _, err := match(t,event)
+  return err
+}
+
+// Fire applies the event to the claim: the transition sets the new status and
+// edit time, runs its effect and is added to the history and the index
+func Fire(t *TransitionContext, event Event) error {
+  transition, err := match(t,event)
+  if err != nil {
+    return err
+  }
+  reason := t.Reason
+  if reason == "" {
+    reason = transition.Reason
+  }
+  t.Claim.History = append(t.Claim.History,HistoryEntry{Type: event.String(), Actor: t.Actor, Timestamp: t.Timestamp, From: t.Claim.Status, To: transition.To, Reason: reason})
+  t.Claim.Status = transition.To
+  t.Claim.LastEdited = t.Timestamp
+  if transition.Effect != nil {
+    transition.Effect(t)
+  }
+  if t.Index != nil {
+    t.Index.Update(t.ClaimId,t.Claim)
+  }
+  return nil
+}
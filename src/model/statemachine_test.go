@@ -0,0 +1,225 @@
+package model
+
+import (
+  "errors"
+  "testing"
+)
+
+const testClaimId = "claim"
+
+func newTransition(status Status) (*TransitionContext, map[string]*User) {
+  users := make(map[string]*User)
+  getUser := func(address string) *User {
+    if users[address] == nil {
+      users[address] = &User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{})}
+    }
+    return users[address]
+  }
+  claim := &Claim{Status: status, UserAddress: "claimer", LastEdited: 100}
+  if status != Undefined && status != Open {
+    claim.DisputingUserAddress = "disputer"
+  }
+  switch status {
+  case Open:
+    getUser("claimer").OpenClaims[testClaimId] = struct{}{}
+  case Disputing:
+    getUser("claimer").OpenDisputes[testClaimId] = struct{}{}
+  }
+  return &TransitionContext{ClaimId: testClaimId, Claim: claim, GetUser: getUser, Timestamp: 1000, ClaimTimeout: 10, DisputeTimeout: 10, Sender: "disputer", Actor: "actor"}, users
+}
+
+// every status and event pair, with claims that pass the timeouts and have no
+// dispute mode
+func TestTransitionTable(t *testing.T) {
+  legal := map[Status]map[Event]Status{
+    Undefined: {ClaimEvent: Open},
+    Open: {DisputeEvent: Disputing, FinalizeEvent: Finalized, ValidateEvent: Validated, ContradictEvent: Contradicted},
+    Disputing: {FinalizeEvent: Disputed, ValidateEvent: Validated, ContradictEvent: Contradicted},
+  }
+  guarded := map[Status]map[Event]error{
+    Disputing: {RevealEvent: ErrNotBisection, ChooseEvent: ErrNotBisection, CheckRowEvent: ErrNotSpotCheck},
+  }
+  for _, status := range Statuses {
+    for _, event := range Events {
+      t.Run(status.String()+"/"+event.String(), func(t *testing.T) {
+        transition, _ := newTransition(status)
+        err := Fire(transition, event)
+        to, isLegal := legal[status][event]
+        guardErr, isGuarded := guarded[status][event]
+
+        if isLegal {
+          if err != nil {
+            t.Fatalf("unexpected error %v", err)
+          }
+          if transition.Claim.Status != to {
+            t.Errorf("status %s, expected %s", transition.Claim.Status, to)
+          }
+          if transition.Claim.LastEdited != transition.Timestamp {
+            t.Errorf("last edited %d, expected %d", transition.Claim.LastEdited, transition.Timestamp)
+          }
+          history := transition.Claim.History
+          if len(history) != 1 || history[0].Type != event.String() || history[0].Actor != "actor" || history[0].Timestamp != 1000 || history[0].From != status || history[0].To != to {
+            t.Errorf("history %+v", history)
+          }
+        } else {
+          var transitionErr *TransitionError
+          if !errors.As(err, &transitionErr) || transitionErr.From != status || transitionErr.Event != event {
+            t.Fatalf("expected transition error, got %v", err)
+          }
+          expected := ErrIllegalTransition
+          if isGuarded {
+            expected = guardErr
+          }
+          if !errors.Is(err, expected) {
+            t.Errorf("error %v, expected %v", err, expected)
+          }
+          if transition.Claim.Status != status {
+            t.Errorf("status changed to %s", transition.Claim.Status)
+          }
+          if len(transition.Claim.History) != 0 {
+            t.Errorf("rejected event added to the history: %+v", transition.Claim.History)
+          }
+        }
+
+        checkErr := CheckEvent(status, event)
+        if (checkErr == nil) != (isLegal || isGuarded) {
+          t.Errorf("CheckEvent %v doesn't match the table", checkErr)
+        }
+        if checkErr != nil && !errors.Is(checkErr, ErrIllegalTransition) {
+          t.Errorf("CheckEvent error %v, expected illegal transition", checkErr)
+        }
+      })
+    }
+  }
+}
+
+func TestTransitionGuards(t *testing.T) {
+  tests := []struct {
+    name string
+    from Status
+    event Event
+    setup func(t *TransitionContext)
+    to Status
+    remaining uint64
+  }{
+    {name: "open before timeout", from: Open, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Timestamp = 104 }, to: Open, remaining: 6},
+    {name: "dispute before timeout", from: Disputing, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Timestamp = 109 }, to: Disputing, remaining: 1},
+    {name: "open at timeout", from: Open, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Timestamp = 110 }, to: Finalized},
+    {name: "claimer didn't reveal", from: Disputing, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Claim.Bisection = &Bisection{} }, to: Disputed},
+    {name: "disputer didn't choose", from: Disputing, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Claim.Bisection = &Bisection{Left: &BisectionNode{}} }, to: Finalized},
+    {name: "reveal", from: Disputing, event: RevealEvent, setup: func(t *TransitionContext) { t.Claim.Bisection = &Bisection{} }, to: Disputing},
+    {name: "choose", from: Disputing, event: ChooseEvent, setup: func(t *TransitionContext) { t.Claim.Bisection = &Bisection{} }, to: Disputing},
+    {name: "check row", from: Disputing, event: CheckRowEvent, setup: func(t *TransitionContext) { t.Claim.SpotCheck = &SpotCheck{} }, to: Disputing},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      transition, _ := newTransition(test.from)
+      test.setup(transition)
+      allowed := Allowed(transition, test.event)
+      err := Fire(transition, test.event)
+      if (allowed == nil) != (err == nil) {
+        t.Errorf("Allowed %v doesn't match Fire %v", allowed, err)
+      }
+      if transition.Claim.Status != test.to {
+        t.Errorf("status %s, expected %s", transition.Claim.Status, test.to)
+      }
+      var timeoutErr *TimeoutError
+      if test.remaining > 0 {
+        if !errors.As(err, &timeoutErr) || timeoutErr.Remaining != test.remaining {
+          t.Errorf("expected %d seconds to go, got %v", test.remaining, err)
+        }
+        if transition.Claim.LastEdited != 100 {
+          t.Errorf("rejected event edited the claim")
+        }
+      } else if err != nil {
+        t.Errorf("unexpected error %v", err)
+      }
+    })
+  }
+}
+
+func TestTransitionHistoryReasons(t *testing.T) {
+  tests := []struct {
+    name string
+    from Status
+    event Event
+    setup func(t *TransitionContext)
+    reason string
+  }{
+    {name: "open timeout", from: Open, event: FinalizeEvent, reason: "no dispute before the claim timeout"},
+    {name: "claimer timeout", from: Disputing, event: FinalizeEvent, reason: "claimer didn't answer the dispute in time"},
+    {name: "disputer timeout", from: Disputing, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Claim.Bisection = &Bisection{Left: &BisectionNode{}} }, reason: "disputer didn't choose a bisection side in time"},
+    {name: "input reason", from: Disputing, event: ContradictEvent, setup: func(t *TransitionContext) { t.Reason = "data doesn't match the claim" }, reason: "data doesn't match the claim"},
+    {name: "input reason over the table", from: Open, event: FinalizeEvent, setup: func(t *TransitionContext) { t.Reason = "other" }, reason: "other"},
+    {name: "no reason", from: Open, event: DisputeEvent},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      transition, _ := newTransition(test.from)
+      if test.setup != nil {
+        test.setup(transition)
+      }
+      if err := Fire(transition, test.event); err != nil {
+        t.Fatal(err)
+      }
+      history := transition.Claim.History
+      if len(history) != 1 || history[0].Reason != test.reason {
+        t.Errorf("history %+v, expected reason %q", history, test.reason)
+      }
+    })
+  }
+}
+
+func TestTransitionEffects(t *testing.T) {
+  type stats struct {
+    totalClaims, correctClaims, totalDisputes, wonDisputes, providedData uint32
+    openClaim, openDispute bool
+  }
+  tests := []struct {
+    name string
+    from Status
+    event Event
+    uploader string
+    claimer stats
+    disputer stats
+    uploaderStats stats
+  }{
+    {name: "claim", from: Undefined, event: ClaimEvent, claimer: stats{openClaim: true}},
+    {name: "dispute", from: Open, event: DisputeEvent, claimer: stats{openDispute: true}},
+    {name: "finalize open", from: Open, event: FinalizeEvent, claimer: stats{totalClaims: 1, correctClaims: 1}},
+    {name: "validate open", from: Open, event: ValidateEvent, claimer: stats{totalClaims: 1, correctClaims: 1}},
+    {name: "contradict open", from: Open, event: ContradictEvent, claimer: stats{totalClaims: 1}},
+    {name: "finalize dispute", from: Disputing, event: FinalizeEvent, claimer: stats{totalClaims: 1, totalDisputes: 1}, disputer: stats{totalDisputes: 1, wonDisputes: 1}},
+    {name: "validate dispute", from: Disputing, event: ValidateEvent, claimer: stats{totalClaims: 1, correctClaims: 1}, disputer: stats{totalDisputes: 1}},
+    {name: "contradict dispute", from: Disputing, event: ContradictEvent, claimer: stats{totalClaims: 1}, disputer: stats{totalDisputes: 1, wonDisputes: 1}},
+    {name: "contradict dispute with third party data", from: Disputing, event: ContradictEvent, uploader: "uploader", claimer: stats{totalClaims: 1}, disputer: stats{totalDisputes: 1, wonDisputes: 1}, uploaderStats: stats{providedData: 1}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      transition, users := newTransition(test.from)
+      transition.Uploader = test.uploader
+      if err := Fire(transition, test.event); err != nil {
+        t.Fatal(err)
+      }
+      if test.event == DisputeEvent && transition.Claim.DisputingUserAddress != transition.Sender {
+        t.Errorf("disputer %s, expected %s", transition.Claim.DisputingUserAddress, transition.Sender)
+      }
+      expected := map[string]stats{"claimer": test.claimer, "disputer": test.disputer}
+      if test.uploader != "" {
+        expected[test.uploader] = test.uploaderStats
+      }
+      for address, want := range expected {
+        user := transition.GetUser(address)
+        _, openClaim := user.OpenClaims[testClaimId]
+        _, openDispute := user.OpenDisputes[testClaimId]
+        got := stats{user.TotalClaims, user.CorrectClaims, user.TotalDisputes, user.WonDisputes, user.ProvidedData, openClaim, openDispute}
+        if got != want {
+          t.Errorf("%s stats %+v, expected %+v", address, got, want)
+        }
+      }
+      if len(users) > len(expected) {
+        t.Errorf("%d users touched, expected %d", len(users), len(expected))
+      }
+    })
+  }
+}
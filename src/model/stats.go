@@ -0,0 +1,179 @@
+package model
+
+import (
+  "fmt"
+  "sort"
+)
+
+// User stats are updated by the transition effects as claims change status,
+// but they only depend on the claims: the status of a claim and who claimed,
+// disputed and provided its data tell what it counted for each user. The
+// invariant checker rebuilds the stats from the claims and compares them to
+// the users.
+
+// UserStats are the parts of a user derived from the claims
+type UserStats struct {
+  OpenClaims map[string]struct{}  `json:"openClaims"`
+  OpenDisputes map[string]struct{}`json:"openDisputes"`
+  TotalDisputes uint32            `json:"totalDisputes"`
+  WonDisputes uint32              `json:"wonDisputes"`
+  TotalClaims uint32              `json:"totalClaims"`
+  CorrectClaims uint32            `json:"correctClaims"`
+  ProvidedData uint32             `json:"providedData"`
+}
+
+func newUserStats() *UserStats {
+  return &UserStats{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{})}
+}
+
+// Stats are the user parts derived from the claims
+func (u User) Stats() *UserStats {
+  return &UserStats{
+    OpenClaims: u.OpenClaims,
+    OpenDisputes: u.OpenDisputes,
+    TotalDisputes: u.TotalDisputes,
+    WonDisputes: u.WonDisputes,
+    TotalClaims: u.TotalClaims,
+    CorrectClaims: u.CorrectClaims,
+    ProvidedData: u.ProvidedData,
+  }
+}
+
+// RebuildUserStats computes the stats of every user involved in the claims
+func RebuildUserStats(claims map[string]*Claim) map[string]*UserStats {
+  stats := make(map[string]*UserStats)
+  get := func(address string) *UserStats {
+    if stats[address] == nil {
+      stats[address] = newUserStats()
+    }
+    return stats[address]
+  }
+  for claimId, claim := range claims {
+    if claim.Status == Undefined {
+      continue
+    }
+    claimer := get(claim.UserAddress)
+    disputed := claim.DisputingUserAddress != ""
+    switch claim.Status {
+    case Open:
+      claimer.OpenClaims[claimId] = struct{}{}
+    case Disputing:
+      claimer.OpenDisputes[claimId] = struct{}{}
+    case Finalized, Validated:
+      // the claim was right, a disputer lost the dispute
+      claimer.TotalClaims += 1
+      claimer.CorrectClaims += 1
+      if disputed {
+        get(claim.DisputingUserAddress).TotalDisputes += 1
+      }
+    case Disputed:
+      // the claimer didn't answer the dispute in time and lost it
+      claimer.TotalClaims += 1
+      claimer.TotalDisputes += 1
+      disputer := get(claim.DisputingUserAddress)
+      disputer.TotalDisputes += 1
+      disputer.WonDisputes += 1
+    case Contradicted:
+      claimer.TotalClaims += 1
+      if disputed {
+        disputer := get(claim.DisputingUserAddress)
+        disputer.TotalDisputes += 1
+        disputer.WonDisputes += 1
+      }
+      if claim.DataProvider != "" {
+        get(claim.DataProvider).ProvidedData += 1
+      }
+    }
+  }
+  return stats
+}
+
+// StatsDivergence is a user stat that doesn't match the claims
+type StatsDivergence struct {
+  Address string                  `json:"address"`
+  Field string                    `json:"field"`
+  Expected interface{}            `json:"expected"`
+  Actual interface{}              `json:"actual"`
+}
+
+func (d StatsDivergence) String() string {
+  return fmt.Sprintf("user %s %s is %v, expected %v", d.Address, d.Field, d.Actual, d.Expected)
+}
+
+func sortedIds(set map[string]struct{}) []string {
+  ids := make([]string,0,len(set))
+  for id := range set {
+    ids = append(ids,id)
+  }
+  sort.Strings(ids)
+  return ids
+}
+
+func diffIds(expected map[string]struct{}, actual map[string]struct{}) bool {
+  if len(expected) != len(actual) {
+    return true
+  }
+  for id := range expected {
+    if _, ok := actual[id]; !ok {
+      return true
+    }
+  }
+  return false
+}
+
+func compareStats(address string, expected *UserStats, actual *UserStats) []StatsDivergence {
+  var divergences []StatsDivergence
+  if diffIds(expected.OpenClaims,actual.OpenClaims) {
+    divergences = append(divergences,StatsDivergence{address,"openClaims",sortedIds(expected.OpenClaims),sortedIds(actual.OpenClaims)})
+  }
+  if diffIds(expected.OpenDisputes,actual.OpenDisputes) {
+    divergences = append(divergences,StatsDivergence{address,"openDisputes",sortedIds(expected.OpenDisputes),sortedIds(actual.OpenDisputes)})
+  }
+  counters := []struct {
+    field string
+    expected uint32
+    actual uint32
+  }{
+    {"totalDisputes",expected.TotalDisputes,actual.TotalDisputes},
+    {"wonDisputes",expected.WonDisputes,actual.WonDisputes},
+    {"totalClaims",expected.TotalClaims,actual.TotalClaims},
+    {"correctClaims",expected.CorrectClaims,actual.CorrectClaims},
+    {"providedData",expected.ProvidedData,actual.ProvidedData},
+  }
+  for _, counter := range counters {
+    if counter.expected != counter.actual {
+      divergences = append(divergences,StatsDivergence{address,counter.field,counter.expected,counter.actual})
+    }
+  }
+  return divergences
+}
+
+// CheckUserStats compares the stats of the users to the ones rebuilt from the
+// claims, sorted by address. Users without claims must have empty stats.
+func CheckUserStats(users map[string]*User, claims map[string]*Claim) []StatsDivergence {
+  rebuilt := RebuildUserStats(claims)
+  addresses := make([]string,0,len(users))
+  for address := range users {
+    addresses = append(addresses,address)
+  }
+  for address := range rebuilt {
+    if users[address] == nil {
+      addresses = append(addresses,address)
+    }
+  }
+  sort.Strings(addresses)
+
+  divergences := []StatsDivergence{}
+  for _, address := range addresses {
+    expected := rebuilt[address]
+    if expected == nil {
+      expected = newUserStats()
+    }
+    actual := newUserStats()
+    if users[address] != nil {
+      actual = users[address].Stats()
+    }
+    divergences = append(divergences,compareStats(address,expected,actual)...)
+  }
+  return divergences
+}
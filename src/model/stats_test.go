@@ -0,0 +1,100 @@
+package model
+
+import (
+  "testing"
+)
+
+type statsFixture struct {
+  users map[string]*User
+  claims map[string]*Claim
+}
+
+func newStatsFixture() *statsFixture {
+  return &statsFixture{users: make(map[string]*User), claims: make(map[string]*Claim)}
+}
+
+func (f *statsFixture) getUser(address string) *User {
+  if f.users[address] == nil {
+    f.users[address] = &User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{})}
+  }
+  return f.users[address]
+}
+
+// fire runs the events on the claim through the state machine, past the
+// timeouts, creating the claim on its first event
+func (f *statsFixture) fire(t *testing.T, claimId string, claimer string, events ...Event) *Claim {
+  if f.claims[claimId] == nil {
+    f.claims[claimId] = &Claim{UserAddress: claimer}
+  }
+  for i, event := range events {
+    transition := &TransitionContext{ClaimId: claimId, Claim: f.claims[claimId], GetUser: f.getUser, Timestamp: uint64(i+1)*100, ClaimTimeout: 10, DisputeTimeout: 10, Sender: "disputer"}
+    if event == ContradictEvent && claimer == "provided" {
+      transition.Uploader = "provider"
+    }
+    if err := Fire(transition,event); err != nil {
+      t.Fatalf("claim %s: %v", claimId, err)
+    }
+  }
+  return f.claims[claimId]
+}
+
+func TestUserStatsConsistent(t *testing.T) {
+  f := newStatsFixture()
+  f.fire(t,"open","alice",ClaimEvent)
+  f.fire(t,"disputing","alice",ClaimEvent,DisputeEvent)
+  f.fire(t,"finalized","alice",ClaimEvent,FinalizeEvent)
+  f.fire(t,"validated","bob",ClaimEvent,ValidateEvent)
+  f.fire(t,"contradicted","bob",ClaimEvent,ContradictEvent)
+  f.fire(t,"disputed","bob",ClaimEvent,DisputeEvent,FinalizeEvent)
+  f.fire(t,"disputeValidated","alice",ClaimEvent,DisputeEvent,ValidateEvent)
+  f.fire(t,"disputeContradicted","alice",ClaimEvent,DisputeEvent,ContradictEvent)
+  f.fire(t,"providedContradicted","provided",ClaimEvent,DisputeEvent,ContradictEvent)
+  // users without claims, like delegates, have empty stats
+  f.getUser("delegate")
+
+  if divergences := CheckUserStats(f.users,f.claims); len(divergences) != 0 {
+    t.Fatalf("unexpected divergences %v", divergences)
+  }
+
+  rebuilt := RebuildUserStats(f.claims)
+  if rebuilt["disputer"].TotalDisputes != 4 || rebuilt["disputer"].WonDisputes != 3 {
+    t.Errorf("disputer stats %+v", rebuilt["disputer"])
+  }
+  if rebuilt["provider"].ProvidedData != 1 {
+    t.Errorf("provider stats %+v", rebuilt["provider"])
+  }
+  if _, ok := rebuilt["alice"].OpenDisputes["disputing"]; !ok || len(rebuilt["alice"].OpenDisputes) != 1 {
+    t.Errorf("alice open disputes %v", rebuilt["alice"].OpenDisputes)
+  }
+}
+
+func TestUserStatsDivergences(t *testing.T) {
+  tests := []struct {
+    name string
+    drift func(f *statsFixture)
+    address string
+    field string
+  }{
+    {name: "open dispute left after validation", drift: func(f *statsFixture) { f.users["alice"].OpenDisputes["resolved"] = struct{}{} }, address: "alice", field: "openDisputes"},
+    {name: "open claim missing", drift: func(f *statsFixture) { delete(f.users["alice"].OpenClaims,"open") }, address: "alice", field: "openClaims"},
+    {name: "counter drift", drift: func(f *statsFixture) { f.users["disputer"].WonDisputes += 1 }, address: "disputer", field: "wonDisputes"},
+    {name: "stats of a user without claims", drift: func(f *statsFixture) { f.getUser("delegate").TotalClaims = 1 }, address: "delegate", field: "totalClaims"},
+    {name: "user missing", drift: func(f *statsFixture) { delete(f.users,"disputer") }, address: "disputer", field: "totalDisputes"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      f := newStatsFixture()
+      f.fire(t,"open","alice",ClaimEvent)
+      f.fire(t,"resolved","alice",ClaimEvent,DisputeEvent,ValidateEvent)
+      test.drift(f)
+
+      divergences := CheckUserStats(f.users,f.claims)
+      if len(divergences) != 1 {
+        t.Fatalf("expected one divergence, got %v", divergences)
+      }
+      if divergences[0].Address != test.address || divergences[0].Field != test.field {
+        t.Errorf("divergence %v, expected %s %s", divergences[0], test.address, test.field)
+      }
+    })
+  }
+}
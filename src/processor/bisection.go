@@ -0,0 +1,456 @@
+package processor
+
+import (
+  "io"
+  "fmt"
+  "bytes"
+  "errors"
+  "strings"
+  "crypto/sha256"
+  "encoding"
+  "encoding/binary"
+  "encoding/hex"
+  cid "github.com/ipfs/go-cid"
+  mh "github.com/multiformats/go-multihash"
+
+  "dapp/model"
+)
+
+// Bisection disputes avoid uploading the whole data. The claimer splits the
+// data at record ends into chunks and commits to a binary tree over them,
+// where each node holds the sha2-256 state of the data hash before and after
+// its bytes and the metric partial of its records. The root ties the data CID
+// (final hash state) to the claimed value (root partial). Each bisection step
+// reveals the children of the node in question, which must merge into it, and
+// the disputer picks the wrong one, so a wrong claim ends in a wrong leaf that
+// is recomputed from its chunk alone.
+//
+// Chunks are parsed on their own, so they must start at a record boundary:
+// every chunk but the last ends with a newline and holds at least one data
+// record (so the first one holds the whole header), and lazyQuotes is not
+// allowed, so a chunk that ends inside a quoted field is a parse error.
+
+const DefaultBisectionChunkSize = 64 * 1024
+
+const bisectionLeafTag = 0
+const bisectionNodeTag = 1
+
+// ErrBisectionChunkMismatch marks uploaded data that isn't the chunk of the
+// leaf in question, which says nothing about the claim
+var ErrBisectionChunkMismatch = errors.New("data doesn't match the chunk hash states")
+
+// ErrBisectionChunkBoundary marks a chunk that doesn't end a record
+var ErrBisectionChunkBoundary = errors.New("chunk doesn't end at a record boundary")
+
+func decodeHex(value string) ([]byte,error) {
+  if !strings.HasPrefix(value,"0x") {
+    return nil, fmt.Errorf("decodeHex: value must be 0x prefixed hex")
+  }
+  return hex.DecodeString(value[2:])
+}
+
+func encodeHex(value []byte) string {
+  return "0x"+hex.EncodeToString(value)
+}
+
+// NormalizeHex checks a 0x prefixed hex value and writes it in lower case, so
+// hash states and hashes can be compared as strings
+func NormalizeHex(value string) (string,error) {
+  decoded, err := decodeHex(value)
+  if err != nil {
+    return "", fmt.Errorf("NormalizeHex: %s", err)
+  }
+  return encodeHex(decoded), nil
+}
+
+// NewBisectionNode builds a node from 0x prefixed hex fields
+func NewBisectionNode(hash string, stateIn string, stateOut string, partial []uint64) (model.BisectionNode,error) {
+  node := model.BisectionNode{Partial: partial}
+  fields := []*string{&node.Hash,&node.StateIn,&node.StateOut}
+  for i, value := range []string{hash,stateIn,stateOut} {
+    normalized, err := NormalizeHex(value)
+    if err != nil {
+      return model.BisectionNode{}, err
+    }
+    *fields[i] = normalized
+  }
+  if len(node.Hash) != 2+2*sha256.Size {
+    return model.BisectionNode{}, fmt.Errorf("NewBisectionNode: invalid hash length")
+  }
+  return node, nil
+}
+
+// InitialHashState is the marshaled state of an empty sha2-256 hash
+func InitialHashState() string {
+  state, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+  return encodeHex(state)
+}
+
+func hashFromState(state string) (hashWriter,error) {
+  stateBytes, err := decodeHex(state)
+  if err != nil {
+    return nil, err
+  }
+  hasher := sha256.New()
+  if err := hasher.(encoding.BinaryUnmarshaler).UnmarshalBinary(stateBytes); err != nil {
+    return nil, fmt.Errorf("hashFromState: invalid hash state: %s", err)
+  }
+  return hasher, nil
+}
+
+type hashWriter interface {
+  io.Writer
+  Sum(b []byte) []byte
+}
+
+func hashState(hasher hashWriter) string {
+  state, _ := hasher.(encoding.BinaryMarshaler).MarshalBinary()
+  return encodeHex(state)
+}
+
+// HashStateDigest is the sha2-256 digest of the data hashed up to the state
+func HashStateDigest(state string) ([]byte,error) {
+  hasher, err := hashFromState(state)
+  if err != nil {
+    return nil, err
+  }
+  return hasher.Sum(nil), nil
+}
+
+func appendHexField(buf []byte, value string) []byte {
+  decoded, _ := decodeHex(value)
+  buf = binary.AppendUvarint(buf,uint64(len(decoded)))
+  return append(buf,decoded...)
+}
+
+// bisectionHash is the sha2-256 of the tag, the length prefixed hash states,
+// the partial length and big endian values and the children hashes
+func bisectionHash(tag byte, node model.BisectionNode, children ...string) string {
+  buf := []byte{tag}
+  buf = appendHexField(buf,node.StateIn)
+  buf = appendHexField(buf,node.StateOut)
+  buf = binary.AppendUvarint(buf,uint64(len(node.Partial)))
+  for _, value := range node.Partial {
+    buf = binary.BigEndian.AppendUint64(buf,value)
+  }
+  for _, child := range children {
+    childHash, _ := decodeHex(child)
+    buf = append(buf,childHash...)
+  }
+  hash := sha256.Sum256(buf)
+  return encodeHex(hash[:])
+}
+
+func BisectionLeafHash(leaf model.BisectionNode) string {
+  return bisectionHash(bisectionLeafTag,leaf)
+}
+
+func BisectionNodeHash(node model.BisectionNode, leftHash string, rightHash string) string {
+  return bisectionHash(bisectionNodeTag,node,leftHash,rightHash)
+}
+
+// BisectionSplit is where the chunks [start,end) split into the left and the
+// right children, the left child gets the extra chunk
+func BisectionSplit(start uint32, end uint32) uint32 {
+  return start + (end-start+1)/2
+}
+
+// MergePartials adds two partials, failing on overflow so forged partials
+// can't wrap around
+func MergePartials(left []uint64, right []uint64) ([]uint64,error) {
+  if len(left) != len(right) {
+    return nil, fmt.Errorf("MergePartials: partials of %d and %d values", len(left), len(right))
+  }
+  merged := make([]uint64,len(left))
+  for i := range left {
+    merged[i] = left[i] + right[i]
+    if merged[i] < left[i] {
+      return nil, fmt.Errorf("MergePartials: partial overflow")
+    }
+  }
+  return merged, nil
+}
+
+func equalPartials(a []uint64, b []uint64) bool {
+  if len(a) != len(b) {
+    return false
+  }
+  for i := range a {
+    if a[i] != b[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// checkTreeCommitment checks the root of a bisection tree commitment: the data
+// CID must be a raw sha2-256 CID matching the final hash state, and a single
+// leaf tree must hash to the root. It returns the root and the claimed metric
+// result.
+func checkTreeCommitment(dataCid cid.Cid, metric Metric, options MetricOptions, columns []string, rootHash string, finalState string, partial []uint64, leaves uint32, width uint32) (model.BisectionNode,*MetricResult,error) {
+  partialMetric, ok := metric.(PartialMetric)
+  if !ok {
+    return model.BisectionNode{}, nil, fmt.Errorf("metric %s can't be computed by chunks", metric.Name())
+  }
+  pref := dataCid.Prefix()
+  if pref.Codec != cid.Raw || pref.MhType != mh.SHA2_256 {
+    return model.BisectionNode{}, nil, fmt.Errorf("tree commitments require a raw sha2-256 CID")
+  }
+  if options.Dialect.LazyQuotes {
+    return model.BisectionNode{}, nil, fmt.Errorf("tree commitments require strict quotes")
+  }
+  if leaves == 0 {
+    return model.BisectionNode{}, nil, fmt.Errorf("invalid number of leaves")
+  }
+  if metric.Vector() && uint32(len(columns)) != width {
+    return model.BisectionNode{}, nil, fmt.Errorf("%d columns for width %d", len(columns), width)
+  }
+
+  root, err := NewBisectionNode(rootHash,InitialHashState(),finalState,partial)
+  if err != nil {
+    return model.BisectionNode{}, nil, err
+  }
+  digest, err := HashStateDigest(root.StateOut)
+  if err != nil {
+    return model.BisectionNode{}, nil, err
+  }
+  decoded, err := mh.Decode(dataCid.Hash())
+  if err != nil {
+    return model.BisectionNode{}, nil, err
+  }
+  if !bytes.Equal(digest,decoded.Digest) {
+    return model.BisectionNode{}, nil, fmt.Errorf("final hash state doesn't match the CID")
+  }
+  if leaves == 1 && root.Hash != BisectionLeafHash(root) {
+    return model.BisectionNode{}, nil, fmt.Errorf("root doesn't match its single leaf")
+  }
+
+  result, err := partialMetric.FinalizePartial(columns,partial)
+  if err != nil {
+    return model.BisectionNode{}, nil, err
+  }
+  return root, result, nil
+}
+
+// NewBisection checks a bisection claim commitment and returns the dispute
+// state and the claimed metric result
+func NewBisection(dataCid cid.Cid, metric Metric, options MetricOptions, columns []string, rootHash string, finalState string, partial []uint64, leaves uint32, width uint32) (*model.Bisection,*MetricResult,error) {
+  root, result, err := checkTreeCommitment(dataCid,metric,options,columns,rootHash,finalState,partial,leaves,width)
+  if err != nil {
+    return nil, nil, fmt.Errorf("NewBisection: %s", err)
+  }
+  return &model.Bisection{Leaves: leaves, Width: width, Node: root, Start: 0, End: leaves}, result, nil
+}
+
+// VerifyBisectionChildren checks that the revealed children merge into the
+// node in question, and that children which are leaves hash to their fields
+func VerifyBisectionChildren(bisection *model.Bisection, left model.BisectionNode, right model.BisectionNode) error {
+  parent := bisection.Node
+  if bisection.End - bisection.Start < 2 {
+    return fmt.Errorf("VerifyBisectionChildren: node is a leaf")
+  }
+  if parent.Hash != BisectionNodeHash(parent,left.Hash,right.Hash) {
+    return fmt.Errorf("VerifyBisectionChildren: children hashes don't match the node")
+  }
+  if left.StateIn != parent.StateIn || left.StateOut != right.StateIn || right.StateOut != parent.StateOut {
+    return fmt.Errorf("VerifyBisectionChildren: hash states don't chain")
+  }
+  merged, err := MergePartials(left.Partial,right.Partial)
+  if err != nil {
+    return err
+  }
+  if !equalPartials(merged,parent.Partial) {
+    return fmt.Errorf("VerifyBisectionChildren: partials don't merge into the node partial")
+  }
+  mid := BisectionSplit(bisection.Start,bisection.End)
+  if mid - bisection.Start == 1 && left.Hash != BisectionLeafHash(left) {
+    return fmt.Errorf("VerifyBisectionChildren: left leaf hash doesn't match its fields")
+  }
+  if bisection.End - mid == 1 && right.Hash != BisectionLeafHash(right) {
+    return fmt.Errorf("VerifyBisectionChildren: right leaf hash doesn't match its fields")
+  }
+  return nil
+}
+
+// ComputeBisectionLeaf hashes a chunk from the state it starts at and computes
+// its partial. The first chunk holds the header and defines the width, the
+// others are read with the given width. It also returns the columns named by
+// the first chunk.
+func ComputeBisectionLeaf(chunk []byte, stateIn string, first bool, last bool, width uint32, metric PartialMetric, options MetricOptions) (model.BisectionNode,[]string,error) {
+  hasher, err := hashFromState(stateIn)
+  if err != nil {
+    return model.BisectionNode{}, nil, err
+  }
+  hasher.Write(chunk)
+  leaf := model.BisectionNode{StateIn: stateIn, StateOut: hashState(hasher)}
+
+  if !last && (len(chunk) == 0 || chunk[len(chunk)-1] != '\n') {
+    return leaf, nil, ErrBisectionChunkBoundary
+  }
+
+  var scanner *CsvScanner
+  if first {
+    scanner, err = NewCsvScanner(bytes.NewReader(chunk),options.Dialect)
+  } else {
+    scanner, err = NewCsvChunkScanner(bytes.NewReader(chunk),options.Dialect,int(width))
+  }
+  if err != nil {
+    return leaf, nil, err
+  }
+  leaf.Partial, err = metric.ComputePartial(scanner,options)
+  if err != nil {
+    return leaf, nil, err
+  }
+  if !last && scanner.rows == 0 {
+    return leaf, nil, fmt.Errorf("ComputeBisectionLeaf: chunk without data records")
+  }
+
+  var columns []string
+  if first {
+    chunkWidth := scanner.Width
+    if chunkWidth < 0 {
+      chunkWidth = 0
+    }
+    if uint32(chunkWidth) != width {
+      return leaf, nil, fmt.Errorf("ComputeBisectionLeaf: data width %d, committed %d", chunkWidth, width)
+    }
+    columns = scanner.Columns()
+  }
+  leaf.Hash = BisectionLeafHash(leaf)
+  return leaf, columns, nil
+}
+
+// VerifyBisectionLeaf recomputes the leaf in question from its chunk. Data
+// that doesn't hash to the leaf states is ErrBisectionChunkMismatch, any other
+// error means the leaf, and so the claim, is wrong. Columns are checked
+// against the header of the first chunk for vector claims.
+func VerifyBisectionLeaf(bisection *model.Bisection, chunk []byte, metric Metric, options MetricOptions, columns []string) error {
+  if bisection.End - bisection.Start != 1 {
+    return fmt.Errorf("VerifyBisectionLeaf: bisection hasn't reached a single chunk")
+  }
+  first := bisection.Start == 0
+  last := bisection.End == bisection.Leaves
+  return verifyLeafChunk(bisection.Node,chunk,first,last,bisection.Width,metric,options,columns)
+}
+
+func verifyLeafChunk(committed model.BisectionNode, chunk []byte, first bool, last bool, width uint32, metric Metric, options MetricOptions, columns []string) error {
+  partialMetric, ok := metric.(PartialMetric)
+  if !ok {
+    return fmt.Errorf("verifyLeafChunk: metric %s can't be computed by chunks", metric.Name())
+  }
+
+  leaf, chunkColumns, err := ComputeBisectionLeaf(chunk,committed.StateIn,first,last,width,partialMetric,options)
+  if leaf.StateOut != committed.StateOut {
+    return ErrBisectionChunkMismatch
+  }
+  if err != nil {
+    return err
+  }
+  if !equalPartials(leaf.Partial,committed.Partial) {
+    return fmt.Errorf("verifyLeafChunk: chunk partial %v, committed %v", leaf.Partial, committed.Partial)
+  }
+  if first && columns != nil && strings.Join(chunkColumns,"\x00") != strings.Join(columns,"\x00") {
+    return fmt.Errorf("verifyLeafChunk: header columns %v, committed %v", chunkColumns, columns)
+  }
+  return nil
+}
+
+// BisectionTree is the claimer side of a bisection dispute, it splits the data
+// and answers every step of the dispute
+type BisectionTree struct {
+  Chunks [][]byte
+  Leaves []model.BisectionNode
+  Width uint32
+  Columns []string
+  nodes map[[2]uint32]model.BisectionNode
+}
+
+// BuildBisectionTree splits the data at the first record end after every
+// chunkSize bytes and computes the leaves
+func BuildBisectionTree(data []byte, chunkSize int, metricName string, options MetricOptions) (*BisectionTree,error) {
+  metric, err := GetMetric(metricName)
+  if err != nil {
+    return nil, err
+  }
+  partialMetric, ok := metric.(PartialMetric)
+  if !ok {
+    return nil, fmt.Errorf("BuildBisectionTree: metric %s can't be computed by chunks", metric.Name())
+  }
+  if options.Dialect.LazyQuotes {
+    return nil, fmt.Errorf("BuildBisectionTree: bisection requires strict quotes")
+  }
+  if chunkSize <= 0 {
+    chunkSize = DefaultBisectionChunkSize
+  }
+
+  scanner, err := NewCsvScanner(bytes.NewReader(data),options.Dialect)
+  if err != nil {
+    return nil, err
+  }
+  tree := &BisectionTree{nodes: make(map[[2]uint32]model.BisectionNode)}
+  chunkStart := int64(0)
+  for {
+    _, err := scanner.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, err
+    }
+    offset := scanner.reader.InputOffset()
+    if offset - chunkStart >= int64(chunkSize) && offset < int64(len(data)) {
+      tree.Chunks = append(tree.Chunks,data[chunkStart:offset])
+      chunkStart = offset
+    }
+  }
+  tree.Chunks = append(tree.Chunks,data[chunkStart:])
+  if scanner.Width > 0 {
+    tree.Width = uint32(scanner.Width)
+  }
+  tree.Columns = scanner.Columns()
+
+  stateIn := InitialHashState()
+  for i, chunk := range tree.Chunks {
+    leaf, _, err := ComputeBisectionLeaf(chunk,stateIn,i == 0,i == len(tree.Chunks)-1,tree.Width,partialMetric,options)
+    if err != nil {
+      return nil, err
+    }
+    tree.Leaves = append(tree.Leaves,leaf)
+    stateIn = leaf.StateOut
+  }
+  return tree, nil
+}
+
+// Node is the node over the chunks [start,end)
+func (t *BisectionTree) Node(start uint32, end uint32) (model.BisectionNode,error) {
+  if start >= end || end > uint32(len(t.Leaves)) {
+    return model.BisectionNode{}, fmt.Errorf("BisectionTree: invalid range [%d,%d)", start, end)
+  }
+  if end - start == 1 {
+    return t.Leaves[start], nil
+  }
+  if node, ok := t.nodes[[2]uint32{start,end}]; ok {
+    return node, nil
+  }
+  mid := BisectionSplit(start,end)
+  left, err := t.Node(start,mid)
+  if err != nil {
+    return model.BisectionNode{}, err
+  }
+  right, err := t.Node(mid,end)
+  if err != nil {
+    return model.BisectionNode{}, err
+  }
+  partial, err := MergePartials(left.Partial,right.Partial)
+  if err != nil {
+    return model.BisectionNode{}, err
+  }
+  node := model.BisectionNode{StateIn: left.StateIn, StateOut: right.StateOut, Partial: partial}
+  node.Hash = BisectionNodeHash(node,left.Hash,right.Hash)
+  t.nodes[[2]uint32{start,end}] = node
+  return node, nil
+}
+
+func (t *BisectionTree) Root() (model.BisectionNode,error) {
+  return t.Node(0,uint32(len(t.Leaves)))
+}
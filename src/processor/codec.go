@@ -0,0 +1,169 @@
+package processor
+
+import (
+  "io"
+  "fmt"
+  "sort"
+  "bytes"
+  "compress/flate"
+  "compress/gzip"
+  "compress/lzw"
+  "compress/zlib"
+)
+
+// Compression codecs of the chunked data, the id travels in the chunk
+// envelope. Levels only tune the compressor, every level of a codec is read by
+// the same decompressor.
+const (
+  ChunkCodecNone uint8 = iota
+  ChunkCodecGzip
+  ChunkCodecZlib
+  ChunkCodecFlate
+  ChunkCodecLzw
+)
+
+// ChunkCodecAuto makes PrepareDataToSendWithCodec try every codec and keep
+// the smallest payload
+const ChunkCodecAuto = "auto"
+
+const DefaultCompressionLevel = flate.DefaultCompression
+
+type ChunkCodec struct {
+  Id uint8
+  Name string
+  NewWriter func(w io.Writer, level int) (io.WriteCloser,error)
+  NewReader func(r io.Reader) (io.ReadCloser,error)
+}
+
+type nopWriteCloser struct {
+  io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+  return nil
+}
+
+var chunkCodecs = map[uint8]*ChunkCodec{
+  ChunkCodecNone: {
+    Id: ChunkCodecNone,
+    Name: "none",
+    NewWriter: func(w io.Writer, level int) (io.WriteCloser,error) { return nopWriteCloser{w}, nil },
+    NewReader: func(r io.Reader) (io.ReadCloser,error) { return io.NopCloser(r), nil },
+  },
+  ChunkCodecGzip: {
+    Id: ChunkCodecGzip,
+    Name: "gzip",
+    NewWriter: func(w io.Writer, level int) (io.WriteCloser,error) { return gzip.NewWriterLevel(w,level) },
+    NewReader: func(r io.Reader) (io.ReadCloser,error) { return gzip.NewReader(r) },
+  },
+  ChunkCodecZlib: {
+    Id: ChunkCodecZlib,
+    Name: "zlib",
+    NewWriter: func(w io.Writer, level int) (io.WriteCloser,error) { return zlib.NewWriterLevel(w,level) },
+    NewReader: func(r io.Reader) (io.ReadCloser,error) { return zlib.NewReader(r) },
+  },
+  ChunkCodecFlate: {
+    Id: ChunkCodecFlate,
+    Name: "flate",
+    NewWriter: func(w io.Writer, level int) (io.WriteCloser,error) { return flate.NewWriter(w,level) },
+    NewReader: func(r io.Reader) (io.ReadCloser,error) { return flate.NewReader(r), nil },
+  },
+  ChunkCodecLzw: {
+    Id: ChunkCodecLzw,
+    Name: "lzw",
+    NewWriter: func(w io.Writer, level int) (io.WriteCloser,error) { return lzw.NewWriter(w,lzw.LSB,8), nil },
+    NewReader: func(r io.Reader) (io.ReadCloser,error) { return lzw.NewReader(r,lzw.LSB,8), nil },
+  },
+}
+
+func GetChunkCodec(id uint8) (*ChunkCodec,error) {
+  codec := chunkCodecs[id]
+  if codec == nil {
+    return nil, fmt.Errorf("GetChunkCodec: Unsupported compression codec %d", id)
+  }
+  return codec, nil
+}
+
+func ChunkCodecFromName(name string) (*ChunkCodec,error) {
+  for _, codec := range chunkCodecs {
+    if codec.Name == name {
+      return codec, nil
+    }
+  }
+  return nil, fmt.Errorf("ChunkCodecFromName: Unsupported compression codec %s, available codecs are %v", name, ListChunkCodecs())
+}
+
+// ListChunkCodecs lists the codec names by id
+func ListChunkCodecs() []string {
+  ids := make([]int, 0, len(chunkCodecs))
+  for id := range chunkCodecs {
+    ids = append(ids, int(id))
+  }
+  sort.Ints(ids)
+  names := make([]string, len(ids))
+  for i, id := range ids {
+    names[i] = chunkCodecs[uint8(id)].Name
+  }
+  return names
+}
+
+func CompressDataWithCodec(data []byte, codecId uint8, level int) ([]byte,error) {
+  codec, err := GetChunkCodec(codecId)
+  if err != nil {
+    return nil, err
+  }
+  var buf bytes.Buffer
+  zw, err := codec.NewWriter(&buf,level)
+  if err != nil {
+    return nil, fmt.Errorf("CompressData: error creating %s writer: %s", codec.Name, err)
+  }
+
+  _, err = zw.Write(data)
+  if err != nil {
+    return buf.Bytes(), fmt.Errorf("CompressData: error compressing data: %s", err)
+  }
+  if err := zw.Close(); err != nil {
+    return buf.Bytes(), fmt.Errorf("CompressData: error closing writer: %s", err)
+  }
+  return buf.Bytes(), nil
+}
+
+func DecompressDataWithCodec(data []byte, codecId uint8) ([]byte,error) {
+  var bufOut bytes.Buffer
+  codec, err := GetChunkCodec(codecId)
+  if err != nil {
+    return bufOut.Bytes(), err
+  }
+
+  zr, err := codec.NewReader(bytes.NewReader(data))
+  if err != nil {
+    return bufOut.Bytes(), fmt.Errorf("DecompressData: error decompressing data: %s", err)
+  }
+
+  if _, err := io.Copy(&bufOut, NewBoundedReader(zr,LimitDecompressedSize,Limits.MaxDecompressedSize)); err != nil {
+    return bufOut.Bytes(), fmt.Errorf("DecompressData: error copying data to out bufer: %w", err)
+  }
+  if err := zr.Close(); err != nil {
+    return bufOut.Bytes(), fmt.Errorf("DecompressData: error closing reader: %s", err)
+  }
+  return bufOut.Bytes(),nil
+}
+
+// compressSmallest compresses the data with every codec and keeps the smallest
+// payload, the lowest codec id wins ties
+func compressSmallest(data []byte, level int) ([]byte,uint8,error) {
+  var smallest []byte
+  var smallestId uint8
+  for _, name := range ListChunkCodecs() {
+    codec, _ := ChunkCodecFromName(name)
+    compressed, err := CompressDataWithCodec(data,codec.Id,level)
+    if err != nil {
+      return nil, 0, err
+    }
+    if smallest == nil || len(compressed) < len(smallest) {
+      smallest = compressed
+      smallestId = codec.Id
+    }
+  }
+  return smallest, smallestId, nil
+}
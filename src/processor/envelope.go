@@ -0,0 +1,106 @@
+package processor
+
+import (
+  "fmt"
+  "bytes"
+  "strings"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+)
+
+// Chunks are sent in a versioned binary envelope, hex encoded with 0x prefix:
+//   magic "CSVC" | version uint8 | codec uint8 | index uint32 |
+//   total chunks uint32 | total size uint64 | [manifest] | data
+// Integers are big endian. Total size is the compressed size of all chunks
+// together, and the first chunk carries the manifest, the sha256 of the data of
+// every chunk. PrepareDataToSend (and the wasm prepareData export) and
+// UpdateDataChunks both use this codec.
+
+var ChunkEnvelopeMagic = []byte("CSVC")
+
+const ChunkEnvelopeVersion uint8 = 1
+
+const chunkEnvelopeHeaderSize = 22
+
+type ChunkEnvelope struct {
+  Version uint8
+  Codec uint8
+  Index uint32
+  TotalChunks uint32
+  TotalSize uint64
+  Manifest [][]byte
+  Data []byte
+}
+
+func (e *ChunkEnvelope) Encode() []byte {
+  buf := make([]byte,0,chunkEnvelopeHeaderSize+len(e.Manifest)*sha256.Size+len(e.Data))
+  buf = append(buf,ChunkEnvelopeMagic...)
+  buf = append(buf,e.Version,e.Codec)
+  buf = binary.BigEndian.AppendUint32(buf,e.Index)
+  buf = binary.BigEndian.AppendUint32(buf,e.TotalChunks)
+  buf = binary.BigEndian.AppendUint64(buf,e.TotalSize)
+  for _, chunkHash := range e.Manifest {
+    buf = append(buf,chunkHash...)
+  }
+  return append(buf,e.Data...)
+}
+
+func (e *ChunkEnvelope) EncodeHex() string {
+  return "0x"+hex.EncodeToString(e.Encode())
+}
+
+// DecodeChunkEnvelope parses and checks an envelope, rejecting unknown
+// versions and codecs
+func DecodeChunkEnvelope(chunk []byte) (*ChunkEnvelope,error) {
+  if len(chunk) < len(ChunkEnvelopeMagic)+1 || !bytes.Equal(chunk[:len(ChunkEnvelopeMagic)],ChunkEnvelopeMagic) {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Chunk isn't a chunk envelope, prepare it with prepareData")
+  }
+  envelope := &ChunkEnvelope{Version: chunk[len(ChunkEnvelopeMagic)]}
+  if envelope.Version != ChunkEnvelopeVersion {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Unsupported chunk envelope version %d, expected %d", envelope.Version, ChunkEnvelopeVersion)
+  }
+  if len(chunk) < chunkEnvelopeHeaderSize {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Chunk smaller than its header")
+  }
+  envelope.Codec = chunk[5]
+  envelope.Index = binary.BigEndian.Uint32(chunk[6:10])
+  envelope.TotalChunks = binary.BigEndian.Uint32(chunk[10:14])
+  envelope.TotalSize = binary.BigEndian.Uint64(chunk[14:22])
+  data := chunk[chunkEnvelopeHeaderSize:]
+
+  if _, err := GetChunkCodec(envelope.Codec); err != nil {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: %s", err)
+  }
+  if envelope.Index >= envelope.TotalChunks {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Inconsistent chunk index, greater than total")
+  }
+
+  if envelope.Index == 0 {
+    manifestSize := uint64(envelope.TotalChunks)*sha256.Size
+    if uint64(len(data)) < manifestSize {
+      return nil, fmt.Errorf("DecodeChunkEnvelope: First chunk smaller than its manifest")
+    }
+    envelope.Manifest = make([][]byte,envelope.TotalChunks)
+    for i := range envelope.Manifest {
+      envelope.Manifest[i] = data[i*sha256.Size:(i+1)*sha256.Size]
+    }
+    data = data[manifestSize:]
+  }
+  if uint64(len(data)) > envelope.TotalSize {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Chunk larger than the total size")
+  }
+  envelope.Data = data
+  return envelope, nil
+}
+
+func DecodeChunkEnvelopeHex(chunkHex string) (*ChunkEnvelope,error) {
+  if !strings.HasPrefix(chunkHex,"0x") {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Chunk must be 0x prefixed hex")
+  }
+  chunk, err := hex.DecodeString(chunkHex[2:])
+  if err != nil {
+    return nil, fmt.Errorf("DecodeChunkEnvelope: Error converting hex to bytes %s",err)
+  }
+  return DecodeChunkEnvelope(chunk)
+}
@@ -0,0 +1,90 @@
+package processor
+
+import (
+  "bytes"
+  "encoding/hex"
+  "testing"
+
+  "dapp/model"
+)
+
+// The fuzz targets check that no input reachable from a rollup input can
+// panic the processor. Run them with, for example:
+//   go test -fuzz FuzzCsvMetrics ./processor
+
+func FuzzCsvMetrics(f *testing.F) {
+  f.Add([]byte("a,b\n1,na\n,2\n"), ",", "", false, false, uint8(1))
+  f.Add([]byte(""), ",", "", false, false, uint8(1))
+  f.Add([]byte("a,b\n"), ",", "", false, false, uint8(3))
+  f.Add([]byte("a,b\n1\n1,2,3\n"), ",", "", false, false, uint8(0))
+  f.Add([]byte("a\tb\n# comment\n\"x\"y\t\xff\n"), "\t", "#", true, true, uint8(1))
+  f.Add([]byte("a;b\n\"unterminated\n"), ";", "", false, false, uint8(1))
+
+  f.Fuzz(func(t *testing.T, data []byte, delimiter string, comment string, lazyQuotes bool, trimLeadingSpace bool, headerRows uint8) {
+    options := DefaultMetricOptions()
+    options.Dialect = model.Dialect{Delimiter: delimiter, Comment: comment, LazyQuotes: lazyQuotes, TrimLeadingSpace: trimLeadingSpace, HeaderRows: uint32(headerRows)}
+    if ValidateDialect(options.Dialect) != nil {
+      // the DApp rejects claims with invalid dialects
+      return
+    }
+
+    value, err := CsvBlankCellPermillionage(bytes.NewReader(data), options)
+    if err == nil && value > 1000000 {
+      t.Errorf("value %d out of range", value)
+    }
+
+    columns, values, err := CsvColumnBlankCellPermillionage(bytes.NewReader(data), options)
+    if err == nil {
+      if len(columns) != len(values) {
+        t.Errorf("%d columns and %d values", len(columns), len(values))
+      }
+      for _, value := range values {
+        if value > 1000000 {
+          t.Errorf("column value %d out of range", value)
+        }
+      }
+    }
+  })
+}
+
+func FuzzComputeCidAndMetric(f *testing.F) {
+  f.Add([]byte("a,b\n1,2\n"))
+  f.Add([]byte("a\nx\"y\n"))
+  f.Add([]byte{})
+
+  f.Fuzz(func(t *testing.T, data []byte) {
+    dataCids, _, _ := ComputeCidAndMetric(bytes.NewReader(data), DataCidPrefix(), DefaultMetric, DefaultMetricOptions())
+    expectedCid, err := GetDataCid(bytes.NewReader(data))
+    if err != nil {
+      t.Fatal(err)
+    }
+    // the CID covers the whole data, even if the metric stops early
+    if !dataCids.Contains(expectedCid) {
+      t.Errorf("CIDs %s, expected %s", dataCids, expectedCid)
+    }
+  })
+}
+
+func FuzzUpdateDataChunks(f *testing.F) {
+  f.Add([]byte{0, 0, 0, 0, 0, 0, 0, 0, 0x1f, 0x8b})
+  f.Add([]byte{0, 0, 0, 1, 0, 0, 0, 0})
+  f.Add([]byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+  f.Add([]byte{0, 0})
+  f.Add([]byte("CSVC\x02"))
+  prepared, _ := PrepareDataToSend([]byte("a,b\n1,2\n"), 1024)
+  preparedChunk, _ := hex.DecodeString(prepared[0][2:])
+  f.Add(preparedChunk)
+
+  f.Fuzz(func(t *testing.T, chunk []byte) {
+    dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+    UpdateDataChunks(dataChunks, hex.EncodeToString(chunk))
+    if UpdateDataChunks(dataChunks, "0x" + hex.EncodeToString(chunk)) != nil {
+      return
+    }
+    reader, err := NewChunksReader(dataChunks)
+    if err != nil {
+      return
+    }
+    ComputeCidAndMetric(reader, DataCidPrefix(), DefaultMetric, DefaultMetricOptions())
+  })
+}
@@ -0,0 +1,95 @@
+package processor
+
+import (
+  "io"
+  "fmt"
+)
+
+// DataLimits caps the claim data the DApp accepts, so a small upload (like a
+// decompression bomb) can't exhaust the machine memory. Exceeding a limit is
+// deterministic and contradicts the claim.
+type DataLimits struct {
+  MaxCompressedSize uint64
+  MaxDecompressedSize uint64
+  MaxChunks uint32
+  MaxChunkSize uint64
+  MaxStoreSize uint64
+}
+
+// Limits are the data limits in use, sized for the 128Mi of ram of the machine
+var Limits = DataLimits{
+  MaxCompressedSize: 16 << 20,
+  MaxDecompressedSize: 32 << 20,
+  MaxChunks: 256,
+  MaxChunkSize: 1 << 20,
+  MaxStoreSize: 32 << 20,
+}
+
+// Names of the data limits
+const (
+  LimitCompressedSize = "compressedSize"
+  LimitDecompressedSize = "decompressedSize"
+  LimitChunks = "chunks"
+  LimitChunkSize = "chunkSize"
+)
+
+// LimitError is the error of data over a limit. Value is omitted when the data
+// is streamed, it is only known to be over the limit.
+type LimitError struct {
+  Limit string  `json:"limit"`
+  Max uint64    `json:"max"`
+  Value uint64  `json:"value,omitempty"`
+}
+
+func (e *LimitError) Error() string {
+  if e.Value == 0 {
+    return fmt.Sprintf("data %s exceeds the limit of %d", e.Limit, e.Max)
+  }
+  return fmt.Sprintf("data %s of %d exceeds the limit of %d", e.Limit, e.Value, e.Max)
+}
+
+// CheckEnvelopeLimits checks the sizes declared by a chunk envelope and the
+// size of its data
+func CheckEnvelopeLimits(envelope *ChunkEnvelope) error {
+  if envelope.TotalChunks > Limits.MaxChunks {
+    return &LimitError{Limit: LimitChunks, Max: uint64(Limits.MaxChunks), Value: uint64(envelope.TotalChunks)}
+  }
+  if envelope.TotalSize > Limits.MaxCompressedSize {
+    return &LimitError{Limit: LimitCompressedSize, Max: Limits.MaxCompressedSize, Value: envelope.TotalSize}
+  }
+  if uint64(len(envelope.Data)) > Limits.MaxChunkSize {
+    return &LimitError{Limit: LimitChunkSize, Max: Limits.MaxChunkSize, Value: uint64(len(envelope.Data))}
+  }
+  return nil
+}
+
+type boundedReader struct {
+  r io.Reader
+  limit string
+  max uint64
+  read uint64
+  err error
+}
+
+// NewBoundedReader reads up to max bytes, reading past them fails with a
+// LimitError of the named limit
+func NewBoundedReader(r io.Reader, limit string, max uint64) io.Reader {
+  return &boundedReader{r: r, limit: limit, max: max}
+}
+
+func (b *boundedReader) Read(p []byte) (int,error) {
+  if b.err != nil {
+    return 0, b.err
+  }
+  // read one byte past the limit to tell data that ends at the limit apart
+  if remaining := b.max - b.read; uint64(len(p)) > remaining {
+    p = p[:remaining+1]
+  }
+  n, err := b.r.Read(p)
+  b.read += uint64(n)
+  if b.read > b.max {
+    b.err = &LimitError{Limit: b.limit, Max: b.max}
+    return n - int(b.read - b.max), b.err
+  }
+  return n, err
+}
@@ -0,0 +1,216 @@
+package processor
+
+import (
+  "fmt"
+  "sort"
+  "io"
+  "bytes"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+
+  "dapp/model"
+)
+
+const DefaultMetric = "blankCellPermillionage"
+const ColumnBlankCellMetric = "blankCellPermillionageByColumn"
+
+// Metric is a data quality assertion that can be claimed and disputed
+type Metric interface {
+  Name() string
+  Description() string
+  MaxValue() uint64
+  Vector() bool
+  Compute(csvReader io.Reader, options MetricOptions) (*MetricResult,error)
+}
+
+// PartialMetric is a metric that can be computed over chunks of data records
+// and merged by adding the partials, as bisection disputes require
+type PartialMetric interface {
+  Metric
+  ComputePartial(scanner *CsvScanner, options MetricOptions) ([]uint64,error)
+  FinalizePartial(columns []string, partial []uint64) (*MetricResult,error)
+}
+
+// MetricOptions are the claim parameters that define how cells are read
+type MetricOptions struct {
+  NullTokens model.NullTokens
+  Dialect model.Dialect
+}
+
+func DefaultMetricOptions() MetricOptions {
+  return MetricOptions{NullTokens: model.DefaultNullTokens(), Dialect: model.DefaultDialect()}
+}
+
+func ClaimMetricOptions(claim *model.Claim) MetricOptions {
+  return MetricOptions{NullTokens: claim.NullTokens, Dialect: claim.Dialect}
+}
+
+// MetricResult holds a scalar value or, for vector metrics, one value per column
+type MetricResult struct {
+  Value uint64
+  Columns []string
+  Values []uint64
+}
+
+func (r *MetricResult) Hash() string {
+  return HashMetricVector(r.Columns,r.Values)
+}
+
+func (r *MetricResult) EqualVector(columns []string, values []uint64) bool {
+  if len(r.Columns) != len(columns) || len(r.Values) != len(values) {
+    return false
+  }
+  for i := range columns {
+    if r.Columns[i] != columns[i] {
+      return false
+    }
+  }
+  for i := range values {
+    if r.Values[i] != values[i] {
+      return false
+    }
+  }
+  return true
+}
+
+// HashMetricVector commits to column names and values: sha256 of each
+// column as uvarint length and bytes followed by each value as big endian uint64
+func HashMetricVector(columns []string, values []uint64) string {
+  var buf bytes.Buffer
+  lenBytes := make([]byte, binary.MaxVarintLen64)
+  for _, column := range columns {
+    n := binary.PutUvarint(lenBytes, uint64(len(column)))
+    buf.Write(lenBytes[:n])
+    buf.WriteString(column)
+  }
+  valueBytes := make([]byte, 8)
+  for _, value := range values {
+    binary.BigEndian.PutUint64(valueBytes, value)
+    buf.Write(valueBytes)
+  }
+  hash := sha256.Sum256(buf.Bytes())
+  return "0x"+hex.EncodeToString(hash[:])
+}
+
+var metrics = make(map[string]Metric)
+
+func RegisterMetric(metric Metric) error {
+  if metric == nil || metric.Name() == "" {
+    return fmt.Errorf("RegisterMetric: invalid metric")
+  }
+  if metrics[metric.Name()] != nil {
+    return fmt.Errorf("RegisterMetric: metric %s already registered", metric.Name())
+  }
+  metrics[metric.Name()] = metric
+  return nil
+}
+
+func GetMetric(name string) (Metric,error) {
+  if name == "" {
+    name = DefaultMetric
+  }
+  metric := metrics[name]
+  if metric == nil {
+    return nil, fmt.Errorf("GetMetric: unknown metric %s", name)
+  }
+  return metric, nil
+}
+
+func ListMetrics() []string {
+  names := make([]string, 0, len(metrics))
+  for name := range metrics {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  return names
+}
+
+func ComputeMetric(name string, csvReader io.Reader, options MetricOptions) (*MetricResult,error) {
+  metric, err := GetMetric(name)
+  if err != nil {
+    return nil, err
+  }
+  return metric.Compute(csvReader,options)
+}
+
+type blankCellPermillionageMetric struct {}
+
+func (m blankCellPermillionageMetric) Name() string {
+  return DefaultMetric
+}
+
+func (m blankCellPermillionageMetric) Description() string {
+  return "Permillionage of non-empty data cells"
+}
+
+func (m blankCellPermillionageMetric) MaxValue() uint64 {
+  return 1000000
+}
+
+func (m blankCellPermillionageMetric) Vector() bool {
+  return false
+}
+
+func (m blankCellPermillionageMetric) Compute(csvReader io.Reader, options MetricOptions) (*MetricResult,error) {
+  value, err := CsvBlankCellPermillionage(csvReader, options)
+  if err != nil {
+    return nil, err
+  }
+  return &MetricResult{Value: value}, nil
+}
+
+func (m blankCellPermillionageMetric) ComputePartial(scanner *CsvScanner, options MetricOptions) ([]uint64,error) {
+  return CsvBlankCellPartial(scanner, options)
+}
+
+func (m blankCellPermillionageMetric) FinalizePartial(columns []string, partial []uint64) (*MetricResult,error) {
+  value, err := BlankCellPermillionage(partial)
+  if err != nil {
+    return nil, err
+  }
+  return &MetricResult{Value: value}, nil
+}
+
+type columnBlankCellPermillionageMetric struct {}
+
+func (m columnBlankCellPermillionageMetric) Name() string {
+  return ColumnBlankCellMetric
+}
+
+func (m columnBlankCellPermillionageMetric) Description() string {
+  return "Permillionage of non-empty data cells for each header column"
+}
+
+func (m columnBlankCellPermillionageMetric) MaxValue() uint64 {
+  return 1000000
+}
+
+func (m columnBlankCellPermillionageMetric) Vector() bool {
+  return true
+}
+
+func (m columnBlankCellPermillionageMetric) Compute(csvReader io.Reader, options MetricOptions) (*MetricResult,error) {
+  columns, values, err := CsvColumnBlankCellPermillionage(csvReader, options)
+  if err != nil {
+    return nil, err
+  }
+  return &MetricResult{Columns: columns, Values: values}, nil
+}
+
+func (m columnBlankCellPermillionageMetric) ComputePartial(scanner *CsvScanner, options MetricOptions) ([]uint64,error) {
+  return CsvColumnBlankCellPartial(scanner, options)
+}
+
+func (m columnBlankCellPermillionageMetric) FinalizePartial(columns []string, partial []uint64) (*MetricResult,error) {
+  values, err := ColumnBlankCellPermillionage(columns, partial)
+  if err != nil {
+    return nil, err
+  }
+  return &MetricResult{Columns: columns, Values: values}, nil
+}
+
+func init() {
+  RegisterMetric(blankCellPermillionageMetric{})
+  RegisterMetric(columnBlankCellPermillionageMetric{})
+}
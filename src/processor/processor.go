@@ -3,196 +3,809 @@ package processor
 import (
   "io"
   "fmt"
+  "errors"
   "strings"
+  "strconv"
+  "unicode/utf8"
 	"bytes"
   "encoding/csv"
-	"encoding/binary"
-	"encoding/hex"
-	"compress/gzip"
+  "hash"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
   cid "github.com/ipfs/go-cid"
   // mc "github.com/multiformats/go-multicodec"
-  // mh "github.com/multiformats/go-multihash"
+  mh "github.com/multiformats/go-multihash"
 
   "dapp/model"
   // "github.com/prototyp3-dev/go-rollups"
 )
 
-func CsvBlankCellPermillionage(csvString string, nilFields ...string) (uint64,error) {
+// NullMatcher reports whether a cell value is blank
+type NullMatcher func(value string) bool
 
-  reader := csv.NewReader(strings.NewReader(csvString))
+// NewNullMatcher builds a matcher where empty cells and the configured null
+// tokens are blank, applying the same trimming and case rules to both sides
+func NewNullMatcher(nullTokens model.NullTokens) NullMatcher {
+  normalize := func(value string) string {
+    if nullTokens.TrimSpace {
+      value = strings.TrimSpace(value)
+    }
+    // invalid UTF-8 is compared byte by byte
+    if !nullTokens.CaseSensitive && utf8.ValidString(value) {
+      value = strings.ToLower(value)
+    }
+    return value
+  }
+
+  tokens := make(map[string]bool)
+  for _, token := range nullTokens.Tokens {
+    tokens[normalize(token)] = true
+  }
+
+  return func(value string) bool {
+    value = normalize(value)
+    return value == "" || tokens[value]
+  }
+}
+
+// NewCsvReader builds a csv reader configured by the claim dialect
+func NewCsvReader(r io.Reader, dialect model.Dialect) *csv.Reader {
+  reader := csv.NewReader(r)
+  if dialect.Delimiter != "" {
+    reader.Comma, _ = utf8.DecodeRuneInString(dialect.Delimiter)
+  }
+  if dialect.Comment != "" {
+    reader.Comment, _ = utf8.DecodeRuneInString(dialect.Comment)
+  }
+  reader.LazyQuotes = dialect.LazyQuotes
+  reader.TrimLeadingSpace = dialect.TrimLeadingSpace
+  // metrics only look at a record while it is read
+  reader.ReuseRecord = true
+  return reader
+}
+
+func ValidateDialect(dialect model.Dialect) error {
+  delimiter, _ := utf8.DecodeRuneInString(dialect.Delimiter)
+  if utf8.RuneCountInString(dialect.Delimiter) != 1 || !validCsvRune(delimiter) {
+    return fmt.Errorf("ValidateDialect: invalid delimiter %q", dialect.Delimiter)
+  }
+  if dialect.Comment != "" {
+    comment, _ := utf8.DecodeRuneInString(dialect.Comment)
+    if utf8.RuneCountInString(dialect.Comment) != 1 || !validCsvRune(comment) || comment == delimiter {
+      return fmt.Errorf("ValidateDialect: invalid comment %q", dialect.Comment)
+    }
+  }
+  return nil
+}
+
+func validCsvRune(r rune) bool {
+  return r != 0 && r != '"' && r != '\r' && r != '\n' && utf8.ValidRune(r) && r != utf8.RuneError
+}
+
+// MaxCsvRecordSize bounds the bytes read for a single record, so huge fields
+// can't exhaust the machine memory
+var MaxCsvRecordSize int64 = 1 << 20
+
+var ErrCsvRecordTooLarge = errors.New("record too large")
+
+// CsvDataError marks data that can't be read with the claim dialect. Such data
+// has no metric value, so it contradicts any claim on it.
+type CsvDataError struct {
+  Record uint64
+  Err error
+}
+
+func (e *CsvDataError) Error() string {
+  return fmt.Sprintf("invalid csv data at record %d: %s", e.Record, e.Err)
+}
+
+func (e *CsvDataError) Unwrap() error {
+  return e.Err
+}
+
+// recordLimitReader fails once more than limit bytes are read past the start
+// of the current record. csv buffers ahead, so the bound is approximate but
+// deterministic.
+type recordLimitReader struct {
+  r io.Reader
+  read int64
+  recordStart int64
+  limit int64
+}
+
+func (l *recordLimitReader) Read(p []byte) (int,error) {
+  if l.read - l.recordStart > l.limit {
+    return 0, ErrCsvRecordTooLarge
+  }
+  n, err := l.r.Read(p)
+  l.read += int64(n)
+  return n, err
+}
+
+// CsvScanner reads the data records of a csv with the claim dialect and
+// defines the outcome of degenerate inputs:
+//   - empty data, or data with only header or comment lines, has no records
+//   - every record is normalized to the width of the last header row (or of
+//     the first record without header rows): missing cells are blank and
+//     extra cells are ignored
+//   - invalid UTF-8 is read as is, cells are opaque bytes
+//   - parse errors, such as bare quotes without lazyQuotes, and records
+//     larger than MaxCsvRecordSize are a CsvDataError
+type CsvScanner struct {
+  Header []string
+  Width int
+  reader *csv.Reader
+  limitReader *recordLimitReader
+  records uint64
+  rows uint64
+  record []string
+}
+
+func NewCsvScanner(r io.Reader, dialect model.Dialect) (*CsvScanner,error) {
+  limitReader := &recordLimitReader{r:r,limit:MaxCsvRecordSize}
+  scanner := &CsvScanner{reader:NewCsvReader(limitReader,dialect),limitReader:limitReader,Width:-1}
+  // width is checked by the scanner
+  scanner.reader.FieldsPerRecord = -1
+
+  for i := uint32(0); i < dialect.HeaderRows; i += 1 {
+    record, err := scanner.read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil,err
+    }
+    scanner.Header = append([]string(nil), record...)
+    scanner.Width = len(record)
+  }
+  return scanner,nil
+}
+
+func (s *CsvScanner) read() ([]string,error) {
+  s.records += 1
+  record, err := s.reader.Read()
+  if err == io.EOF {
+    return nil,err
+  }
+  if err != nil {
+    var parseErr *csv.ParseError
+    if errors.As(err,&parseErr) {
+      err = parseErr.Err
+    }
+    return nil,&CsvDataError{Record:s.records,Err:err}
+  }
+  s.limitReader.recordStart = s.reader.InputOffset()
+  return record,nil
+}
+
+// Next returns the next data record normalized to the scanner width, or
+// io.EOF. The record is only valid until the next call.
+func (s *CsvScanner) Next() ([]string,error) {
+  record, err := s.read()
+  if err != nil {
+    return nil,err
+  }
+  s.rows += 1
+  if s.Width < 0 {
+    s.Width = len(record)
+  }
+  if len(record) == s.Width {
+    return record,nil
+  }
+  if len(record) > s.Width {
+    return record[:s.Width],nil
+  }
+  s.record = append(s.record[:0], record...)
+  for len(s.record) < s.Width {
+    s.record = append(s.record, "")
+  }
+  return s.record,nil
+}
+
+// Columns names the columns by the last header row, or by position when there
+// are no header rows
+func (s *CsvScanner) Columns() []string {
+  if s.Header != nil {
+    return s.Header
+  }
+  columns := make([]string,0)
+  for i := 0; i < s.Width; i += 1 {
+    columns = append(columns,strconv.Itoa(i+1))
+  }
+  return columns
+}
 
-  nilFieldsMap := make(map[string]bool)
-  for _, nilField := range nilFields {
-    nilFieldsMap[strings.ToLower(nilField)] = true
+// NewCsvChunkScanner reads the data records of a chunk of csv data that starts
+// at a record boundary after the header, with the width of the whole data
+func NewCsvChunkScanner(r io.Reader, dialect model.Dialect, width int) (*CsvScanner,error) {
+  dialect.HeaderRows = 0
+  scanner, err := NewCsvScanner(r,dialect)
+  if err != nil {
+    return nil,err
   }
+  scanner.Width = width
+  return scanner,nil
+}
+
+// CsvBlankCellPartial counts the cells and the blank cells of the remaining
+// records of the scanner, as the mergeable partial [total, blank]
+func CsvBlankCellPartial(scanner *CsvScanner, options MetricOptions) ([]uint64,error) {
+
+  isNull := NewNullMatcher(options.NullTokens)
 
   var totalCells uint64
   var emptyCells uint64
 
-  firstRow := true
   for {
-    record, err := reader.Read()
+    record, err := scanner.Next()
     if err == io.EOF {
       break
     }
     if err != nil {
-      return 0,err
-    }
-    if firstRow {
-      firstRow = false
-      continue
+      return nil,err
     }
 
     for _, value := range record {
       totalCells += 1
-      if value == "" || nilFieldsMap[strings.ToLower(value)] {
+      if isNull(value) {
         emptyCells += 1
       }
     }
   }
-  nDataCells := totalCells-emptyCells
-  value := 1000000*nDataCells/totalCells
 
-  return value,nil
+  return []uint64{totalCells,emptyCells},nil
+}
+
+// BlankCellPermillionage finalizes a [total, blank] partial, data without
+// cells has value 0
+func BlankCellPermillionage(partial []uint64) (uint64,error) {
+  if len(partial) != 2 || partial[1] > partial[0] {
+    return 0,fmt.Errorf("BlankCellPermillionage: invalid partial %v",partial)
+  }
+  totalCells := partial[0]
+  if totalCells == 0 {
+    return 0,nil
+  }
+  nDataCells := totalCells-partial[1]
+  return permillionage(nDataCells,totalCells),nil
+}
+
+// permillionage is 1000000*part/total without overflowing for large totals
+func permillionage(part uint64, total uint64) uint64 {
+  return part/total*1000000 + (part%total)*1000000/total
 }
 
-func GetDataCid(data string) (cid.Cid,error) {
-  pref := cid.Prefix{
+// CsvBlankCellPermillionage is the permillionage of non-blank data cells, data
+// without cells has value 0
+func CsvBlankCellPermillionage(csvReader io.Reader, options MetricOptions) (uint64,error) {
+
+  scanner, err := NewCsvScanner(csvReader,options.Dialect)
+  if err != nil {
+    return 0,err
+  }
+
+  partial, err := CsvBlankCellPartial(scanner,options)
+  if err != nil {
+    return 0,err
+  }
+
+  return BlankCellPermillionage(partial)
+}
+
+// CsvColumnBlankCellPartial counts the rows and the blank cells of each column
+// of the remaining records of the scanner, as the mergeable partial
+// [rows, blank of column 1, ..., blank of column n]
+func CsvColumnBlankCellPartial(scanner *CsvScanner, options MetricOptions) ([]uint64,error) {
+
+  isNull := NewNullMatcher(options.NullTokens)
+
+  var partial []uint64
+
+  for {
+    record, err := scanner.Next()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil,err
+    }
+
+    if partial == nil {
+      partial = make([]uint64,len(record)+1)
+    }
+    partial[0] += 1
+    for i, value := range record {
+      if isNull(value) {
+        partial[i+1] += 1
+      }
+    }
+  }
+
+  if partial == nil {
+    width := scanner.Width
+    if width < 0 {
+      width = 0
+    }
+    partial = make([]uint64,width+1)
+  }
+
+  return partial,nil
+}
+
+// ColumnBlankCellPermillionage finalizes a [rows, blank...] partial, columns
+// without data cells have value 0
+func ColumnBlankCellPermillionage(columns []string, partial []uint64) ([]uint64,error) {
+  if len(partial) != len(columns)+1 {
+    return nil,fmt.Errorf("ColumnBlankCellPermillionage: partial of %d values for %d columns",len(partial),len(columns))
+  }
+  totalRows := partial[0]
+  values := make([]uint64,len(columns))
+  if totalRows == 0 {
+    return values,nil
+  }
+  for i := range columns {
+    if partial[i+1] > totalRows {
+      return nil,fmt.Errorf("ColumnBlankCellPermillionage: invalid partial %v",partial)
+    }
+    values[i] = permillionage(totalRows-partial[i+1],totalRows)
+  }
+  return values,nil
+}
+
+// CsvColumnBlankCellPermillionage is the permillionage of non-blank data cells
+// of each column, columns without data cells have value 0
+func CsvColumnBlankCellPermillionage(csvReader io.Reader, options MetricOptions) ([]string,[]uint64,error) {
+
+  scanner, err := NewCsvScanner(csvReader,options.Dialect)
+  if err != nil {
+    return nil,nil,err
+  }
+
+  partial, err := CsvColumnBlankCellPartial(scanner,options)
+  if err != nil {
+    return nil,nil,err
+  }
+
+  columns := scanner.Columns()
+  values, err := ColumnBlankCellPermillionage(columns,partial)
+  if err != nil {
+    return nil,nil,err
+  }
+
+  return columns,values,nil
+}
+
+func DataCidPrefix() cid.Prefix {
+  return cid.Prefix{
     Version: 1,
-    Codec: uint64(85), // uint64(mc.Raw),
-    MhType: 0x12, // mh.SHA2_256,
+    Codec: cid.Raw,
+    MhType: mh.SHA2_256,
     MhLength: -1, // default length
   }
-  
-  dataCid, err := pref.Sum([]byte(data))
+}
+
+// SupportedCidCodecs are the codecs the data CID can be computed with: a
+// single raw block, or a UnixFS dag-pb DAG as produced by `ipfs add`
+var SupportedCidCodecs = map[uint64]bool{cid.Raw: true, cid.DagProtobuf: true}
+
+// SupportedMultihashes are the hash functions the data CID can use. Keccak-256
+// lets contracts recompute raw data CIDs cheaply.
+var SupportedMultihashes = map[uint64]bool{
+  mh.SHA2_256: true,
+  mh.SHA3_256: true,
+  mh.KECCAK_256: true,
+  mh.BLAKE3: true,
+}
+
+// MultihashFromName gets a supported hash function by its multihash name,
+// such as "sha2-256", "sha3-256", "keccak-256" or "blake3"
+func MultihashFromName(name string) (uint64,error) {
+  code, ok := mh.Names[name]
+  if !ok || !SupportedMultihashes[code] {
+    return 0, fmt.Errorf("MultihashFromName: unsupported hash function %s", name)
+  }
+  return code, nil
+}
+
+// DecodeClaimCid decodes a claimed CID in any multibase, rejecting CIDs the
+// data CID can't be computed with
+func DecodeClaimCid(marshaledString string) (cid.Cid,error) {
+  cidFromString, err := cid.Decode(marshaledString)
   if err != nil {
-    return cid.Cid{}, fmt.Errorf("GetDataCid: error getting CID: %s", err)
+    return cid.Cid{}, fmt.Errorf("DecodeClaimCid: error getting CID: %s", err)
   }
+  pref := cidFromString.Prefix()
+  if !SupportedCidCodecs[pref.Codec] {
+    return cid.Cid{}, fmt.Errorf("DecodeClaimCid: unsupported codec 0x%x", pref.Codec)
+  }
+  decoded, err := mh.Decode(cidFromString.Hash())
+  if err != nil {
+    return cid.Cid{}, fmt.Errorf("DecodeClaimCid: error decoding multihash: %s", err)
+  }
+  if !SupportedMultihashes[decoded.Code] {
+    return cid.Cid{}, fmt.Errorf("DecodeClaimCid: unsupported hash function 0x%x", decoded.Code)
+  }
+  if decoded.Length != mh.DefaultLengths[decoded.Code] {
+    return cid.Cid{}, fmt.Errorf("DecodeClaimCid: unsupported digest length %d", decoded.Length)
+  }
+  return cidFromString, nil
+}
 
-  return dataCid,nil
+// CanonicalCid is the canonical form of a claimed CID: CIDv1 in base32. CIDv0
+// is converted to the equivalent dag-pb CIDv1, so every encoding of the same
+// CID names the same claim.
+func CanonicalCid(marshaledString string) (string,error) {
+  cidFromString, err := DecodeClaimCid(marshaledString)
+  if err != nil {
+    return "", err
+  }
+  if cidFromString.Version() == 0 {
+    cidFromString = cid.NewCidV1(cid.DagProtobuf, cidFromString.Hash())
+  }
+  return cidFromString.String(), nil
 }
 
-func CompareCidWithString(dataCid cid.Cid, marshaledString string) (bool,error) {
-  cidFromString, err := cid.Decode(marshaledString)
+// Claims are keyed by their canonical CID and metric, and by a digest of their
+// metric options when they aren't the defaults, "<cid>/<metric>[/<digest>]",
+// so claims of other metrics or options on the same data coexist.
+
+// NewClaimKey is the key of a claim on the canonical CID
+func NewClaimKey(canonicalCid string, metricName string, options MetricOptions) string {
+  claimKey := canonicalCid+"/"+metricName
+  optionsJson, _ := json.Marshal(options)
+  defaultJson, _ := json.Marshal(DefaultMetricOptions())
+  if !bytes.Equal(optionsJson,defaultJson) {
+    digest := sha256.Sum256(optionsJson)
+    claimKey += "/"+hex.EncodeToString(digest[:8])
+  }
+  return claimKey
+}
+
+// CanonicalClaimKey resolves any encoding of the CID of a claim key. A bare
+// CID is the key of the claim of the default metric and options.
+func CanonicalClaimKey(claimKey string) (string,error) {
+  claimCid, rest, found := strings.Cut(claimKey,"/")
+  canonicalId, err := CanonicalCid(claimCid)
   if err != nil {
-    return false, fmt.Errorf("CompareCidWithString: error getting CID: %s", err)
+    return "", err
   }
-  if cidFromString.Equals(dataCid) {
-    return true, nil
+  if !found {
+    return NewClaimKey(canonicalId,DefaultMetric,DefaultMetricOptions()), nil
   }
-  return false, nil
+  return canonicalId+"/"+rest, nil
 }
 
-func CompressData(data []byte) ([]byte,error) {
-  var buf bytes.Buffer
-  zw := gzip.NewWriter(&buf)
+// ClaimKeyCid is the CID of a claim key
+func ClaimKeyCid(claimKey string) string {
+  claimCid, _, _ := strings.Cut(claimKey,"/")
+  return claimCid
+}
 
-  _, err := zw.Write(data)
+// CidPrefixFromString gets the prefix of a claimed CID, which defines how the
+// data CID is computed
+func CidPrefixFromString(marshaledString string) (cid.Prefix,error) {
+  cidFromString, err := DecodeClaimCid(marshaledString)
   if err != nil {
-    return buf.Bytes(), fmt.Errorf("CompressData: error compressing data: %s", err)
+    return cid.Prefix{}, err
   }
-  if err := zw.Close(); err != nil {
-    return buf.Bytes(), fmt.Errorf("CompressData: error closing writer: %s", err)
+  return cidFromString.Prefix(), nil
+}
+
+// CidWriter hashes the data written to it, so the CID can be computed while
+// the same data is streamed to other consumers
+type CidWriter struct {
+  prefix cid.Prefix
+  hasher hash.Hash
+  unixFs []*unixFsWriter
+}
+
+func NewCidWriter(pref cid.Prefix) (*CidWriter,error) {
+  if pref.Codec == cid.DagProtobuf {
+    return &CidWriter{prefix:pref,unixFs:newUnixFsWriters(pref)}, nil
   }
-  return buf.Bytes(), nil
+  hasher, err := mh.GetHasher(pref.MhType)
+  if err != nil {
+    return nil, fmt.Errorf("NewCidWriter: error getting hasher: %s", err)
+  }
+  return &CidWriter{prefix:pref,hasher:hasher}, nil
 }
 
-func DecompressData(data []byte) ([]byte,error) {
-  buf := bytes.NewBuffer(data)
-  var bufOut bytes.Buffer
+func (w *CidWriter) Write(p []byte) (int,error) {
+  if w.unixFs != nil {
+    for _, unixFs := range w.unixFs {
+      if _, err := unixFs.Write(p); err != nil {
+        return 0, err
+      }
+    }
+    return len(p), nil
+  }
+  return w.hasher.Write(p)
+}
+
+// Sum is the data CID in the default form of the prefix
+func (w *CidWriter) Sum() (cid.Cid,error) {
+  dataCids, err := w.Sums()
+  if err != nil {
+    return cid.Cid{}, err
+  }
+  return dataCids[0], nil
+}
+
+// Sums are all the CIDs the data may be claimed with for the prefix, as
+// UnixFS DAGs may be built with different leaves
+func (w *CidWriter) Sums() (DataCids,error) {
+  if w.unixFs != nil {
+    dataCids := make(DataCids,len(w.unixFs))
+    for i, unixFs := range w.unixFs {
+      dataCid, err := unixFs.Sum()
+      if err != nil {
+        return nil, err
+      }
+      dataCids[i] = dataCid
+    }
+    return dataCids, nil
+  }
+  mhash, err := mh.Encode(w.hasher.Sum(nil), w.prefix.MhType)
+  if err != nil {
+    return nil, fmt.Errorf("CidWriter: error encoding multihash: %s", err)
+  }
+  return DataCids{cid.NewCidV1(w.prefix.Codec, mhash)}, nil
+}
+
+// DataCids are the CIDs that identify the same data
+type DataCids []cid.Cid
+
+// Contains compares codec and multihash, so CIDv0 and CIDv1 of the same DAG match
+func (c DataCids) Contains(other cid.Cid) bool {
+  for _, dataCid := range c {
+    if dataCid.Prefix().Codec == other.Prefix().Codec && bytes.Equal(dataCid.Hash(), other.Hash()) {
+      return true
+    }
+  }
+  return false
+}
+
+func GetDataCid(data io.Reader) (cid.Cid,error) {
+  return GetDataCidWithPrefix(data, DataCidPrefix())
+}
+
+func GetUnixFsCid(data io.Reader, version uint64) (cid.Cid,error) {
+  return GetDataCidWithPrefix(data, UnixFsCidPrefix(version))
+}
+
+func GetDataCidWithPrefix(data io.Reader, pref cid.Prefix) (cid.Cid,error) {
+  cidWriter, err := NewCidWriter(pref)
+  if err != nil {
+    return cid.Cid{}, fmt.Errorf("GetDataCid: error getting CID: %s", err)
+  }
+  if _, err := io.Copy(cidWriter, data); err != nil {
+    return cid.Cid{}, fmt.Errorf("GetDataCid: error reading data: %s", err)
+  }
+  dataCid, err := cidWriter.Sum()
+  if err != nil {
+    return cid.Cid{}, fmt.Errorf("GetDataCid: error getting CID: %s", err)
+  }
 
-  zr, err := gzip.NewReader(buf)
+  return dataCid,nil
+}
+
+// ComputeCidAndMetric reads the data in a single pass, hashing it with the
+// CID prefix while the metric is computed. The CIDs are returned even if the
+// metric fails, as long as the data could be read, so callers can tell both
+// failures apart.
+func ComputeCidAndMetric(data io.Reader, pref cid.Prefix, metricName string, options MetricOptions) (DataCids,*MetricResult,error) {
+  metric, err := GetMetric(metricName)
+  if err != nil {
+    return nil, nil, err
+  }
+  cidWriter, err := NewCidWriter(pref)
   if err != nil {
-    return bufOut.Bytes(), fmt.Errorf("DecompressData: error decompressing data: %s", err)
+    return nil, nil, err
   }
 
-  if _, err := io.Copy(&bufOut, zr); err != nil {
-    return bufOut.Bytes(), fmt.Errorf("DecompressData: error copying data to out bufer: %s", err)
+  result, metricErr := metric.Compute(io.TeeReader(data, cidWriter), options)
+
+  // hash whatever the metric left unread
+  if _, err := io.Copy(cidWriter, data); err != nil {
+    return nil, nil, fmt.Errorf("ComputeCidAndMetric: error reading data: %w", err)
+  }
+  dataCids, err := cidWriter.Sums()
+  if err != nil {
+    return nil, nil, err
   }
-  if err := zr.Close(); err != nil {
-    return bufOut.Bytes(), fmt.Errorf("DecompressData: error closing reader: %s", err)
+  if metricErr != nil {
+    return dataCids, nil, fmt.Errorf("ComputeCidAndMetric: error computing %s: %w", metric.Name(), metricErr)
   }
-  return bufOut.Bytes(),nil
+  return dataCids, result, nil
 }
 
+// CompareCidWithString accepts raw and UnixFS CIDs in any multibase and CID
+// version, as long as the data CIDs were computed with the prefix of the
+// marshaled CID
+func CompareCidWithString(dataCids DataCids, marshaledString string) (bool,error) {
+  cidFromString, err := cid.Decode(marshaledString)
+  if err != nil {
+    return false, fmt.Errorf("CompareCidWithString: error getting CID: %s", err)
+  }
+  return dataCids.Contains(cidFromString), nil
+}
+
+func CompressData(data []byte) ([]byte,error) {
+  return CompressDataWithCodec(data,ChunkCodecGzip,DefaultCompressionLevel)
+}
+
+func DecompressData(data []byte) ([]byte,error) {
+  return DecompressDataWithCodec(data,ChunkCodecGzip)
+}
+
+// PrepareDataToSend gzips the data and splits it in chunk envelopes of up to
+// maxSize compressed bytes
 func PrepareDataToSend(data []byte, maxSize uint64) ([]string,error) {
+  return PrepareDataToSendWithCodec(data,maxSize,"gzip",DefaultCompressionLevel)
+}
+
+// PrepareDataToSendWithCodec compresses the data with the named codec (or the
+// one giving the smallest payload for ChunkCodecAuto) and splits it in chunk
+// envelopes of up to maxSize compressed bytes, the first one carrying the
+// manifest so the DApp verifies each chunk as it arrives
+func PrepareDataToSendWithCodec(data []byte, maxSize uint64, codecName string, level int) ([]string,error) {
   preparedData := []string{}
 	if len(data) < 1 {
 		return preparedData,fmt.Errorf("PrepareData: Invalid empty data")
 	}
-  compressed,err := CompressData(data)
+  if maxSize < 1 {
+		return preparedData,fmt.Errorf("PrepareData: Invalid chunk size")
+  }
+  var compressed []byte
+  var codecId uint8
+  var err error
+  if codecName == ChunkCodecAuto {
+    compressed,codecId,err = compressSmallest(data,level)
+  } else {
+    var codec *ChunkCodec
+    codec,err = ChunkCodecFromName(codecName)
+    if err != nil {
+      return preparedData,fmt.Errorf("PrepareData: %s", err)
+    }
+    codecId = codec.Id
+    compressed,err = CompressDataWithCodec(data,codecId,level)
+  }
 	if err != nil {
 		return preparedData,fmt.Errorf("PrepareData: error compressing data: %s", err)
 	}
   sizeData := uint64(len(compressed))
-  totalChunks := uint32(sizeData/maxSize)
-  if sizeData % maxSize == 0 {
-    totalChunks -= 1
+  totalChunks := (sizeData + maxSize - 1) / maxSize
+  if totalChunks > uint64(^uint32(0)) {
+		return preparedData,fmt.Errorf("PrepareData: Too many chunks")
   }
 
-  totalChunksBytes := make([]byte, 4)
-  binary.BigEndian.PutUint32(totalChunksBytes, totalChunks)
-
-  for chunkIndex := uint32(0); chunkIndex <= totalChunks; chunkIndex += 1 {
-    chunksIndexBytes := make([]byte, 4)
-    binary.BigEndian.PutUint32(chunksIndexBytes, chunkIndex)
-    metadata := append(chunksIndexBytes, totalChunksBytes...)
+  envelopes := make([]*ChunkEnvelope,totalChunks)
+  manifest := make([][]byte,totalChunks)
+  for chunkIndex := range envelopes {
     top := uint64(chunkIndex+1)*(maxSize)
     if top > sizeData {
       top = sizeData
     }
-    allData := append(metadata,compressed[uint64(chunkIndex)*maxSize:top]...)
+    chunkData := compressed[uint64(chunkIndex)*maxSize:top]
+    chunkHash := sha256.Sum256(chunkData)
+    manifest[chunkIndex] = chunkHash[:]
+    envelopes[chunkIndex] = &ChunkEnvelope{
+      Version: ChunkEnvelopeVersion,
+      Codec: codecId,
+      Index: uint32(chunkIndex),
+      TotalChunks: uint32(totalChunks),
+      TotalSize: sizeData,
+      Data: chunkData,
+    }
+  }
+  envelopes[0].Manifest = manifest
 
-    hx := hex.EncodeToString(allData)
-    allDataHex := "0x"+string(hx)
-    preparedData = append(preparedData, allDataHex)
+  for _, envelope := range envelopes {
+    preparedData = append(preparedData, envelope.EncodeHex())
   }
 
   return preparedData,nil
 }
 
+// UpdateDataChunks adds an uploaded chunk envelope. The first chunk sets the
+// manifest and must come first, the other chunks must match their manifest
+// hash and the first chunk header. Resending a chunk already received is a
+// no-op, and a first chunk with a different manifest restarts the upload.
 func UpdateDataChunks(dataChunks *model.DataChunks, chunkHex string) error {
-  chunk, err := hex.DecodeString(chunkHex[2:])
+  envelope, err := DecodeChunkEnvelopeHex(chunkHex)
   if err != nil {
-    return fmt.Errorf("UpdateDataChunks: Error converting hex to bytes %s",err)
+    return fmt.Errorf("UpdateDataChunks: %s",err)
   }
-  chunkIndex := binary.BigEndian.Uint32(chunk[0:4])
-  totalChunks := binary.BigEndian.Uint32(chunk[4:8]) + 1
-  data := chunk[8:]
-
-  if chunkIndex > totalChunks {
-    return fmt.Errorf("UpdateDataChunks: Inconsistent chunk index, greater than total")
+  if err := CheckEnvelopeLimits(envelope); err != nil {
+    return fmt.Errorf("UpdateDataChunks: %w",err)
   }
+  chunkIndex := envelope.Index
 
-  if dataChunks.TotalChunks == 0 {
-    dataChunks.ChunksData = make(map[uint32]*model.Chunk)
-    dataChunks.TotalChunks = totalChunks
+  manifest := dataChunks.Manifest
+  newManifest := false
+  if chunkIndex == 0 {
+    if !bytes.Equal(bytes.Join(envelope.Manifest,nil),bytes.Join(manifest,nil)) || envelope.Codec != dataChunks.Codec || envelope.TotalSize != dataChunks.TotalSize {
+      newManifest = true
+      manifest = envelope.Manifest
+    }
   } else {
-    if totalChunks != dataChunks.TotalChunks {
-      return fmt.Errorf("UpdateDataChunks: Can't append chunk, Inconsistent number of chunks")
+    if manifest == nil {
+      return fmt.Errorf("UpdateDataChunks: The first chunk, with the manifest, must be sent first")
+    }
+    if envelope.TotalChunks != dataChunks.TotalChunks || envelope.Codec != dataChunks.Codec || envelope.TotalSize != dataChunks.TotalSize {
+      return fmt.Errorf("UpdateDataChunks: Can't append chunk, header inconsistent with the first chunk")
     }
   }
-  dataChunks.ChunksData[chunkIndex] = &model.Chunk{Data:data}
+
+  chunkHash := sha256.Sum256(envelope.Data)
+  if !bytes.Equal(chunkHash[:],manifest[chunkIndex]) {
+    return fmt.Errorf("UpdateDataChunks: Chunk %d doesn't match its manifest hash",chunkIndex)
+  }
+  if newManifest {
+    // a new manifest restarts the upload
+    if dataChunks.Stream != nil {
+      dataChunks.Stream.Abort()
+      dataChunks.Stream = nil
+    }
+    dataChunks.NextChunk = 0
+    dataChunks.StreamedSize = 0
+    dataChunks.ChunksData = make(map[uint32]*model.Chunk)
+    dataChunks.TotalChunks = envelope.TotalChunks
+    dataChunks.Codec = envelope.Codec
+    dataChunks.TotalSize = envelope.TotalSize
+    dataChunks.Manifest = manifest
+  }
+  if chunkIndex >= dataChunks.NextChunk && dataChunks.ChunksData[chunkIndex] == nil {
+    dataChunks.ChunksData[chunkIndex] = &model.Chunk{Data:envelope.Data}
+  }
   return nil
 }
 
-func ComposeDataFromChunks(dataChunks *model.DataChunks) ([]byte,error) {
-  var data []byte
+// NewChunksReader streams the decompressed data of the ordered chunks,
+// without composing the compressed or decompressed data in memory. Reading
+// past the decompressed size limit fails with a LimitError.
+func NewChunksReader(dataChunks *model.DataChunks) (io.Reader,error) {
   if uint32(len(dataChunks.ChunksData)) != dataChunks.TotalChunks {
-    return data,fmt.Errorf("ComposeDataFromChunks: Wrong number of chunks")
+    return nil,fmt.Errorf("NewChunksReader: Wrong number of chunks")
   }
-  orderedChunks := make([][]byte,dataChunks.TotalChunks)
+  orderedChunks := make([]io.Reader,dataChunks.TotalChunks)
+  var size uint64
   for i, chunk := range dataChunks.ChunksData {
-    orderedChunks[i] = chunk.Data
+    if i >= dataChunks.TotalChunks {
+      return nil,fmt.Errorf("NewChunksReader: Inconsistent chunk index %d", i)
+    }
+    orderedChunks[i] = bytes.NewReader(chunk.Data)
+    size += uint64(len(chunk.Data))
   }
-  var compressed []byte
-  for _, chunkData := range orderedChunks {
-    compressed = append(compressed, chunkData...)
+  if size != dataChunks.TotalSize {
+    return nil,fmt.Errorf("NewChunksReader: Chunks have %d bytes, expected %d", size, dataChunks.TotalSize)
+  }
+  if size > Limits.MaxCompressedSize {
+    return nil,fmt.Errorf("NewChunksReader: %w", &LimitError{Limit: LimitCompressedSize, Max: Limits.MaxCompressedSize, Value: size})
+  }
+  codec, err := GetChunkCodec(dataChunks.Codec)
+  if err != nil {
+    return nil,fmt.Errorf("NewChunksReader: %s", err)
+  }
+
+  zr, err := codec.NewReader(io.MultiReader(orderedChunks...))
+  if err != nil {
+    return nil,fmt.Errorf("NewChunksReader: error decompressing data: %s", err)
+  }
+  return NewBoundedReader(zr,LimitDecompressedSize,Limits.MaxDecompressedSize),nil
+}
+
+func ComposeDataFromChunks(dataChunks *model.DataChunks) ([]byte,error) {
+  var data []byte
+  reader, err := NewChunksReader(dataChunks)
+  if err != nil {
+    return data,fmt.Errorf("ComposeDataFromChunks: %w",err)
   }
 
-  decompressed,err := DecompressData(compressed)
+  decompressed,err := io.ReadAll(reader)
 	if err != nil {
-		return data,fmt.Errorf("ComposeDataFromChunks: Error decompressing data %s",err)
+		return data,fmt.Errorf("ComposeDataFromChunks: Error decompressing data %w",err)
 	}
   return decompressed,nil
 }
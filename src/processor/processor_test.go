@@ -0,0 +1,1108 @@
+package processor
+
+import (
+  "bytes"
+  "encoding/csv"
+  "errors"
+  "fmt"
+  "io"
+  "strings"
+  "testing"
+  "time"
+
+  "dapp/model"
+  cid "github.com/ipfs/go-cid"
+  mh "github.com/multiformats/go-multihash"
+)
+
+type rowCountMetric struct{}
+
+func (m rowCountMetric) Name() string {
+  return "testRowCount"
+}
+
+func (m rowCountMetric) Description() string {
+  return "Number of lines"
+}
+
+func (m rowCountMetric) MaxValue() uint64 {
+  return 1000
+}
+
+func (m rowCountMetric) Vector() bool {
+  return false
+}
+
+func (m rowCountMetric) Compute(csvReader io.Reader, options MetricOptions) (*MetricResult,error) {
+  data, err := io.ReadAll(csvReader)
+  if err != nil {
+    return nil, err
+  }
+  return &MetricResult{Value: uint64(bytes.Count(data, []byte("\n")))}, nil
+}
+
+func init() {
+  RegisterMetric(rowCountMetric{})
+}
+
+func TestMetricRegistry(t *testing.T) {
+  if err := RegisterMetric(rowCountMetric{}); err == nil {
+    t.Errorf("registered the same metric twice")
+  }
+  if err := RegisterMetric(nil); err == nil {
+    t.Errorf("registered a nil metric")
+  }
+
+  data := "id,name,score\n1,,na\n2,bob,7\n3,carol,\n"
+  tests := []struct {
+    name string
+    metric string
+    value uint64
+    err bool
+  }{
+    {name: "default", metric: "", value: 666666},
+    {name: "blank cells", metric: DefaultMetric, value: 666666},
+    {name: "registered", metric: "testRowCount", value: 4},
+    {name: "unknown", metric: "rowCount", err: true},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      result, err := ComputeMetric(test.metric, strings.NewReader(data), DefaultMetricOptions())
+      if test.err {
+        if err == nil {
+          t.Errorf("expected error, got %+v", result)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if result.Value != test.value {
+        t.Errorf("value %d, expected %d", result.Value, test.value)
+      }
+    })
+  }
+
+  names := ListMetrics()
+  if len(names) != 3 || names[0] != DefaultMetric || names[1] != ColumnBlankCellMetric || names[2] != "testRowCount" {
+    t.Errorf("listed metrics %v", names)
+  }
+}
+
+func TestColumnBlankCellMetric(t *testing.T) {
+  tests := []struct {
+    name string
+    data string
+    columns []string
+    values []uint64
+    err bool
+  }{
+    {name: "columns", data: "id,name,score\n1,,na\n2,bob,7\n3,carol,\n", columns: []string{"id", "name", "score"}, values: []uint64{1000000, 666666, 333333}},
+    {name: "null token case", data: "a,b\nNA,1\n", columns: []string{"a", "b"}, values: []uint64{0, 1000000}},
+    {name: "no data rows", data: "a,b\n", columns: []string{"a", "b"}, values: []uint64{0, 0}},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      result, err := ComputeMetric(ColumnBlankCellMetric, strings.NewReader(test.data), DefaultMetricOptions())
+      if test.err {
+        if err == nil {
+          t.Errorf("expected error, got %+v", result)
+        }
+        return
+      }
+      if err != nil {
+        t.Fatal(err)
+      }
+      if !result.EqualVector(test.columns, test.values) {
+        t.Errorf("vector %v %v, expected %v %v", result.Columns, result.Values, test.columns, test.values)
+      }
+      if result.Hash() != HashMetricVector(test.columns, test.values) {
+        t.Errorf("hash %s of the result doesn't match its vector", result.Hash())
+      }
+    })
+  }
+
+  hash := HashMetricVector([]string{"a", "b"}, []uint64{1, 2})
+  for _, other := range []string{
+    HashMetricVector([]string{"a", "c"}, []uint64{1, 2}),
+    HashMetricVector([]string{"a", "b"}, []uint64{2, 1}),
+    HashMetricVector([]string{"ab"}, []uint64{1, 2}),
+  } {
+    if other == hash {
+      t.Errorf("different vectors hash to %s", hash)
+    }
+  }
+}
+
+func TestNullTokens(t *testing.T) {
+  data := "a,b\n NULL,n/a\nnull,7\n-,\n"
+  tests := []struct {
+    name string
+    nullTokens model.NullTokens
+    blank []string
+    notBlank []string
+    value uint64
+  }{
+    {name: "default", nullTokens: model.DefaultNullTokens(), blank: []string{"", "na", "NA", "Na"}, notBlank: []string{" ", " na", "null", "-"}, value: 833333},
+    {name: "case insensitive", nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}}, blank: []string{"", "null", "Null", "n/a"}, notBlank: []string{" NULL", "na", "-"}, value: 500000},
+    {name: "trim space", nullTokens: model.NullTokens{Tokens: []string{" NULL", "N/A"}, TrimSpace: true}, blank: []string{" ", " null", "N/A\t"}, notBlank: []string{"nul l", "na"}, value: 333333},
+    {name: "case sensitive", nullTokens: model.NullTokens{Tokens: []string{"NULL", "N/A"}, CaseSensitive: true, TrimSpace: true}, blank: []string{"NULL", " NULL "}, notBlank: []string{"null", "n/a"}, value: 666666},
+    {name: "no tokens", nullTokens: model.NullTokens{}, blank: []string{""}, notBlank: []string{"na", " "}, value: 833333},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      isNull := NewNullMatcher(test.nullTokens)
+      for _, value := range test.blank {
+        if !isNull(value) {
+          t.Errorf("%q isn't blank", value)
+        }
+      }
+      for _, value := range test.notBlank {
+        if isNull(value) {
+          t.Errorf("%q is blank", value)
+        }
+      }
+      options := DefaultMetricOptions()
+      options.NullTokens = test.nullTokens
+      result, err := ComputeMetric(DefaultMetric, strings.NewReader(data), options)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if result.Value != test.value {
+        t.Errorf("value %d, expected %d", result.Value, test.value)
+      }
+    })
+  }
+}
+
+func TestDialect(t *testing.T) {
+  dialect := func(change func(*model.Dialect)) MetricOptions {
+    options := DefaultMetricOptions()
+    change(&options.Dialect)
+    return options
+  }
+  tests := []struct {
+    name string
+    data string
+    options MetricOptions
+    value uint64
+    columns []string
+    err bool
+  }{
+    {name: "tab", data: "a\tb\n1\t\nna\t2\n", options: dialect(func(d *model.Dialect) { d.Delimiter = "\t" }), value: 500000, columns: []string{"a", "b"}},
+    {name: "tab read as comma", data: "a\tb\n1\t\nna\t2\n", options: DefaultMetricOptions(), value: 1000000, columns: []string{"a\tb"}},
+    {name: "semicolon", data: "a;b\n1;\n", options: dialect(func(d *model.Dialect) { d.Delimiter = ";" }), value: 500000, columns: []string{"a", "b"}},
+    {name: "comment", data: "# exported\na,b\n1,\n#x,y,z\n2,3\n", options: dialect(func(d *model.Dialect) { d.Comment = "#" }), value: 750000, columns: []string{"a", "b"}},
+    {name: "comment read as data", data: "# exported\na,b\n1,\n#x,y,z\n2,3\n", options: DefaultMetricOptions(), value: 1000000, columns: []string{"# exported"}},
+    {name: "two header rows", data: "title,x,y\na,b\n1,\n", options: dialect(func(d *model.Dialect) { d.HeaderRows = 2 }), value: 500000, columns: []string{"a", "b"}},
+    {name: "no header rows", data: "1,\n2,3\n", options: dialect(func(d *model.Dialect) { d.HeaderRows = 0 }), value: 750000, columns: []string{"1", "2"}},
+    {name: "trim leading space", data: "a,b\n1, \n", options: dialect(func(d *model.Dialect) { d.TrimLeadingSpace = true }), value: 500000, columns: []string{"a", "b"}},
+    {name: "leading space", data: "a,b\n1, \n", options: DefaultMetricOptions(), value: 1000000, columns: []string{"a", "b"}},
+    {name: "lazy quotes", data: "a,b\n1,x\"y\n", options: dialect(func(d *model.Dialect) { d.LazyQuotes = true }), value: 1000000, columns: []string{"a", "b"}},
+    {name: "bare quote", data: "a,b\n1,x\"y\n", options: DefaultMetricOptions(), err: true},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      result, err := ComputeMetric(DefaultMetric, strings.NewReader(test.data), test.options)
+      columnResult, columnErr := ComputeMetric(ColumnBlankCellMetric, strings.NewReader(test.data), test.options)
+      if test.err {
+        if err == nil || columnErr == nil {
+          t.Errorf("expected errors, got %v, %v", err, columnErr)
+        }
+        return
+      }
+      if err != nil || columnErr != nil {
+        t.Fatalf("unexpected errors %v, %v", err, columnErr)
+      }
+      if result.Value != test.value {
+        t.Errorf("value %d, expected %d", result.Value, test.value)
+      }
+      if len(columnResult.Columns) != len(test.columns) {
+        t.Fatalf("columns %q, expected %q", columnResult.Columns, test.columns)
+      }
+      for i, column := range test.columns {
+        if columnResult.Columns[i] != column {
+          t.Errorf("columns %q, expected %q", columnResult.Columns, test.columns)
+        }
+      }
+    })
+  }
+
+  for _, invalid := range []model.Dialect{
+    {Delimiter: ""},
+    {Delimiter: ";;"},
+    {Delimiter: "\""},
+    {Delimiter: "\n"},
+    {Delimiter: ",", Comment: ","},
+    {Delimiter: ",", Comment: "##"},
+  } {
+    if err := ValidateDialect(invalid); err == nil {
+      t.Errorf("dialect %+v is valid", invalid)
+    }
+  }
+}
+
+const benchmarkRows = 200000
+const benchmarkChunkSize = 1 << 20
+
+func generateCsv(rows int) []byte {
+  var buf bytes.Buffer
+  buf.WriteString("id,name,score,comment\n")
+  for i := 0; i < rows; i += 1 {
+    comment := "na"
+    if i % 3 == 0 {
+      comment = fmt.Sprintf("row %d is a commented row", i)
+    }
+    fmt.Fprintf(&buf, "%d,name%d,%d,%s\n", i, i % 97, i % 1000, comment)
+  }
+  return buf.Bytes()
+}
+
+func prepareChunks(tb testing.TB, data []byte) *model.DataChunks {
+  preparedData, err := PrepareDataToSend(data, benchmarkChunkSize)
+  if err != nil {
+    tb.Fatal(err)
+  }
+  dataChunks := &model.DataChunks{}
+  for _, chunkHex := range preparedData {
+    if err := UpdateDataChunks(dataChunks, chunkHex); err != nil {
+      tb.Fatal(err)
+    }
+  }
+  return dataChunks
+}
+
+func TestDegenerateCsv(t *testing.T) {
+  lazyQuotes := DefaultMetricOptions()
+  lazyQuotes.Dialect.LazyQuotes = true
+  noHeader := DefaultMetricOptions()
+  noHeader.Dialect.HeaderRows = 0
+
+  tests := []struct {
+    name string
+    data string
+    options MetricOptions
+    value uint64
+    columns []string
+    values []uint64
+    err error
+  }{
+    {name: "empty", data: "", value: 0, columns: []string{}, values: []uint64{}},
+    {name: "empty without header", data: "", options: noHeader, value: 0, columns: []string{}, values: []uint64{}},
+    {name: "header only", data: "a,b\n", value: 0, columns: []string{"a", "b"}, values: []uint64{0, 0}},
+    {name: "blank lines only", data: "a,b\n\n\n", value: 0, columns: []string{"a", "b"}, values: []uint64{0, 0}},
+    {name: "ragged rows", data: "a,b\n1\n1,2,3\n", value: 750000, columns: []string{"a", "b"}, values: []uint64{1000000, 500000}},
+    {name: "ragged rows without header", data: "1,2\n1\n", options: noHeader, value: 750000, columns: []string{"1", "2"}, values: []uint64{1000000, 500000}},
+    {name: "invalid utf8", data: "a,b\n\xff,\xfe\x80\n", value: 1000000, columns: []string{"a", "b"}, values: []uint64{1000000, 1000000}},
+    {name: "bare quote", data: "a\nx\"y\n", err: csv.ErrBareQuote},
+    {name: "bare quote with lazy quotes", data: "a\nx\"y\n", options: lazyQuotes, value: 1000000, columns: []string{"a"}, values: []uint64{1000000}},
+    {name: "huge field", data: "a\n" + strings.Repeat("x", int(MaxCsvRecordSize) + 8192) + "\n", err: ErrCsvRecordTooLarge},
+  }
+
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      options := test.options
+      if options.Dialect.Delimiter == "" {
+        options = DefaultMetricOptions()
+      }
+
+      value, err := CsvBlankCellPermillionage(strings.NewReader(test.data), options)
+      columns, values, columnErr := CsvColumnBlankCellPermillionage(strings.NewReader(test.data), options)
+      if test.err != nil {
+        var dataErr *CsvDataError
+        if !errors.As(err, &dataErr) || !errors.Is(err, test.err) {
+          t.Errorf("expected data error %v, got %v", test.err, err)
+        }
+        if !errors.As(columnErr, &dataErr) || !errors.Is(columnErr, test.err) {
+          t.Errorf("expected data error %v for columns, got %v", test.err, columnErr)
+        }
+        return
+      }
+      if err != nil || columnErr != nil {
+        t.Fatalf("unexpected errors %v, %v", err, columnErr)
+      }
+      if value != test.value {
+        t.Errorf("value %d, expected %d", value, test.value)
+      }
+      result := MetricResult{Columns: columns, Values: values}
+      if !result.EqualVector(test.columns, test.values) {
+        t.Errorf("vector %v %v, expected %v %v", columns, values, test.columns, test.values)
+      }
+    })
+  }
+}
+
+func TestComputeCidAndMetricMatchesComposedData(t *testing.T) {
+  data := generateCsv(1000)
+  dataChunks := prepareChunks(t, data)
+
+  reader, err := NewChunksReader(dataChunks)
+  if err != nil {
+    t.Fatal(err)
+  }
+  streamCids, streamResult, err := ComputeCidAndMetric(reader, DataCidPrefix(), DefaultMetric, DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  composed, err := ComposeDataFromChunks(dataChunks)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataCid, err := GetDataCid(bytes.NewReader(composed))
+  if err != nil {
+    t.Fatal(err)
+  }
+  result, err := ComputeMetric(DefaultMetric, bytes.NewReader(composed), DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  if !streamCids.Contains(dataCid) {
+    t.Errorf("streamed CIDs %s, expected %s", streamCids, dataCid)
+  }
+  if streamResult.Value != result.Value {
+    t.Errorf("streamed value %d, expected %d", streamResult.Value, result.Value)
+  }
+}
+
+// BenchmarkValidateComposedString composes the chunks and copies the data to a
+// string before hashing and computing the metric, as validation used to do
+func BenchmarkValidateComposedString(b *testing.B) {
+  data := generateCsv(benchmarkRows)
+  dataChunks := prepareChunks(b, data)
+  b.SetBytes(int64(len(data)))
+  b.ReportAllocs()
+  b.ResetTimer()
+
+  for i := 0; i < b.N; i += 1 {
+    composed, err := ComposeDataFromChunks(dataChunks)
+    if err != nil {
+      b.Fatal(err)
+    }
+    claimData := string(composed)
+    if _, err := GetDataCid(strings.NewReader(claimData)); err != nil {
+      b.Fatal(err)
+    }
+    if _, err := ComputeMetric(DefaultMetric, strings.NewReader(claimData), DefaultMetricOptions()); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+// BenchmarkValidateStreaming decompresses, hashes and computes the metric in a
+// single pass over the chunks
+func BenchmarkValidateStreaming(b *testing.B) {
+  data := generateCsv(benchmarkRows)
+  dataChunks := prepareChunks(b, data)
+  b.SetBytes(int64(len(data)))
+  b.ReportAllocs()
+  b.ResetTimer()
+
+  for i := 0; i < b.N; i += 1 {
+    reader, err := NewChunksReader(dataChunks)
+    if err != nil {
+      b.Fatal(err)
+    }
+    if _, _, err := ComputeCidAndMetric(reader, DataCidPrefix(), DefaultMetric, DefaultMetricOptions()); err != nil {
+      b.Fatal(err)
+    }
+  }
+}
+
+// patternData is the test file of the known UnixFS CIDs, byte i is i mod 251
+func patternData(size int) []byte {
+  data := make([]byte, size)
+  for i := range data {
+    data[i] = byte(i % 251)
+  }
+  return data
+}
+
+func TestUnixFsCid(t *testing.T) {
+  // expected CIDs are the ones of `ipfs add` (256KiB chunks, balanced layout,
+  // 174 links per node) and `ipfs add --cid-version=1` (raw leaves)
+  threeChunks := patternData(262144*2 + 1000)
+  twoLevels := patternData(262144*175 + 12345)
+  tests := []struct {
+    name string
+    data []byte
+    version uint64
+    expected string
+  }{
+    {name: "empty v0", data: []byte{}, version: 0, expected: "QmbFMke1KXqnYyBBWxB74N4c5SBnJMVAiMNRcGu6x1AwQH"},
+    {name: "single chunk v0", data: []byte("hello world\n"), version: 0, expected: "QmT78zSuBmuS4z925WZfrqQ1qHaJ56DQaTfyMUF7F8ff5o"},
+    {name: "full chunk v0", data: patternData(262144), version: 0, expected: "QmeqfRyS3vkku7n6krqC3DgGMex3x2sCpSeKMDmrG13QQq"},
+    {name: "full chunk v1", data: patternData(262144), version: 1, expected: "bafkreibruh455iawsviqslif5c7uurdcfdemh22mtnytyzvnzn75kpejxy"},
+    {name: "three chunks v0", data: threeChunks, version: 0, expected: "QmZcZxYrxuDHjzgVm2FwQQdPAhm7xHmm8kbXCax5JvkcoX"},
+    {name: "three chunks v1", data: threeChunks, version: 1, expected: "bafybeiedlmc6ukelkdnmjelnxg565gp6jy3ued6onc4pv7p5qiohksmq3e"},
+    {name: "176 chunks v0", data: twoLevels, version: 0, expected: "QmPHTtDbeCqjdGUde3qAbUNuBBUaH1ycxYfUuWTnh7Jf9U"},
+    {name: "176 chunks v1", data: twoLevels, version: 1, expected: "bafybeig26zqwrr5xvjpk3zhfgqpmhgitt3islants4x7w42yers4wromba"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      dataCid, err := GetUnixFsCid(bytes.NewReader(test.data), test.version)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if dataCid.String() != test.expected {
+        t.Errorf("CID %s, expected %s", dataCid, test.expected)
+      }
+    })
+  }
+
+  // single chunk CIDv1 UnixFS DAGs are a raw leaf, the same as the raw CID
+  data := generateCsv(1000)
+  rawCid, _ := GetDataCid(bytes.NewReader(data))
+  unixFsCid, _ := GetUnixFsCid(bytes.NewReader(data), 1)
+  if !rawCid.Equals(unixFsCid) {
+    t.Errorf("single chunk CIDv1 %s, expected %s", unixFsCid, rawCid)
+  }
+}
+
+func TestCanonicalCid(t *testing.T) {
+  data := []byte("hello world\n")
+  rawCid, _ := GetDataCid(bytes.NewReader(data))
+  v0Cid, _ := GetUnixFsCid(bytes.NewReader(data), 0)
+  base58Raw, _ := rawCid.StringOfBase('z')
+  keccakPrefix := DataCidPrefix()
+  keccakPrefix.MhType, _ = MultihashFromName("keccak-256")
+  keccakCid, _ := GetDataCidWithPrefix(bytes.NewReader(data), keccakPrefix)
+  md5Cid, _ := cid.Prefix{Version: 1, Codec: cid.Raw, MhType: mh.MD5, MhLength: -1}.Sum(data)
+
+  tests := []struct {
+    name string
+    id string
+    expected string
+  }{
+    {name: "raw base32", id: rawCid.String(), expected: rawCid.String()},
+    {name: "raw base58", id: base58Raw, expected: rawCid.String()},
+    {name: "dag-pb v0", id: v0Cid.String(), expected: "bafybeicg2rebjoofv4kbyovkw7af3rpiitvnl6i7ckcywaq6xjcxnc2mby"},
+    {name: "keccak-256", id: keccakCid.String(), expected: keccakCid.String()},
+    {name: "not a cid", id: "claim"},
+    {name: "unsupported hash function", id: md5Cid.String()},
+    {name: "unsupported codec", id: cid.NewCidV1(cid.DagCBOR, rawCid.Hash()).String()},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      canonical, err := CanonicalCid(test.id)
+      if test.expected == "" {
+        if err == nil {
+          t.Errorf("expected error for %s, got %s", test.id, canonical)
+        }
+        return
+      }
+      if err != nil || canonical != test.expected {
+        t.Errorf("canonical %s (%v), expected %s", canonical, err, test.expected)
+      }
+    })
+  }
+
+  // the canonical CIDv1 of a CIDv0 DAG still validates the data
+  pref, _ := CidPrefixFromString("bafybeicg2rebjoofv4kbyovkw7af3rpiitvnl6i7ckcywaq6xjcxnc2mby")
+  dataCids, _, err := ComputeCidAndMetric(bytes.NewReader(data), pref, DefaultMetric, DefaultMetricOptions())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if equal, _ := CompareCidWithString(dataCids, "bafybeicg2rebjoofv4kbyovkw7af3rpiitvnl6i7ckcywaq6xjcxnc2mby"); !equal {
+    t.Errorf("CIDs %s don't match the CIDv0 DAG", dataCids)
+  }
+}
+
+func TestBisectionTree(t *testing.T) {
+  data := generateCsv(1000)
+  dataCid, _ := GetDataCid(bytes.NewReader(data))
+
+  for _, metricName := range []string{DefaultMetric, ColumnBlankCellMetric} {
+    t.Run(metricName, func(t *testing.T) {
+      metric, _ := GetMetric(metricName)
+      options := DefaultMetricOptions()
+      tree, err := BuildBisectionTree(data, 4096, metricName, options)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if len(tree.Leaves) < 2 {
+        t.Fatalf("%d leaves, expected several", len(tree.Leaves))
+      }
+      root, err := tree.Root()
+      if err != nil {
+        t.Fatal(err)
+      }
+
+      // the root partial finalizes to the metric of the whole data
+      bisection, result, err := NewBisection(dataCid, metric, options, tree.Columns, root.Hash, root.StateOut, root.Partial, uint32(len(tree.Leaves)), tree.Width)
+      if err != nil {
+        t.Fatal(err)
+      }
+      expected, _ := ComputeMetric(metricName, bytes.NewReader(data), options)
+      if result.Value != expected.Value || !result.EqualVector(expected.Columns, expected.Values) {
+        t.Errorf("root result %v, expected %v", result, expected)
+      }
+
+      // an honest claimer answers every step and its leaf verifies
+      for bisection.End - bisection.Start > 1 {
+        mid := BisectionSplit(bisection.Start, bisection.End)
+        left, _ := tree.Node(bisection.Start, mid)
+        right, _ := tree.Node(mid, bisection.End)
+        if err := VerifyBisectionChildren(bisection, left, right); err != nil {
+          t.Fatal(err)
+        }
+        bisection.Node, bisection.Start = right, mid
+      }
+      if err := VerifyBisectionLeaf(bisection, tree.Chunks[bisection.Start], metric, options, tree.Columns); err != nil {
+        t.Errorf("honest leaf: %v", err)
+      }
+      if err := VerifyBisectionLeaf(bisection, tree.Chunks[0], metric, options, tree.Columns); !errors.Is(err, ErrBisectionChunkMismatch) {
+        t.Errorf("expected chunk mismatch, got %v", err)
+      }
+    })
+  }
+}
+
+func TestBisectionWrongLeaf(t *testing.T) {
+  data := generateCsv(1000)
+  dataCid, _ := GetDataCid(bytes.NewReader(data))
+  metric, _ := GetMetric(DefaultMetric)
+  options := DefaultMetricOptions()
+  honest, _ := BuildBisectionTree(data, 4096, DefaultMetric, options)
+
+  // the claimer moves a blank cell from one chunk to another, so the root
+  // partial and the chain of hash states are right but two leaves are wrong
+  forged, _ := BuildBisectionTree(data, 4096, DefaultMetric, options)
+  forged.Leaves[1].Partial = []uint64{forged.Leaves[1].Partial[0], forged.Leaves[1].Partial[1] + 1}
+  forged.Leaves[1].Hash = BisectionLeafHash(forged.Leaves[1])
+  forged.Leaves[2].Partial = []uint64{forged.Leaves[2].Partial[0], forged.Leaves[2].Partial[1] - 1}
+  forged.Leaves[2].Hash = BisectionLeafHash(forged.Leaves[2])
+  root, _ := forged.Root()
+
+  bisection, _, err := NewBisection(dataCid, metric, options, nil, root.Hash, root.StateOut, root.Partial, uint32(len(forged.Leaves)), forged.Width)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the disputer follows the child that differs from its own tree
+  for bisection.End - bisection.Start > 1 {
+    mid := BisectionSplit(bisection.Start, bisection.End)
+    left, _ := forged.Node(bisection.Start, mid)
+    right, _ := forged.Node(mid, bisection.End)
+    if err := VerifyBisectionChildren(bisection, left, right); err != nil {
+      t.Fatal(err)
+    }
+    honestLeft, _ := honest.Node(bisection.Start, mid)
+    if left.Hash != honestLeft.Hash {
+      bisection.Node, bisection.End = left, mid
+    } else {
+      bisection.Node, bisection.Start = right, mid
+    }
+  }
+  if bisection.Start != 1 {
+    t.Errorf("bisection ended at chunk %d, expected 1", bisection.Start)
+  }
+  err = VerifyBisectionLeaf(bisection, forged.Chunks[bisection.Start], metric, options, nil)
+  if err == nil || errors.Is(err, ErrBisectionChunkMismatch) {
+    t.Errorf("expected wrong partial, got %v", err)
+  }
+
+  // the revealed children must merge into the node in question
+  bisection, _, _ = NewBisection(dataCid, metric, options, nil, root.Hash, root.StateOut, root.Partial, uint32(len(forged.Leaves)), forged.Width)
+  mid := BisectionSplit(bisection.Start, bisection.End)
+  left, _ := honest.Node(bisection.Start, mid)
+  right, _ := forged.Node(mid, bisection.End)
+  if VerifyBisectionChildren(bisection, left, right) == nil {
+    t.Errorf("expected children mismatch")
+  }
+}
+
+func TestSpotCheck(t *testing.T) {
+  data := generateCsv(200)
+  dataCid, _ := GetDataCid(bytes.NewReader(data))
+  metric, _ := GetMetric(DefaultMetric)
+  options := DefaultMetricOptions()
+
+  tree, err := CommitRows(data, DefaultMetric, options)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(tree.Leaves) != 200 {
+    t.Fatalf("%d rows, expected 200", len(tree.Leaves))
+  }
+  root, _ := tree.Root()
+  spotCheck, _, err := NewSpotCheck(dataCid, metric, options, nil, root.Hash, root.StateOut, root.Partial, uint32(len(tree.Leaves)), tree.Width)
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  samples := SampleRows(dataCid.String(), 100, 1700000000, spotCheck.Rows, SpotCheckSamples)
+  if len(samples) != SpotCheckSamples {
+    t.Fatalf("%d samples, expected %d", len(samples), SpotCheckSamples)
+  }
+  for i, row := range samples {
+    if row >= spotCheck.Rows || (i > 0 && row <= samples[i-1]) {
+      t.Fatalf("samples %v aren't distinct sorted rows", samples)
+    }
+  }
+  if all := SampleRows(dataCid.String(), 100, 1700000000, 3, SpotCheckSamples); len(all) != 3 {
+    t.Errorf("samples %v, expected every row", all)
+  }
+
+  for _, row := range append(samples, 0, spotCheck.Rows-1) {
+    proof, _ := tree.Proof(row)
+    leaf := tree.Leaves[row]
+    if err := VerifySpotCheckRow(spotCheck, row, tree.Chunks[row], leaf.StateIn, leaf.Partial, proof, metric, options, nil); err != nil {
+      t.Errorf("row %d: %v", row, err)
+    }
+  }
+
+  // a row proven with another row's path isn't in the commitment
+  proof, _ := tree.Proof(5)
+  leaf := tree.Leaves[6]
+  if err := VerifySpotCheckRow(spotCheck, 6, tree.Chunks[6], leaf.StateIn, leaf.Partial, proof, metric, options, nil); !errors.Is(err, ErrSpotCheckProof) {
+    t.Errorf("expected proof error, got %v", err)
+  }
+
+  // a committed row with a wrong partial contradicts the claim
+  tree.Leaves[6].Partial = []uint64{leaf.Partial[0], leaf.Partial[1] + 1}
+  tree.Leaves[6].Hash = BisectionLeafHash(tree.Leaves[6])
+  tree.Leaves[7].Partial = []uint64{tree.Leaves[7].Partial[0], tree.Leaves[7].Partial[1] - 1}
+  tree.Leaves[7].Hash = BisectionLeafHash(tree.Leaves[7])
+  tree.nodes = make(map[[2]uint32]model.BisectionNode)
+  root, _ = tree.Root()
+  spotCheck, _, _ = NewSpotCheck(dataCid, metric, options, nil, root.Hash, root.StateOut, root.Partial, uint32(len(tree.Leaves)), tree.Width)
+  proof, _ = tree.Proof(6)
+  leaf = tree.Leaves[6]
+  err = VerifySpotCheckRow(spotCheck, 6, tree.Chunks[6], leaf.StateIn, leaf.Partial, proof, metric, options, nil)
+  if err == nil || errors.Is(err, ErrSpotCheckProof) {
+    t.Errorf("expected wrong row, got %v", err)
+  }
+}
+
+func TestChunkManifest(t *testing.T) {
+  chunks, err := PrepareDataToSend(generateCsv(1000), 1024)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chunks) < 3 {
+    t.Fatalf("%d chunks, expected several", len(chunks))
+  }
+  dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+
+  if UpdateDataChunks(dataChunks, chunks[1]) == nil {
+    t.Errorf("expected chunk before the manifest to fail")
+  }
+  for _, chunk := range []string{chunks[0], chunks[0], chunks[2], chunks[2]} {
+    if err := UpdateDataChunks(dataChunks, chunk); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if received := dataChunks.ReceivedChunks(); len(received) != 2 || received[1] != 2 {
+    t.Errorf("received %v, expected [0 2]", received)
+  }
+  if missing := dataChunks.MissingChunks(); len(missing) != len(chunks) - 2 || missing[0] != 1 {
+    t.Errorf("missing %v", missing)
+  }
+
+  // a replaced chunk doesn't match its manifest hash
+  tampered := chunks[1][:len(chunks[1])-2] + "00"
+  if tampered == chunks[1] {
+    tampered = chunks[1][:len(chunks[1])-2] + "01"
+  }
+  if UpdateDataChunks(dataChunks, tampered) == nil {
+    t.Errorf("expected tampered chunk to fail")
+  }
+
+  // a first chunk with another manifest restarts the upload
+  otherChunks, _ := PrepareDataToSend(generateCsv(10), 1024)
+  if err := UpdateDataChunks(dataChunks, otherChunks[0]); err != nil {
+    t.Fatal(err)
+  }
+  if dataChunks.TotalChunks != uint32(len(otherChunks)) || len(dataChunks.ReceivedChunks()) != 1 {
+    t.Errorf("upload wasn't restarted: %d chunks, received %v", dataChunks.TotalChunks, dataChunks.ReceivedChunks())
+  }
+}
+
+func TestChunkEnvelope(t *testing.T) {
+  envelope := &ChunkEnvelope{Version: ChunkEnvelopeVersion, Codec: ChunkCodecGzip, Index: 1, TotalChunks: 3, TotalSize: 10, Data: []byte{1, 2, 3}}
+  decoded, err := DecodeChunkEnvelopeHex(envelope.EncodeHex())
+  if err != nil {
+    t.Fatal(err)
+  }
+  if decoded.Index != 1 || decoded.TotalChunks != 3 || decoded.TotalSize != 10 || !bytes.Equal(decoded.Data, envelope.Data) {
+    t.Errorf("decoded %+v, expected %+v", decoded, envelope)
+  }
+
+  unknownVersion := *envelope
+  unknownVersion.Version = ChunkEnvelopeVersion + 1
+  unknownCodec := *envelope
+  unknownCodec.Codec = 0xff
+  tooLarge := *envelope
+  tooLarge.TotalSize = 2
+  tests := []struct {
+    name string
+    chunk []byte
+    err string
+  }{
+    {name: "unknown version", chunk: unknownVersion.Encode(), err: "Unsupported chunk envelope version"},
+    {name: "unknown codec", chunk: unknownCodec.Encode(), err: "Unsupported compression codec"},
+    {name: "larger than total size", chunk: tooLarge.Encode(), err: "larger than the total size"},
+    {name: "unversioned header", chunk: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0x1f, 0x8b}, err: "isn't a chunk envelope"},
+    {name: "truncated header", chunk: envelope.Encode()[:10], err: "smaller than its header"},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      _, err := DecodeChunkEnvelope(test.chunk)
+      if err == nil || !strings.Contains(err.Error(), test.err) {
+        t.Errorf("expected error %q, got %v", test.err, err)
+      }
+    })
+  }
+}
+
+func TestChunkCodecs(t *testing.T) {
+  data := generateCsv(1000)
+  for _, name := range append(ListChunkCodecs(), ChunkCodecAuto) {
+    t.Run(name, func(t *testing.T) {
+      chunks, err := PrepareDataToSendWithCodec(data, 1024, name, 9)
+      if err != nil {
+        t.Fatal(err)
+      }
+      dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+      for _, chunk := range chunks {
+        if err := UpdateDataChunks(dataChunks, chunk); err != nil {
+          t.Fatal(err)
+        }
+      }
+      if name != ChunkCodecAuto {
+        codec, _ := GetChunkCodec(dataChunks.Codec)
+        if codec.Name != name {
+          t.Errorf("codec %s in the header, expected %s", codec.Name, name)
+        }
+      }
+      composed, err := ComposeDataFromChunks(dataChunks)
+      if err != nil {
+        t.Fatal(err)
+      }
+      if !bytes.Equal(composed, data) {
+        t.Errorf("composed data differs from the original")
+      }
+    })
+  }
+
+  if _, err := PrepareDataToSendWithCodec(data, 1024, "brotli", 9); err == nil {
+    t.Errorf("expected unknown codec to fail")
+  }
+
+  // auto picks the smallest payload
+  smallest, _, err := compressSmallest(data, 9)
+  if err != nil {
+    t.Fatal(err)
+  }
+  for _, name := range ListChunkCodecs() {
+    codec, _ := ChunkCodecFromName(name)
+    compressed, _ := CompressDataWithCodec(data, codec.Id, 9)
+    if len(compressed) < len(smallest) {
+      t.Errorf("%s gives %d bytes, smaller than auto %d", name, len(compressed), len(smallest))
+    }
+  }
+}
+
+func TestDataLimits(t *testing.T) {
+  defaultLimits := Limits
+  defer func() { Limits = defaultLimits }()
+
+  data := generateCsv(1000)
+  chunks, err := PrepareDataToSend(data, 1024)
+  if err != nil {
+    t.Fatal(err)
+  }
+  tests := []struct {
+    name string
+    limits DataLimits
+    limit string
+  }{
+    {name: "chunks", limits: DataLimits{MaxCompressedSize: 1 << 20, MaxDecompressedSize: 1 << 20, MaxChunks: 2, MaxChunkSize: 1 << 20}, limit: LimitChunks},
+    {name: "compressed size", limits: DataLimits{MaxCompressedSize: 1024, MaxDecompressedSize: 1 << 20, MaxChunks: 256, MaxChunkSize: 1 << 20}, limit: LimitCompressedSize},
+    {name: "chunk size", limits: DataLimits{MaxCompressedSize: 1 << 20, MaxDecompressedSize: 1 << 20, MaxChunks: 256, MaxChunkSize: 512}, limit: LimitChunkSize},
+  }
+  for _, test := range tests {
+    t.Run(test.name, func(t *testing.T) {
+      Limits = test.limits
+      dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+      err := UpdateDataChunks(dataChunks, chunks[0])
+      var limitErr *LimitError
+      if !errors.As(err, &limitErr) || limitErr.Limit != test.limit {
+        t.Errorf("expected %s limit error, got %v", test.limit, err)
+      }
+    })
+  }
+
+  // a decompression bomb stops at the decompressed size limit
+  Limits = defaultLimits
+  Limits.MaxDecompressedSize = 1 << 16
+  bomb, err := PrepareDataToSend(make([]byte, 1 << 22), 1 << 20)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  for _, chunk := range bomb {
+    if err := UpdateDataChunks(dataChunks, chunk); err != nil {
+      t.Fatal(err)
+    }
+  }
+  _, err = ComposeDataFromChunks(dataChunks)
+  var limitErr *LimitError
+  if !errors.As(err, &limitErr) || limitErr.Limit != LimitDecompressedSize {
+    t.Errorf("expected decompressed size limit error, got %v", err)
+  }
+
+  // data right at the limit is read whole
+  reader := NewBoundedReader(bytes.NewReader(make([]byte, 100)), LimitDecompressedSize, 100)
+  if read, err := io.ReadAll(reader); err != nil || len(read) != 100 {
+    t.Errorf("read %d bytes with error %v, expected 100", len(read), err)
+  }
+  reader = NewBoundedReader(bytes.NewReader(make([]byte, 101)), LimitDecompressedSize, 100)
+  if read, err := io.ReadAll(reader); !errors.As(err, &limitErr) || len(read) != 100 {
+    t.Errorf("read %d bytes with error %v, expected limit error after 100", len(read), err)
+  }
+}
+
+func TestChunkStream(t *testing.T) {
+  data := generateCsv(1000)
+  chunks, err := PrepareDataToSend(data, 1024)
+  if err != nil {
+    t.Fatal(err)
+  }
+  expectedCid, err := GetDataCid(bytes.NewReader(data))
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataChunks := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  if err := UpdateDataChunks(dataChunks, chunks[0]); err != nil {
+    t.Fatal(err)
+  }
+  stream, err := NewChunkStream(dataChunks.Codec, func(data io.Reader) (bool, error) {
+    dataCids, _, err := ComputeCidAndMetric(data, DataCidPrefix(), DefaultMetric, DefaultMetricOptions())
+    if err != nil {
+      return false, err
+    }
+    return dataCids.Contains(expectedCid), nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataChunks.Stream = stream
+
+  // chunks ahead of the streamed ones wait, the others are streamed and dropped
+  order := []int{0, 2}
+  for i := 3; i < len(chunks); i += 1 {
+    order = append(order, i)
+  }
+  order = append(order, 1)
+  for i, index := range order {
+    if err := UpdateDataChunks(dataChunks, chunks[index]); err != nil {
+      t.Fatal(err)
+    }
+    done, err := StreamDataChunks(dataChunks)
+    if err != nil {
+      t.Fatal(err)
+    }
+    if done != (i == len(order)-1) {
+      t.Fatalf("stream done %v after chunk %d", done, index)
+    }
+    if index != 1 && dataChunks.NextChunk != 1 {
+      t.Errorf("streamed up to %d, expected 1", dataChunks.NextChunk)
+    }
+  }
+  if len(dataChunks.ChunksData) != 0 || len(dataChunks.MissingChunks()) != 0 {
+    t.Errorf("chunks left %d, missing %v", len(dataChunks.ChunksData), dataChunks.MissingChunks())
+  }
+  valid, err := stream.Close()
+  if err != nil || !valid {
+    t.Errorf("stream verification %v %v, expected valid", valid, err)
+  }
+
+  // uncompressed chunks are read straight, past the end by the cid hasher
+  rawChunks, err := PrepareDataToSendWithCodec(data, 1024, "none", DefaultCompressionLevel)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(rawChunks) < 3 {
+    t.Fatalf("expected several chunks, got %d", len(rawChunks))
+  }
+  dataChunks = &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  for _, chunk := range rawChunks {
+    if err := UpdateDataChunks(dataChunks, chunk); err != nil {
+      t.Fatal(err)
+    }
+  }
+  dataChunks.Stream, err = NewChunkStream(dataChunks.Codec, func(data io.Reader) (bool, error) {
+    dataCids, _, err := ComputeCidAndMetric(data, DataCidPrefix(), DefaultMetric, DefaultMetricOptions())
+    if err != nil {
+      return false, err
+    }
+    return dataCids.Contains(expectedCid), nil
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  if done, err := StreamDataChunks(dataChunks); !done || err != nil {
+    t.Fatalf("stream done %v %v, expected done", done, err)
+  }
+  closed := make(chan error)
+  go func() {
+    valid, err := dataChunks.Stream.Close()
+    if err == nil && !valid {
+      err = fmt.Errorf("data didn't verify")
+    }
+    closed <- err
+  }()
+  select {
+  case err := <-closed:
+    if err != nil {
+      t.Errorf("uncompressed stream verification: %v", err)
+    }
+  case <-time.After(5 * time.Second):
+    t.Fatalf("uncompressed stream doesn't close")
+  }
+
+  // wrong data ends the verification before the last chunk
+  badData := append([]byte("a,b\nc\"d,e\n"), generateCsv(50000)...)
+  badChunks, err := PrepareDataToSend(badData, 1 << 12)
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataChunks = &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  if err := UpdateDataChunks(dataChunks, badChunks[0]); err != nil {
+    t.Fatal(err)
+  }
+  dataChunks.Stream, _ = NewChunkStream(dataChunks.Codec, func(data io.Reader) (bool, error) {
+    _, err := ComputeMetric(DefaultMetric, data, DefaultMetricOptions())
+    return err == nil, err
+  })
+  done := false
+  for _, chunk := range badChunks[1:] {
+    if err := UpdateDataChunks(dataChunks, chunk); err != nil {
+      t.Fatal(err)
+    }
+    if done, err = StreamDataChunks(dataChunks); done || err != nil {
+      break
+    }
+  }
+  if !done || dataChunks.NextChunk == dataChunks.TotalChunks {
+    t.Errorf("stream done %v at chunk %d of %d, expected to end early", done, dataChunks.NextChunk, dataChunks.TotalChunks)
+  }
+  if valid, err := dataChunks.Stream.Close(); valid || err == nil {
+    t.Errorf("expected bad data to fail verification")
+  }
+
+  // a restarted upload aborts the stream
+  aborted, _ := NewChunkStream(ChunkCodecGzip, func(data io.Reader) (bool, error) {
+    _, err := io.ReadAll(data)
+    return false, err
+  })
+  aborted.Write(nil)
+  aborted.Abort()
+  if _, err := aborted.Close(); !errors.Is(err, ErrStreamAborted) {
+    t.Errorf("expected aborted stream, got %v", err)
+  }
+}
+
+func TestChunkStore(t *testing.T) {
+  defaultLimits := Limits
+  defer func() { Limits = defaultLimits }()
+
+  data := generateCsv(1000)
+  chunks, err := PrepareDataToSend(data, 1024)
+  if err != nil {
+    t.Fatal(err)
+  }
+  store := NewChunkStore()
+  upload := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  for _, chunk := range chunks {
+    if err := UpdateDataChunks(upload, chunk); err != nil {
+      t.Fatal(err)
+    }
+    store.HoldUpload("a", upload)
+  }
+  if err := store.AddDataset("cid", "a", upload); err != nil {
+    t.Fatal(err)
+  }
+  store.Release("a")
+  if len(store.Blobs) == 0 || !store.HasDataset("cid") {
+    t.Fatalf("dataset chunks weren't kept")
+  }
+  reader, err := store.DatasetReader("cid")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if stored, err := io.ReadAll(reader); err != nil || !bytes.Equal(stored, data) {
+    t.Errorf("stored data differs from the original: %v", err)
+  }
+
+  // another upload of the same data only needs the first chunk
+  other := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  if err := UpdateDataChunks(other, chunks[0]); err != nil {
+    t.Fatal(err)
+  }
+  store.FillUpload(other)
+  store.HoldUpload("b", other)
+  if missing := other.MissingChunks(); len(missing) != 0 {
+    t.Errorf("missing %v, expected the stored chunks", missing)
+  }
+  for key, blob := range store.Blobs {
+    if blob.Refs != 2 {
+      t.Errorf("blob %s has %d refs, expected 2", key, blob.Refs)
+    }
+  }
+
+  // a restarted upload releases the chunks of the previous one
+  restarted, _ := PrepareDataToSend(generateCsv(10), 1024)
+  if err := UpdateDataChunks(other, restarted[0]); err != nil {
+    t.Fatal(err)
+  }
+  store.HoldUpload("b", other)
+  for key, blob := range store.Blobs {
+    if blob.Refs != 1 {
+      t.Errorf("blob %s has %d refs, expected 1", key, blob.Refs)
+    }
+  }
+  store.Release("b")
+
+  // the oldest datasets are dropped over the store size limit
+  Limits.MaxStoreSize = store.Size
+  if err := UpdateDataChunks(other, restarted[0]); err != nil {
+    t.Fatal(err)
+  }
+  store.HoldUpload("b", other)
+  if err := store.AddDataset("other", "b", other); err != nil {
+    t.Fatal(err)
+  }
+  store.Release("b")
+  if store.HasDataset("cid") || !store.HasDataset("other") || len(store.Blobs) != 1 {
+    t.Errorf("datasets %v with %d blobs, expected only the newest", store.DatasetOrder, len(store.Blobs))
+  }
+
+  // held uploads count against the limit, one that doesn't fit isn't kept
+  Limits.MaxStoreSize = store.Size + uint64(len(data) / 4)
+  held := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  for _, chunk := range chunks {
+    if err := UpdateDataChunks(held, chunk); err != nil {
+      t.Fatal(err)
+    }
+    store.HoldUpload("c", held)
+    if store.Size > Limits.MaxStoreSize {
+      t.Fatalf("store of %d bytes over the %d bytes limit", store.Size, Limits.MaxStoreSize)
+    }
+  }
+  if !store.Holds["c"].Dropped || len(store.Holds["c"].Keys) != 0 {
+    t.Errorf("upload over the limit wasn't dropped")
+  }
+  if err := store.AddDataset("cid", "c", held); err == nil {
+    t.Errorf("added the dataset of a dropped upload")
+  }
+  if store.HasDataset("other") {
+    t.Errorf("dataset wasn't dropped to make room for the upload")
+  }
+  store.Release("c")
+  if len(store.Blobs) != 0 || store.Size != 0 {
+    t.Errorf("%d blobs of %d bytes left", len(store.Blobs), store.Size)
+  }
+}
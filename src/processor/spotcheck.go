@@ -0,0 +1,162 @@
+package processor
+
+import (
+  "fmt"
+  "sort"
+  "errors"
+  "crypto/sha256"
+  "encoding/binary"
+  cid "github.com/ipfs/go-cid"
+
+  "dapp/model"
+)
+
+// Spot checks are a cheaper alternative to full validation. The claimer
+// commits to a row level tree, the bisection tree with one data record per
+// leaf, and a dispute samples some rows from the dispute input metadata. The
+// claimer proves each sampled row with its Merkle path, which ties the row to
+// the CID and the claimed value, and the DApp recomputes the row. A wrong claim
+// is only caught if a wrong row is sampled.
+
+// SpotCheckSamples is the number of rows sampled by a spot check dispute
+var SpotCheckSamples = 16
+
+// ErrSpotCheckProof marks a row that isn't proven against the commitment,
+// which says nothing about the claim
+var ErrSpotCheckProof = errors.New("row isn't included in the commitment")
+
+// CommitRows builds the row commitment of a spot check claim
+func CommitRows(data []byte, metricName string, options MetricOptions) (*BisectionTree,error) {
+  return BuildBisectionTree(data,1,metricName,options)
+}
+
+// NewSpotCheck checks a spot check claim commitment and returns the dispute
+// state and the claimed metric result
+func NewSpotCheck(dataCid cid.Cid, metric Metric, options MetricOptions, columns []string, rootHash string, finalState string, partial []uint64, rows uint32, width uint32) (*model.SpotCheck,*MetricResult,error) {
+  root, result, err := checkTreeCommitment(dataCid,metric,options,columns,rootHash,finalState,partial,rows,width)
+  if err != nil {
+    return nil, nil, fmt.Errorf("NewSpotCheck: %s", err)
+  }
+  return &model.SpotCheck{Rows: rows, Width: width, Root: root}, result, nil
+}
+
+// SampleRows derives distinct sorted row indices from the claim and the block
+// number and timestamp of the dispute input. The disputer may pick when to
+// dispute, but the claimer can't choose the rows it will have to prove.
+func SampleRows(claimId string, blockNumber uint64, timestamp uint64, rows uint32, count int) []uint32 {
+  seed := []byte(claimId)
+  seed = binary.BigEndian.AppendUint64(seed,blockNumber)
+  seed = binary.BigEndian.AppendUint64(seed,timestamp)
+  seedHash := sha256.Sum256(seed)
+
+  samples := make([]uint32,0,count)
+  sampled := make(map[uint32]bool)
+  for counter := uint64(0); len(samples) < count && uint32(len(samples)) < rows; counter += 1 {
+    hash := sha256.Sum256(binary.BigEndian.AppendUint64(seedHash[:],counter))
+    index := uint32(binary.BigEndian.Uint64(hash[:8]) % uint64(rows))
+    if !sampled[index] {
+      sampled[index] = true
+      samples = append(samples,index)
+    }
+  }
+  sort.Slice(samples, func(i, j int) bool { return samples[i] < samples[j] })
+  return samples
+}
+
+// bisectionPath tells, from the root down, whether the node holding the leaf
+// is the left child
+func bisectionPath(leaves uint32, index uint32) []bool {
+  var path []bool
+  start, end := uint32(0), leaves
+  for end - start > 1 {
+    mid := BisectionSplit(start,end)
+    path = append(path,index < mid)
+    if index < mid {
+      end = mid
+    } else {
+      start = mid
+    }
+  }
+  return path
+}
+
+// Proof is the Merkle path of a leaf: the sibling nodes from the leaf level up
+func (t *BisectionTree) Proof(index uint32) ([]model.BisectionNode,error) {
+  if index >= uint32(len(t.Leaves)) {
+    return nil, fmt.Errorf("BisectionTree: invalid leaf %d", index)
+  }
+  var proof []model.BisectionNode
+  start, end := uint32(0), uint32(len(t.Leaves))
+  for end - start > 1 {
+    mid := BisectionSplit(start,end)
+    var sibling model.BisectionNode
+    var err error
+    if index < mid {
+      sibling, err = t.Node(mid,end)
+      end = mid
+    } else {
+      sibling, err = t.Node(start,mid)
+      start = mid
+    }
+    if err != nil {
+      return nil, err
+    }
+    proof = append([]model.BisectionNode{sibling},proof...)
+  }
+  return proof, nil
+}
+
+// VerifyRowProof merges the leaf with its siblings up to the root, which must
+// match the committed root
+func VerifyRowProof(spotCheck *model.SpotCheck, index uint32, leaf model.BisectionNode, proof []model.BisectionNode) error {
+  if index >= spotCheck.Rows {
+    return fmt.Errorf("VerifyRowProof: invalid row %d", index)
+  }
+  path := bisectionPath(spotCheck.Rows,index)
+  if len(proof) != len(path) {
+    return fmt.Errorf("VerifyRowProof: proof of %d nodes, expected %d", len(proof), len(path))
+  }
+  node := leaf
+  node.Hash = BisectionLeafHash(leaf)
+  for i, sibling := range proof {
+    left, right := node, sibling
+    if !path[len(path)-1-i] {
+      left, right = sibling, node
+    }
+    if left.StateOut != right.StateIn {
+      return fmt.Errorf("VerifyRowProof: hash states don't chain")
+    }
+    partial, err := MergePartials(left.Partial,right.Partial)
+    if err != nil {
+      return err
+    }
+    node = model.BisectionNode{StateIn: left.StateIn, StateOut: right.StateOut, Partial: partial}
+    node.Hash = BisectionNodeHash(node,left.Hash,right.Hash)
+  }
+  root := spotCheck.Root
+  if node.Hash != root.Hash || node.StateIn != root.StateIn || node.StateOut != root.StateOut || !equalPartials(node.Partial,root.Partial) {
+    return fmt.Errorf("VerifyRowProof: proof doesn't match the root")
+  }
+  return nil
+}
+
+// VerifySpotCheckRow proves a sampled row, given its data, the hash state it
+// starts at and its committed partial, and recomputes it. A row that isn't in
+// the commitment is ErrSpotCheckProof, any other error means the row, and so
+// the claim, is wrong.
+func VerifySpotCheckRow(spotCheck *model.SpotCheck, index uint32, chunk []byte, stateIn string, partial []uint64, proof []model.BisectionNode, metric Metric, options MetricOptions, columns []string) error {
+  hasher, err := hashFromState(stateIn)
+  if err != nil {
+    return fmt.Errorf("%w: %s", ErrSpotCheckProof, err)
+  }
+  hasher.Write(chunk)
+  leaf := model.BisectionNode{StateIn: stateIn, StateOut: hashState(hasher), Partial: partial}
+  if err := VerifyRowProof(spotCheck,index,leaf,proof); err != nil {
+    return fmt.Errorf("%w: %s", ErrSpotCheckProof, err)
+  }
+
+  // the data is the committed row
+  first := index == 0
+  last := index == spotCheck.Rows-1
+  return verifyLeafChunk(leaf,chunk,first,last,spotCheck.Width,metric,options,columns)
+}
@@ -0,0 +1,255 @@
+package processor
+
+import (
+  "io"
+  "fmt"
+  "crypto/sha256"
+  "encoding/binary"
+  "encoding/hex"
+
+  "dapp/model"
+)
+
+// The chunk store keeps the compressed chunks by the sha256 of their data,
+// shared by every upload and verified dataset holding them. A blob lives while
+// it has holders: the upload of a claim holds the chunks it received, and a
+// dataset, the chunks of an upload verified against a claimed CID, holds all
+// of its chunks. Uploads reuse the stored chunks their manifest lists, and a
+// claim on the CID of a dataset is validated without another upload. Held and
+// dataset chunks count against the store size limit: the oldest datasets are
+// dropped to make room, and an upload that still doesn't fit isn't kept.
+
+type Blob struct {
+  Data []byte                     `json:"data"`
+  Refs uint32                     `json:"refs"`
+}
+
+// Dataset is a verified upload, the chunks of the compressed data of a CID
+type Dataset struct {
+  Codec uint8                     `json:"codec"`
+  TotalSize uint64                `json:"totalSize"`
+  Chunks []string                 `json:"chunks"`
+}
+
+// Hold is the set of blobs a holder references, for an upload Upload is the
+// key of its manifest. Dropped uploads didn't fit in the store, their chunks
+// are only streamed.
+type Hold struct {
+  Upload string                   `json:"upload"`
+  Keys map[string]bool            `json:"keys"`
+  Dropped bool                    `json:"dropped,omitempty"`
+}
+
+type ChunkStore struct {
+  Blobs map[string]*Blob          `json:"blobs"`
+  Datasets map[string]*Dataset    `json:"datasets"`
+  DatasetOrder []string           `json:"datasetOrder"`
+  Holds map[string]*Hold          `json:"holds"`
+  Size uint64                     `json:"size"`
+}
+
+func NewChunkStore() *ChunkStore {
+  return &ChunkStore{
+    Blobs: make(map[string]*Blob),
+    Datasets: make(map[string]*Dataset),
+    Holds: make(map[string]*Hold),
+  }
+}
+
+func datasetHolder(dataCid string) string {
+  return "dataset:"+dataCid
+}
+
+// UploadKey identifies the upload of a manifest, codec and total size
+func UploadKey(dataChunks *model.DataChunks) string {
+  hasher := sha256.New()
+  hasher.Write([]byte{dataChunks.Codec})
+  hasher.Write(binary.BigEndian.AppendUint64(nil,dataChunks.TotalSize))
+  for _, chunkHash := range dataChunks.Manifest {
+    hasher.Write(chunkHash)
+  }
+  return hex.EncodeToString(hasher.Sum(nil))
+}
+
+func (s *ChunkStore) retain(hold *Hold, key string, data []byte) {
+  if hold.Keys[key] {
+    return
+  }
+  blob := s.Blobs[key]
+  if blob == nil {
+    blob = &Blob{Data: data}
+    s.Blobs[key] = blob
+    s.Size += uint64(len(data))
+  }
+  blob.Refs += 1
+  hold.Keys[key] = true
+}
+
+// Release drops the references of a holder, deleting the blobs left without
+// holders
+func (s *ChunkStore) Release(holder string) {
+  hold := s.Holds[holder]
+  if hold == nil {
+    return
+  }
+  for key := range hold.Keys {
+    blob := s.Blobs[key]
+    blob.Refs -= 1
+    if blob.Refs == 0 {
+      s.Size -= uint64(len(blob.Data))
+      delete(s.Blobs,key)
+    }
+  }
+  delete(s.Holds,holder)
+}
+
+// FillUpload adds to the upload the chunks of its manifest already stored
+func (s *ChunkStore) FillUpload(dataChunks *model.DataChunks) {
+  for index := dataChunks.NextChunk; index < dataChunks.TotalChunks; index += 1 {
+    if dataChunks.ChunksData[index] != nil {
+      continue
+    }
+    if blob := s.Blobs[hex.EncodeToString(dataChunks.Manifest[index])]; blob != nil {
+      dataChunks.ChunksData[index] = &model.Chunk{Data: blob.Data}
+    }
+  }
+}
+
+// RewindUpload puts back the chunks the upload already streamed, which the
+// holder keeps stored, so a new stream verifies the upload from the start.
+// Streams don't outlive the DApp, a restored upload is rewound.
+func (s *ChunkStore) RewindUpload(holder string, dataChunks *model.DataChunks) error {
+  if dataChunks.NextChunk == 0 {
+    return nil
+  }
+  hold := s.Holds[holder]
+  if hold == nil || hold.Upload != UploadKey(dataChunks) {
+    return fmt.Errorf("ChunkStore: %s doesn't hold the upload", holder)
+  }
+  for index := uint32(0); index < dataChunks.NextChunk; index += 1 {
+    blob := s.Blobs[hex.EncodeToString(dataChunks.Manifest[index])]
+    if blob == nil {
+      return fmt.Errorf("ChunkStore: streamed chunk %d of the upload isn't stored", index)
+    }
+    dataChunks.ChunksData[index] = &model.Chunk{Data: blob.Data}
+  }
+  dataChunks.NextChunk = 0
+  dataChunks.StreamedSize = 0
+  return nil
+}
+
+// HoldUpload makes the holder reference the received chunks of the upload,
+// which stay stored after they are streamed. A restarted upload releases the
+// chunks of the previous one, and an upload that doesn't fit in the store is
+// dropped.
+func (s *ChunkStore) HoldUpload(holder string, dataChunks *model.DataChunks) {
+  if dataChunks.Manifest == nil {
+    return
+  }
+  uploadKey := UploadKey(dataChunks)
+  hold := s.Holds[holder]
+  if hold != nil && hold.Upload != uploadKey {
+    s.Release(holder)
+    hold = nil
+  }
+  if hold == nil {
+    hold = &Hold{Upload: uploadKey, Keys: make(map[string]bool)}
+    s.Holds[holder] = hold
+  }
+  if hold.Dropped {
+    return
+  }
+  for index, chunk := range dataChunks.ChunksData {
+    key := hex.EncodeToString(dataChunks.Manifest[index])
+    if s.Blobs[key] == nil && !s.reserve(uint64(len(chunk.Data))) {
+      s.Release(holder)
+      s.Holds[holder] = &Hold{Upload: uploadKey, Keys: make(map[string]bool), Dropped: true}
+      return
+    }
+    s.retain(hold,key,chunk.Data)
+  }
+}
+
+// reserve makes room for new blobs of the size under the store size limit,
+// dropping the oldest datasets
+func (s *ChunkStore) reserve(size uint64) bool {
+  for s.Size+size > Limits.MaxStoreSize && len(s.DatasetOrder) > 0 {
+    s.RemoveDataset(s.DatasetOrder[0])
+  }
+  return s.Size+size <= Limits.MaxStoreSize
+}
+
+// AddDataset keeps the chunks the holder received for the upload as the
+// dataset of a CID, the upload must have been verified against the CID
+func (s *ChunkStore) AddDataset(dataCid string, holder string, dataChunks *model.DataChunks) error {
+  if s.Datasets[dataCid] != nil {
+    return nil
+  }
+  hold := s.Holds[holder]
+  if hold == nil || hold.Upload != UploadKey(dataChunks) {
+    return fmt.Errorf("ChunkStore: %s doesn't hold the upload", holder)
+  }
+  if hold.Dropped {
+    return fmt.Errorf("ChunkStore: the upload of %s didn't fit in the store", holder)
+  }
+  dataset := &Dataset{Codec: dataChunks.Codec, TotalSize: dataChunks.TotalSize, Chunks: make([]string,len(dataChunks.Manifest))}
+  for index, chunkHash := range dataChunks.Manifest {
+    dataset.Chunks[index] = hex.EncodeToString(chunkHash)
+    if s.Blobs[dataset.Chunks[index]] == nil {
+      return fmt.Errorf("ChunkStore: chunk %d of the upload isn't stored", index)
+    }
+  }
+  datasetHold := &Hold{Keys: make(map[string]bool)}
+  s.Holds[datasetHolder(dataCid)] = datasetHold
+  for _, key := range dataset.Chunks {
+    s.retain(datasetHold,key,nil)
+  }
+  s.Datasets[dataCid] = dataset
+  s.DatasetOrder = append(s.DatasetOrder,dataCid)
+  s.evict()
+  return nil
+}
+
+// evict drops the oldest datasets, but the newest, while the store is over its
+// size limit
+func (s *ChunkStore) evict() {
+  for s.Size > Limits.MaxStoreSize && len(s.DatasetOrder) > 1 {
+    s.RemoveDataset(s.DatasetOrder[0])
+  }
+}
+
+func (s *ChunkStore) RemoveDataset(dataCid string) {
+  if s.Datasets[dataCid] == nil {
+    return
+  }
+  s.Release(datasetHolder(dataCid))
+  delete(s.Datasets,dataCid)
+  for i, orderCid := range s.DatasetOrder {
+    if orderCid == dataCid {
+      s.DatasetOrder = append(s.DatasetOrder[:i],s.DatasetOrder[i+1:]...)
+      break
+    }
+  }
+}
+
+func (s *ChunkStore) HasDataset(dataCid string) bool {
+  return s.Datasets[dataCid] != nil
+}
+
+// DatasetReader streams the decompressed data of a stored dataset
+func (s *ChunkStore) DatasetReader(dataCid string) (io.Reader,error) {
+  dataset := s.Datasets[dataCid]
+  if dataset == nil {
+    return nil, fmt.Errorf("ChunkStore: No dataset stored for %s", dataCid)
+  }
+  dataChunks := &model.DataChunks{
+    ChunksData: make(map[uint32]*model.Chunk),
+    TotalChunks: uint32(len(dataset.Chunks)),
+    Codec: dataset.Codec,
+    TotalSize: dataset.TotalSize,
+  }
+  for index, key := range dataset.Chunks {
+    dataChunks.ChunksData[uint32(index)] = &model.Chunk{Data: s.Blobs[key].Data}
+  }
+  return NewChunksReader(dataChunks)
+}
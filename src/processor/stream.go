@@ -0,0 +1,154 @@
+package processor
+
+import (
+  "io"
+  "fmt"
+  "errors"
+
+  "dapp/model"
+)
+
+// Chunked uploads are verified as the chunks arrive. A ChunkStream runs the
+// decompressor and the verification (CID hasher and metric) in a goroutine
+// that reads the chunks fed to it in order. Feeding a chunk waits until the
+// goroutine consumed all of it and asks for more, or is done, so the work of
+// each input, and whether the verification ended, only depends on the data.
+
+// ErrStreamAborted ends the verification of an abandoned upload
+var ErrStreamAborted = errors.New("upload aborted")
+
+// StreamVerifier verifies the decompressed data of an upload
+type StreamVerifier func(data io.Reader) (bool,error)
+
+type ChunkStream struct {
+  chunks chan []byte
+  waiting chan struct{}
+  done chan struct{}
+  buf []byte
+  aborted bool
+  // end is the error of the reads once the chunks ended
+  end error
+  valid bool
+  err error
+}
+
+// NewChunkStream starts verifying the data of an upload compressed with the
+// codec, reading it through the decompressed size limit
+func NewChunkStream(codecId uint8, verify StreamVerifier) (*ChunkStream,error) {
+  codec, err := GetChunkCodec(codecId)
+  if err != nil {
+    return nil, fmt.Errorf("NewChunkStream: %s", err)
+  }
+  s := &ChunkStream{chunks: make(chan []byte), waiting: make(chan struct{}), done: make(chan struct{})}
+  go func() {
+    defer close(s.done)
+    zr, err := codec.NewReader(s)
+    if err != nil {
+      s.err = fmt.Errorf("ChunkStream: error decompressing data: %w", err)
+      return
+    }
+    s.valid, s.err = verify(NewBoundedReader(zr,LimitDecompressedSize,Limits.MaxDecompressedSize))
+  }()
+  s.wait()
+  return s, nil
+}
+
+// Read hands the fed chunks to the decompressor, asking for the next chunk
+// once the current one is consumed. Once the chunks ended, reads return the
+// same end without waiting, verifiers may read past the end.
+func (s *ChunkStream) Read(p []byte) (int,error) {
+  for len(s.buf) == 0 {
+    if s.end != nil {
+      return 0, s.end
+    }
+    s.waiting <- struct{}{}
+    chunk, ok := <- s.chunks
+    if !ok {
+      s.end = io.EOF
+      if s.aborted {
+        s.end = ErrStreamAborted
+      }
+      return 0, s.end
+    }
+    s.buf = chunk
+  }
+  n := copy(p,s.buf)
+  s.buf = s.buf[n:]
+  return n, nil
+}
+
+// wait blocks until the verification needs more data or is done
+func (s *ChunkStream) wait() {
+  select {
+  case <- s.waiting:
+  case <- s.done:
+  }
+}
+
+// Done tells whether the verification ended, which may happen before the last
+// chunk when the data is wrong
+func (s *ChunkStream) Done() bool {
+  select {
+  case <- s.done:
+    return true
+  default:
+    return false
+  }
+}
+
+// Write feeds the next chunk and tells whether the verification ended
+func (s *ChunkStream) Write(data []byte) bool {
+  if s.Done() {
+    return true
+  }
+  s.chunks <- data
+  s.wait()
+  return s.Done()
+}
+
+// Close ends the data and returns the verification result
+func (s *ChunkStream) Close() (bool,error) {
+  if !s.Done() {
+    close(s.chunks)
+    <- s.done
+  }
+  return s.valid, s.err
+}
+
+// Abort ends the verification of an abandoned upload
+func (s *ChunkStream) Abort() {
+  if !s.Done() {
+    s.aborted = true
+    close(s.chunks)
+    <- s.done
+  }
+}
+
+// StreamDataChunks feeds the stream the received chunks that follow the
+// streamed ones, dropping them from the upload. It returns whether the
+// verification ended, either because it failed or all the chunks were fed.
+func StreamDataChunks(dataChunks *model.DataChunks) (bool,error) {
+  if dataChunks.Stream == nil {
+    return false, fmt.Errorf("StreamDataChunks: Upload has no stream")
+  }
+  for dataChunks.NextChunk < dataChunks.TotalChunks && dataChunks.ChunksData[dataChunks.NextChunk] != nil {
+    chunk := dataChunks.ChunksData[dataChunks.NextChunk]
+    if dataChunks.StreamedSize + uint64(len(chunk.Data)) > dataChunks.TotalSize {
+      return false, fmt.Errorf("StreamDataChunks: Chunks have more than %d bytes", dataChunks.TotalSize)
+    }
+    done := dataChunks.Stream.Write(chunk.Data)
+    delete(dataChunks.ChunksData,dataChunks.NextChunk)
+    dataChunks.StreamedSize += uint64(len(chunk.Data))
+    dataChunks.NextChunk += 1
+    if done {
+      return true, nil
+    }
+  }
+  if dataChunks.NextChunk < dataChunks.TotalChunks {
+    return false, nil
+  }
+  if dataChunks.StreamedSize != dataChunks.TotalSize {
+    return false, fmt.Errorf("StreamDataChunks: Chunks have %d bytes, expected %d", dataChunks.StreamedSize, dataChunks.TotalSize)
+  }
+  return true, nil
+}
@@ -0,0 +1,203 @@
+package processor
+
+import (
+  "fmt"
+  "encoding/binary"
+  cid "github.com/ipfs/go-cid"
+  mh "github.com/multiformats/go-multihash"
+)
+
+// UnixFS layout used by `ipfs add` with the default options: fixed size
+// chunker of 256KiB and balanced layout with up to 174 links per node. Leaves
+// are either UnixFS file nodes (CIDv0 default) or raw blocks (CIDv1 default).
+const UnixFsChunkSize = 256 * 1024
+const UnixFsMaxLinks = 174
+
+const unixFsFileType = 2
+
+func UnixFsCidPrefix(version uint64) cid.Prefix {
+  pref := DataCidPrefix()
+  pref.Version = version
+  pref.Codec = cid.DagProtobuf
+  return pref
+}
+
+type unixFsLink struct {
+  cid cid.Cid
+  tsize uint64
+  fileSize uint64
+}
+
+// unixFsWriter builds the balanced UnixFS DAG while data is written to it,
+// keeping only the current chunk and the open node of each tree level
+type unixFsWriter struct {
+  prefix cid.Prefix
+  rawLeaves bool
+  chunk []byte
+  levels [][]unixFsLink
+}
+
+func newUnixFsWriter(prefix cid.Prefix, rawLeaves bool) *unixFsWriter {
+  return &unixFsWriter{prefix:prefix,rawLeaves:rawLeaves,chunk:make([]byte,0,UnixFsChunkSize)}
+}
+
+// newUnixFsWriters builds a writer for each DAG `ipfs add` may produce with the
+// prefix hash function, as a dag-pb CID doesn't tell how its leaves were built.
+// The writer of the prefix version default comes first.
+func newUnixFsWriters(prefix cid.Prefix) []*unixFsWriter {
+  v0Prefix := UnixFsCidPrefix(0)
+  v0Prefix.MhType = prefix.MhType
+  v1Prefix := UnixFsCidPrefix(1)
+  v1Prefix.MhType = prefix.MhType
+
+  writers := []*unixFsWriter{newUnixFsWriter(v1Prefix,true),newUnixFsWriter(v1Prefix,false)}
+  if prefix.MhType == mh.SHA2_256 {
+    // --cid-version=0, CIDv0 links and UnixFS file leaves
+    v0Writer := newUnixFsWriter(v0Prefix,false)
+    if prefix.Version == 0 {
+      writers = append([]*unixFsWriter{v0Writer},writers...)
+    } else {
+      writers = append(writers,v0Writer)
+    }
+  }
+  return writers
+}
+
+func (w *unixFsWriter) Write(p []byte) (int,error) {
+  written := len(p)
+  for len(p) > 0 {
+    n := UnixFsChunkSize - len(w.chunk)
+    if n > len(p) {
+      n = len(p)
+    }
+    w.chunk = append(w.chunk,p[:n]...)
+    p = p[n:]
+    if len(w.chunk) == UnixFsChunkSize {
+      if err := w.addLeaf(); err != nil {
+        return written - len(p), err
+      }
+    }
+  }
+  return written, nil
+}
+
+func (w *unixFsWriter) addLeaf() error {
+  var leaf unixFsLink
+  if !w.rawLeaves {
+    block := encodeDagPbNode(nil,encodeUnixFsFile(w.chunk,uint64(len(w.chunk)),nil))
+    leafCid, err := w.prefix.Sum(block)
+    if err != nil {
+      return fmt.Errorf("unixFsWriter: error hashing leaf: %s", err)
+    }
+    leaf = unixFsLink{cid:leafCid,tsize:uint64(len(block)),fileSize:uint64(len(w.chunk))}
+  } else {
+    leafPrefix := w.prefix
+    leafPrefix.Version = 1
+    leafPrefix.Codec = cid.Raw
+    leafCid, err := leafPrefix.Sum(w.chunk)
+    if err != nil {
+      return fmt.Errorf("unixFsWriter: error hashing leaf: %s", err)
+    }
+    leaf = unixFsLink{cid:leafCid,tsize:uint64(len(w.chunk)),fileSize:uint64(len(w.chunk))}
+  }
+  w.chunk = w.chunk[:0]
+  return w.push(0,leaf)
+}
+
+// push adds a link to the open node of a level, closing the node into the
+// level above once it is full and more links arrive
+func (w *unixFsWriter) push(level int, link unixFsLink) error {
+  if level == len(w.levels) {
+    w.levels = append(w.levels,nil)
+  }
+  if len(w.levels[level]) == UnixFsMaxLinks {
+    node, err := w.closeNode(level)
+    if err != nil {
+      return err
+    }
+    if err := w.push(level+1,node); err != nil {
+      return err
+    }
+  }
+  w.levels[level] = append(w.levels[level],link)
+  return nil
+}
+
+func (w *unixFsWriter) closeNode(level int) (unixFsLink,error) {
+  links := w.levels[level]
+  w.levels[level] = nil
+
+  var fileSize uint64
+  var tsize uint64
+  blockSizes := make([]uint64,len(links))
+  for i, link := range links {
+    fileSize += link.fileSize
+    tsize += link.tsize
+    blockSizes[i] = link.fileSize
+  }
+  block := encodeDagPbNode(links,encodeUnixFsFile(nil,fileSize,blockSizes))
+  nodeCid, err := w.prefix.Sum(block)
+  if err != nil {
+    return unixFsLink{}, fmt.Errorf("unixFsWriter: error hashing node: %s", err)
+  }
+  return unixFsLink{cid:nodeCid,tsize:tsize+uint64(len(block)),fileSize:fileSize}, nil
+}
+
+func (w *unixFsWriter) Sum() (cid.Cid,error) {
+  // the last chunk, or the single empty leaf of empty data
+  if len(w.chunk) > 0 || len(w.levels) == 0 {
+    if err := w.addLeaf(); err != nil {
+      return cid.Cid{}, err
+    }
+  }
+  for level := 0; level < len(w.levels); level += 1 {
+    if level == len(w.levels)-1 && len(w.levels[level]) == 1 {
+      return w.levels[level][0].cid, nil
+    }
+    node, err := w.closeNode(level)
+    if err != nil {
+      return cid.Cid{}, err
+    }
+    if err := w.push(level+1,node); err != nil {
+      return cid.Cid{}, err
+    }
+  }
+  return cid.Cid{}, fmt.Errorf("unixFsWriter: empty DAG")
+}
+
+func appendProtoVarint(buf []byte, field uint64, value uint64) []byte {
+  buf = binary.AppendUvarint(buf,field << 3)
+  return binary.AppendUvarint(buf,value)
+}
+
+func appendProtoBytes(buf []byte, field uint64, value []byte) []byte {
+  buf = binary.AppendUvarint(buf,field << 3 | 2)
+  buf = binary.AppendUvarint(buf,uint64(len(value)))
+  return append(buf,value...)
+}
+
+// encodeUnixFsFile encodes a UnixFS Data message of type File
+func encodeUnixFsFile(data []byte, fileSize uint64, blockSizes []uint64) []byte {
+  buf := appendProtoVarint(nil,1,unixFsFileType)
+  if len(data) > 0 {
+    buf = appendProtoBytes(buf,2,data)
+  }
+  buf = appendProtoVarint(buf,3,fileSize)
+  for _, blockSize := range blockSizes {
+    buf = appendProtoVarint(buf,4,blockSize)
+  }
+  return buf
+}
+
+// encodeDagPbNode encodes a dag-pb PBNode, links come before data as the
+// dag-pb spec requires and links always carry an empty name, as go-ipfs does
+func encodeDagPbNode(links []unixFsLink, data []byte) []byte {
+  var buf []byte
+  for _, link := range links {
+    pbLink := appendProtoBytes(nil,1,link.cid.Bytes())
+    pbLink = appendProtoBytes(pbLink,2,nil)
+    pbLink = appendProtoVarint(pbLink,3,link.tsize)
+    buf = appendProtoBytes(buf,2,pbLink)
+  }
+  return appendProtoBytes(buf,1,data)
+}
@@ -0,0 +1,259 @@
+package snapshot
+
+import (
+  "os"
+  "fmt"
+  "sort"
+  "path/filepath"
+  "encoding/json"
+
+  "dapp/model"
+  "dapp/processor"
+)
+
+// A snapshot is the whole DApp state in json: users, claims, the pending
+// uploads of the claims and the chunk store. Maps are encoded with sorted
+// keys, so the same state always gives the same snapshot. Uploads keep their
+// chunks and position but not their streams, which don't outlive the DApp:
+// restored uploads are rewound and verified again from their first chunk. The
+// version tells how to read older snapshots, migrations bring them up to the
+// current version before they are decoded.
+
+// Version of the snapshots written
+const Version uint32 = 1
+
+// Migration updates the fields of a snapshot of a version to the next one
+type Migration func(fields map[string]json.RawMessage) error
+
+// Migrations by the version they migrate from
+var Migrations = map[uint32]Migration{}
+
+// Upload is a claim upload, Uploader is "" for the claimer
+type Upload struct {
+  Uploader string                 `json:"uploader"`
+  ChunksData map[uint32][]byte    `json:"chunksData"`
+  TotalChunks uint32              `json:"totalChunks"`
+  Codec uint8                     `json:"codec"`
+  TotalSize uint64                `json:"totalSize"`
+  Manifest [][]byte               `json:"manifest"`
+  NextChunk uint32                `json:"nextChunk"`
+  StreamedSize uint64             `json:"streamedSize"`
+  LastEdited uint64               `json:"lastEdited"`
+}
+
+type Snapshot struct {
+  Version uint32                  `json:"version"`
+  InputIndex uint64               `json:"inputIndex"`
+  Users map[string]*model.User    `json:"users"`
+  Claims map[string]*model.Claim  `json:"claims"`
+  Uploads map[string][]*Upload    `json:"uploads"`
+  Store *processor.ChunkStore     `json:"store"`
+}
+
+// UploadHolder is the chunk store holder of a claim upload
+type UploadHolder func(claimId string, uploader string) string
+
+func captureUpload(uploader string, dataChunks *model.DataChunks) *Upload {
+  upload := &Upload{
+    Uploader: uploader,
+    ChunksData: make(map[uint32][]byte),
+    TotalChunks: dataChunks.TotalChunks,
+    Codec: dataChunks.Codec,
+    TotalSize: dataChunks.TotalSize,
+    Manifest: dataChunks.Manifest,
+    NextChunk: dataChunks.NextChunk,
+    StreamedSize: dataChunks.StreamedSize,
+    LastEdited: dataChunks.LastEdited,
+  }
+  for index, chunk := range dataChunks.ChunksData {
+    upload.ChunksData[index] = chunk.Data
+  }
+  return upload
+}
+
+// Capture takes the state after the input, claims are copied without their
+// uploads, which are kept apart
+func Capture(inputIndex uint64, users map[string]*model.User, claims map[string]*model.Claim, store *processor.ChunkStore) *Snapshot {
+  snapshot := &Snapshot{
+    Version: Version,
+    InputIndex: inputIndex,
+    Users: users,
+    Claims: make(map[string]*model.Claim),
+    Uploads: make(map[string][]*Upload),
+    Store: store,
+  }
+  for claimId, claim := range claims {
+    claimCopy := *claim
+    claimCopy.DataChunks = nil
+    claimCopy.Uploads = nil
+    snapshot.Claims[claimId] = &claimCopy
+
+    var uploads []*Upload
+    if claim.DataChunks != nil {
+      uploads = append(uploads,captureUpload("",claim.DataChunks))
+    }
+    uploaders := make([]string,0,len(claim.Uploads))
+    for uploader := range claim.Uploads {
+      uploaders = append(uploaders,uploader)
+    }
+    sort.Strings(uploaders)
+    for _, uploader := range uploaders {
+      uploads = append(uploads,captureUpload(uploader,claim.Uploads[uploader]))
+    }
+    if len(uploads) > 0 {
+      snapshot.Uploads[claimId] = uploads
+    }
+  }
+  return snapshot
+}
+
+// Write saves the snapshot to the path, replacing the previous one only once
+// it is complete
+func Write(path string, snapshot *Snapshot) error {
+  snapshotJson, err := json.Marshal(snapshot)
+  if err != nil {
+    return fmt.Errorf("Write: error encoding snapshot: %s", err)
+  }
+  tmpFile, err := os.CreateTemp(filepath.Dir(path),filepath.Base(path)+".*")
+  if err != nil {
+    return fmt.Errorf("Write: error creating snapshot file: %s", err)
+  }
+  defer os.Remove(tmpFile.Name())
+  if _, err := tmpFile.Write(snapshotJson); err != nil {
+    tmpFile.Close()
+    return fmt.Errorf("Write: error writing snapshot: %s", err)
+  }
+  if err := tmpFile.Close(); err != nil {
+    return fmt.Errorf("Write: error writing snapshot: %s", err)
+  }
+  if err := os.Rename(tmpFile.Name(),path); err != nil {
+    return fmt.Errorf("Write: error replacing snapshot: %s", err)
+  }
+  return nil
+}
+
+// Decode reads a snapshot of any known version, migrating it to the current one
+func Decode(snapshotJson []byte) (*Snapshot,error) {
+  return decode(snapshotJson,Version)
+}
+
+func decode(snapshotJson []byte, current uint32) (*Snapshot,error) {
+  var fields map[string]json.RawMessage
+  if err := json.Unmarshal(snapshotJson,&fields); err != nil {
+    return nil, fmt.Errorf("Decode: invalid snapshot: %s", err)
+  }
+  var version uint32
+  if err := json.Unmarshal(fields["version"],&version); err != nil {
+    return nil, fmt.Errorf("Decode: invalid snapshot version: %s", err)
+  }
+  if version == 0 || version > current {
+    return nil, fmt.Errorf("Decode: unsupported snapshot version %d, the current version is %d", version, current)
+  }
+  for ; version < current; version += 1 {
+    migration := Migrations[version]
+    if migration == nil {
+      return nil, fmt.Errorf("Decode: no migration from snapshot version %d", version)
+    }
+    if err := migration(fields); err != nil {
+      return nil, fmt.Errorf("Decode: error migrating snapshot version %d: %s", version, err)
+    }
+    versionJson, _ := json.Marshal(version+1)
+    fields["version"] = versionJson
+  }
+  migratedJson, err := json.Marshal(fields)
+  if err != nil {
+    return nil, fmt.Errorf("Decode: %s", err)
+  }
+  snapshot := &Snapshot{}
+  if err := json.Unmarshal(migratedJson,snapshot); err != nil {
+    return nil, fmt.Errorf("Decode: invalid snapshot: %s", err)
+  }
+  return snapshot, nil
+}
+
+// Read loads the snapshot at the path
+func Read(path string) (*Snapshot,error) {
+  snapshotJson, err := os.ReadFile(path)
+  if err != nil {
+    return nil, fmt.Errorf("Read: %w", err)
+  }
+  return Decode(snapshotJson)
+}
+
+func restoreUser(user *model.User) {
+  if user.OpenClaims == nil {
+    user.OpenClaims = make(map[string]struct{})
+  }
+  if user.OpenDisputes == nil {
+    user.OpenDisputes = make(map[string]struct{})
+  }
+  if user.Delegates == nil {
+    user.Delegates = make(map[string]struct{})
+  }
+  if user.ClaimDelegates == nil {
+    user.ClaimDelegates = make(map[string]map[string]struct{})
+  }
+}
+
+// Restore gives the state of the snapshot, with the uploads of the claims
+// rewound from the chunk store
+func (s *Snapshot) Restore(uploadHolder UploadHolder) (map[string]*model.User,map[string]*model.Claim,*processor.ChunkStore,error) {
+  users := s.Users
+  if users == nil {
+    users = make(map[string]*model.User)
+  }
+  for _, user := range users {
+    restoreUser(user)
+  }
+  claims := s.Claims
+  if claims == nil {
+    claims = make(map[string]*model.Claim)
+  }
+  store := s.Store
+  if store == nil {
+    store = processor.NewChunkStore()
+  }
+  if store.Blobs == nil {
+    store.Blobs = make(map[string]*processor.Blob)
+  }
+  if store.Datasets == nil {
+    store.Datasets = make(map[string]*processor.Dataset)
+  }
+  if store.Holds == nil {
+    store.Holds = make(map[string]*processor.Hold)
+  }
+
+  for claimId, uploads := range s.Uploads {
+    claim := claims[claimId]
+    if claim == nil {
+      return nil, nil, nil, fmt.Errorf("Restore: uploads of unknown claim %s", claimId)
+    }
+    for _, upload := range uploads {
+      dataChunks := &model.DataChunks{
+        ChunksData: make(map[uint32]*model.Chunk),
+        TotalChunks: upload.TotalChunks,
+        Codec: upload.Codec,
+        TotalSize: upload.TotalSize,
+        Manifest: upload.Manifest,
+        NextChunk: upload.NextChunk,
+        StreamedSize: upload.StreamedSize,
+        LastEdited: upload.LastEdited,
+      }
+      for index, data := range upload.ChunksData {
+        dataChunks.ChunksData[index] = &model.Chunk{Data: data}
+      }
+      if err := store.RewindUpload(uploadHolder(claimId,upload.Uploader),dataChunks); err != nil {
+        return nil, nil, nil, fmt.Errorf("Restore: claim %s: %s", claimId, err)
+      }
+      if upload.Uploader == "" {
+        claim.DataChunks = dataChunks
+        continue
+      }
+      if claim.Uploads == nil {
+        claim.Uploads = make(map[string]*model.DataChunks)
+      }
+      claim.Uploads[upload.Uploader] = dataChunks
+    }
+  }
+  return users, claims, store, nil
+}
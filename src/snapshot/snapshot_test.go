@@ -0,0 +1,204 @@
+package snapshot
+
+import (
+  "bytes"
+  "encoding/json"
+  "io"
+  "path/filepath"
+  "strings"
+  "testing"
+
+  "dapp/model"
+  "dapp/processor"
+)
+
+func uploadHolder(claimId string, uploader string) string {
+  if uploader == "" {
+    return claimId
+  }
+  return claimId + ":" + uploader
+}
+
+var testData = []byte("a,b,c\n" + strings.Repeat("1,value 7,1\n2,,2\n3,value 21,\n", 700))
+
+func newUser() *model.User {
+  return &model.User{OpenClaims: make(map[string]struct{}), OpenDisputes: make(map[string]struct{}), Delegates: make(map[string]struct{}), ClaimDelegates: make(map[string]map[string]struct{})}
+}
+
+// streamedData collects the data the upload verification reads
+func streamedData(t *testing.T, dataChunks *model.DataChunks, data *[]byte) {
+  stream, err := processor.NewChunkStream(dataChunks.Codec, func(r io.Reader) (bool, error) {
+    read, err := io.ReadAll(r)
+    *data = read
+    return err == nil, err
+  })
+  if err != nil {
+    t.Fatal(err)
+  }
+  dataChunks.Stream = stream
+}
+
+// a state with an upload halfway streamed, and a third party upload
+func newState(t *testing.T) (map[string]*model.User, map[string]*model.Claim, *processor.ChunkStore, []string) {
+  data := testData
+  chunks, err := processor.PrepareDataToSendWithCodec(data, 1024, "none", processor.DefaultCompressionLevel)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if len(chunks) < 4 {
+    t.Fatalf("expected at least 4 chunks, got %d", len(chunks))
+  }
+
+  users := map[string]*model.User{"claimer": newUser(), "disputer": newUser()}
+  users["claimer"].OpenDisputes["claim"] = struct{}{}
+  users["claimer"].Delegates["delegate"] = struct{}{}
+  claims := map[string]*model.Claim{
+    "claim": {UserAddress: "claimer", DisputingUserAddress: "disputer", Value: 5, Metric: "blankCells", Status: model.Disputing, LastEdited: 10, Bisection: &model.Bisection{Leaves: 4, Width: 1}},
+    "done": {UserAddress: "claimer", Status: model.Validated, LastEdited: 5},
+  }
+  store := processor.NewChunkStore()
+
+  upload := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk)}
+  claims["claim"].DataChunks = upload
+  for _, chunk := range chunks[:len(chunks)/2] {
+    if err := processor.UpdateDataChunks(upload, chunk); err != nil {
+      t.Fatal(err)
+    }
+  }
+  store.HoldUpload(uploadHolder("claim", ""), upload)
+  var streamed []byte
+  streamedData(t, upload, &streamed)
+  if done, err := processor.StreamDataChunks(upload); done || err != nil {
+    t.Fatalf("stream done %v %v", done, err)
+  }
+  if upload.NextChunk == 0 {
+    t.Fatalf("nothing streamed")
+  }
+
+  provided := &model.DataChunks{ChunksData: make(map[uint32]*model.Chunk), LastEdited: 9}
+  claims["claim"].Uploads = map[string]*model.DataChunks{"provider": provided}
+  if err := processor.UpdateDataChunks(provided, chunks[0]); err != nil {
+    t.Fatal(err)
+  }
+  store.HoldUpload(uploadHolder("claim", "provider"), provided)
+  return users, claims, store, chunks
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+  users, claims, store, chunks := newState(t)
+  defer claims["claim"].DataChunks.Stream.Abort()
+
+  snapshot := Capture(7, users, claims, store)
+  snapshotJson, err := json.Marshal(snapshot)
+  if err != nil {
+    t.Fatal(err)
+  }
+  // the same state gives the same snapshot
+  for i := 0; i < 5; i += 1 {
+    again, _ := json.Marshal(Capture(7, users, claims, store))
+    if !bytes.Equal(again, snapshotJson) {
+      t.Fatalf("snapshot isn't deterministic")
+    }
+  }
+  if claims["claim"].DataChunks == nil || claims["claim"].Uploads == nil {
+    t.Fatalf("capture changed the claims")
+  }
+
+  path := filepath.Join(t.TempDir(), "state.json")
+  if err := Write(path, snapshot); err != nil {
+    t.Fatal(err)
+  }
+  read, err := Read(path)
+  if err != nil {
+    t.Fatal(err)
+  }
+  restoredUsers, restoredClaims, restoredStore, err := read.Restore(uploadHolder)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if read.Version != Version || read.InputIndex != 7 {
+    t.Errorf("snapshot version %d input %d", read.Version, read.InputIndex)
+  }
+
+  // the restored state takes the same snapshot, but for the rewound upload
+  claim := restoredClaims["claim"]
+  if claim.Status != model.Disputing || claim.Bisection == nil || claim.Bisection.Leaves != 4 || restoredClaims["done"].Status != model.Validated {
+    t.Errorf("claims weren't restored: %+v", restoredClaims)
+  }
+  if _, ok := restoredUsers["claimer"].OpenDisputes["claim"]; !ok {
+    t.Errorf("users weren't restored: %+v", restoredUsers["claimer"])
+  }
+  if _, ok := restoredUsers["claimer"].Delegates["delegate"]; !ok {
+    t.Errorf("delegates weren't restored: %+v", restoredUsers["claimer"])
+  }
+  if restoredUsers["disputer"].ClaimDelegates == nil {
+    t.Errorf("restored user maps are nil")
+  }
+  storeJson, _ := json.Marshal(store)
+  restoredStoreJson, _ := json.Marshal(restoredStore)
+  if !bytes.Equal(storeJson, restoredStoreJson) {
+    t.Errorf("chunk store wasn't restored")
+  }
+  if provided := claim.Uploads["provider"]; provided == nil || len(provided.ChunksData) != 1 || provided.LastEdited != 9 {
+    t.Errorf("third party upload wasn't restored: %+v", provided)
+  }
+
+  // the upload is rewound and verified from the start as the rest arrives
+  upload := claim.DataChunks
+  if upload.NextChunk != 0 || upload.StreamedSize != 0 || upload.Stream != nil {
+    t.Fatalf("upload wasn't rewound: next %d streamed %d", upload.NextChunk, upload.StreamedSize)
+  }
+  if missing := upload.MissingChunks(); uint32(len(missing)) != upload.TotalChunks-uint32(len(chunks)/2) {
+    t.Errorf("missing %v after restore", missing)
+  }
+  for _, chunk := range chunks[len(chunks)/2:] {
+    if err := processor.UpdateDataChunks(upload, chunk); err != nil {
+      t.Fatal(err)
+    }
+  }
+  var streamed []byte
+  streamedData(t, upload, &streamed)
+  if done, err := processor.StreamDataChunks(upload); !done || err != nil {
+    t.Fatalf("stream done %v %v", done, err)
+  }
+  if valid, err := upload.Stream.Close(); !valid || err != nil {
+    t.Fatalf("stream failed: %v", err)
+  }
+  if !bytes.Equal(streamed, testData) {
+    t.Errorf("restored upload streamed other data")
+  }
+}
+
+func TestSnapshotVersions(t *testing.T) {
+  users, claims, store, _ := newState(t)
+  defer claims["claim"].DataChunks.Stream.Abort()
+  snapshotJson, err := json.Marshal(Capture(3, users, claims, store))
+  if err != nil {
+    t.Fatal(err)
+  }
+
+  // snapshots of newer versions aren't read
+  if _, err := decode(snapshotJson, Version-1); err == nil || !strings.Contains(err.Error(), "unsupported") {
+    t.Errorf("expected unsupported version error, got %v", err)
+  }
+  if _, err := Decode([]byte(`{"version":0}`)); err == nil {
+    t.Errorf("expected error decoding version 0")
+  }
+
+  // older versions are migrated to the current one
+  if _, err := decode(snapshotJson, Version+1); err == nil || !strings.Contains(err.Error(), "no migration") {
+    t.Errorf("expected missing migration error, got %v", err)
+  }
+  Migrations[Version] = func(fields map[string]json.RawMessage) error {
+    fields["inputIndex"] = json.RawMessage("42")
+    return nil
+  }
+  defer delete(Migrations, Version)
+  migrated, err := decode(snapshotJson, Version+1)
+  if err != nil {
+    t.Fatal(err)
+  }
+  if migrated.Version != Version+1 || migrated.InputIndex != 42 {
+    t.Errorf("snapshot wasn't migrated: version %d input %d", migrated.Version, migrated.InputIndex)
+  }
+}